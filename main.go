@@ -2,10 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Clever/stealth/store"
 	"github.com/Clever/stealth/store/util"
@@ -18,35 +28,131 @@ var (
 	cmdDupes        = app.Command("dupes", "Finds duplicate values of a secret.")
 	dupeEnvironment = cmdDupes.Flag("environment", "Environment that the secret belongs to.").Required().String()
 	dupeService     = cmdDupes.Flag("service", "Service that key belongs to.").Required().String()
-	dupeKey         = cmdDupes.Flag("key", "Key to find duplicate values of.").Required().String()
+	dupeKey         = cmdDupes.Flag("key", "Key to find duplicate values of. Nested keys use slashes, e.g. db/password.").Required().String()
 	updateWith      = cmdDupes.Flag("update-with", "Value to update the duplicate values with.").Default("").String()
 
 	cmdDelete         = app.Command("delete", "Deletes all versions of a secret.")
 	deleteEnvironment = cmdDelete.Flag("environment", "Environment that the secret belongs to.").Required().String()
 	deleteService     = cmdDelete.Flag("service", "Service that key belongs to.").Required().String()
-	deleteKey         = cmdDelete.Flag("key", "Key to find duplicate values of.").Required().String()
+	deleteKey         = cmdDelete.Flag("key", "Key to delete. Nested keys use slashes, e.g. db/password.").Required().String()
+	deletePermanent   = cmdDelete.Flag("permanent", "Delete the secret permanently, instead of moving it to the trash.").Bool()
+
+	cmdTrash                = app.Command("trash", "Manages deleted secrets, which are kept in the trash until purged.")
+	cmdTrashList            = cmdTrash.Command("list", "Lists the secrets in the trash.")
+	trashListEnvironment    = cmdTrashList.Flag("environment", "Environment that the secrets belong to.").Required().String()
+	cmdTrashRestore         = cmdTrash.Command("restore", "Restores a secret and its history from the trash.")
+	trashRestoreEnvironment = cmdTrashRestore.Flag("environment", "Environment that the secret belongs to.").Required().String()
+	trashRestoreService     = cmdTrashRestore.Flag("service", "Service that the key belongs to.").Required().String()
+	trashRestoreKey         = cmdTrashRestore.Flag("key", "Key to restore. Nested keys use slashes, e.g. db/password.").Required().String()
+	trashRestoreDeletedAt   = cmdTrashRestore.Flag("deleted-at", "Which deletion to restore, as shown by trash list (RFC3339). Defaults to the most recent.").String()
+	cmdTrashPurge           = cmdTrash.Command("purge", "Permanently deletes secrets that have been in the trash longer than the retention period.")
+	trashPurgeEnvironment   = cmdTrashPurge.Flag("environment", "Environment that the secrets belong to.").Required().String()
+	trashPurgeRetention     = cmdTrashPurge.Flag("retention", "How long to keep trashed secrets.").Default(store.DefaultTrashRetention.String()).Duration()
+	trashPurgeYes           = cmdTrashPurge.Flag("yes", "Don't ask for confirmation.").Bool()
 
 	cmdWrite         = app.Command("write", "Write a new version of a secret.")
 	writeEnvironment = cmdWrite.Flag("environment", "Environment that the secret belongs to.").Required().String()
 	writeService     = cmdWrite.Flag("service", "Service that the key belongs to.").Required().String()
-	writeKey         = cmdWrite.Flag("key", "Key to write.").Required().String()
+	writeKey         = cmdWrite.Flag("key", "Key to write. Nested keys use slashes, e.g. db/password.").Required().String()
 	writeValue       = cmdWrite.Flag("value", "Value to write.").Required().String()
+	writeIfVersion   = cmdWrite.Flag("if-version", "Only write if the secret's latest version is N, so that concurrent writes aren't lost. Versions are 0-indexed.").PlaceHolder("N").String()
+	writeExpiresIn   = cmdWrite.Flag("expires-in", "Make the secret expire after this long, e.g. 90d or 12h. Once expired it can't be read.").PlaceHolder("DURATION").String()
+
+	cmdRollback         = app.Command("rollback", "Restores a previous version of a secret, by writing it as a new version.")
+	rollbackEnvironment = cmdRollback.Flag("environment", "Environment that the secret belongs to.").Required().String()
+	rollbackService     = cmdRollback.Flag("service", "Service that the key belongs to.").Required().String()
+	rollbackKey         = cmdRollback.Flag("key", "Key to roll back. Nested keys use slashes, e.g. db/password.").Required().String()
+	rollbackVersion     = cmdRollback.Flag("version", "Version to restore. Versions are 0-indexed.").Required().Int()
+
+	cmdHistory         = app.Command("history", "Shows who changed a secret and when, without showing its values.")
+	historyEnvironment = cmdHistory.Flag("environment", "Environment that the secret belongs to.").Required().String()
+	historyService     = cmdHistory.Flag("service", "Service that the key belongs to.").Required().String()
+	historyKey         = cmdHistory.Flag("key", "Key to show the history of. Nested keys use slashes, e.g. db/password.").Required().String()
+	historyFormat      = cmdHistory.Flag("format", "Output format: table or json.").Default("table").Enum("table", "json")
+
+	cmdLabel         = app.Command("label", "Attaches a label, such as stable, to a version of a secret. If another version has the label, it is moved.")
+	labelEnvironment = cmdLabel.Flag("environment", "Environment that the secret belongs to.").Required().String()
+	labelService     = cmdLabel.Flag("service", "Service that the key belongs to.").Required().String()
+	labelKey         = cmdLabel.Flag("key", "Key to label. Nested keys use slashes, e.g. db/password.").Required().String()
+	labelVersion     = cmdLabel.Flag("version", "Version to attach the label to. Versions are 0-indexed.").Required().Int()
+	labelName        = cmdLabel.Flag("label", "Label to attach, e.g. stable or canary.").Required().String()
+
+	cmdExpiring         = app.Command("expiring", "Lists secrets that expire soon, or have expired.")
+	expiringEnvironment = cmdExpiring.Flag("environment", "Environment that the secrets belong to.").Required().String()
+	expiringWithin      = cmdExpiring.Flag("within", "List secrets that expire within this long, e.g. 30d or 12h.").Default("30d").String()
 
-	cmdHealth         = app.Command("health", "Checks for health of all secrets for a service across 4 AWS regions, ensuring there is no discrepancies in values.")
+	cmdList         = app.Command("list", "Lists the secrets of a service.")
+	listEnvironment = cmdList.Flag("environment", "Environment that the secrets belong to.").Required().String()
+	listService     = cmdList.Flag("service", "Service that the keys belong to.").Required().String()
+	listPrefix      = cmdList.Flag("prefix", "Only list keys that start with this prefix, e.g. db/.").Default("").String()
+
+	cmdHealth         = app.Command("health", "Checks for health of all secrets for a service across the environment's configured regions, ensuring there is no discrepancies in values.")
 	healthEnvironment = cmdHealth.Flag("environment", "Environment that the secret belongs to.").Required().String()
 	healthService     = cmdHealth.Flag("service", "Service that the key belongs to.").Required().String()
 	assumeRole        = app.Flag("assume", "If set, stealth will assume the SecretsManagement role (based on --environment)").Bool()
+	storeURL          = app.Flag("store", "URL of the secret store to use, e.g. ssm:// or memory://. The scheme selects the backend.").Default("ssm://").Envar("STEALTH_STORE").String()
+	configFile        = app.Flag("config", "Path to a JSON file defining additional environments, or overriding the defaults.").Envar("STEALTH_CONFIG").String()
+	rateLimit         = app.Flag("rate-limit", "Most requests per second to make to each AWS region (ssm:// only). A negative value turns off rate limiting.").PlaceHolder("RPS").String()
+	maxRetries        = app.Flag("max-retries", "How many times to retry a throttled request, with exponential backoff (ssm:// only).").PlaceHolder("N").String()
+	consistency       = app.Flag("consistency", "Which regions to read secrets from (ssm:// only): strict reads every region and fails if any fails, primary reads only the primary region, and available reads the first region that answers.").PlaceHolder("MODE").String()
+	timeout           = app.Flag("timeout", "If set, abort the command once this much time has passed (e.g. 30s, 5m).").Duration()
+	policyFile        = app.Flag("policy", "Path to a JSON policy file that allows or denies operations by environment, service, key and caller.").Envar("STEALTH_POLICY").String()
+	auditTarget       = app.Flag("audit", "Where to record an audit trail of the secrets changed and read: - for stdout, an http(s):// webhook URL or a file path.").Envar("STEALTH_AUDIT").String()
+	auditKey          = app.Flag("audit-key", "Key to fingerprint values in the audit trail with. Required with --audit.").Envar("STEALTH_AUDIT_KEY").String()
+
+	// policy is loaded from --policy, if set
+	policy *store.Policy
+	// auditSink is opened from --audit, if set
+	auditSink store.AuditSink
 )
 
 func main() {
 	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if *configFile != "" {
+		if err := store.LoadEnvironments(*configFile); err != nil {
+			log.Fatalf("Failed to load config: %s", err)
+		}
+	}
+	if *policyFile != "" {
+		var err error
+		if policy, err = store.LoadPolicy(*policyFile); err != nil {
+			log.Fatalf("Failed to load policy: %s", err)
+		}
+	}
+	if *auditTarget != "" {
+		if *auditKey == "" {
+			log.Fatal("--audit-key is required to record an audit trail")
+		}
+		var err error
+		if auditSink, err = store.OpenAuditSink(*auditTarget); err != nil {
+			log.Fatalf("Failed to open audit trail: %s", err)
+		}
+		if closer, ok := auditSink.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	// Cancel in-flight store calls on Ctrl-C or SIGTERM. Once the context is done, the default signal
+	// behavior is restored, so a second Ctrl-C terminates immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
 	switch command {
 	case cmdDupes.FullCommand():
-		s := store.NewParameterStore(50, *dupeEnvironment, *assumeRole)
-		id := store.SecretIdentifier{Environment: getEnvironment(*dupeEnvironment), Service: *dupeService, Key: *dupeKey}
-		envs := []store.Environment{store.DevelopmentEnvironment, store.ProductionEnvironment}
+		s := openStore(ctx, *dupeEnvironment)
+		id := getSecretIdentifier(*dupeEnvironment, *dupeService, *dupeKey)
+		envs := store.Environments()
 
-		dupes, err := util.FindDupes(s, id, envs)
+		dupes, err := util.FindDupes(ctx, s, id, envs)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -58,8 +164,8 @@ func main() {
 			}
 		} else {
 			for _, dupe := range dupes {
-				if askForConfirmation("Are you sure you want to update the secret " + dupe.String() + "?") {
-					_, err := s.Update(dupe, *updateWith)
+				if askForConfirmation(ctx, "Are you sure you want to update the secret "+dupe.String()+"?") {
+					_, err := s.Update(ctx, dupe, *updateWith)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -67,74 +173,412 @@ func main() {
 			}
 		}
 	case cmdDelete.FullCommand():
-		s := store.NewParameterStore(50, *deleteEnvironment, *assumeRole)
-		id := store.SecretIdentifier{Environment: getEnvironment(*deleteEnvironment), Service: *deleteService, Key: *deleteKey}
-		if askForConfirmation("Are you sure you want to delete the secret " + id.String() + "?") {
-			s.Delete(id)
+		s := openStore(ctx, *deleteEnvironment)
+		id := getSecretIdentifier(*deleteEnvironment, *deleteService, *deleteKey)
+		trash, canTrash := s.(store.TrashStore)
+		if !canTrash || !store.Implements[store.TrashStore](s) || *deletePermanent {
+			if askForConfirmation(ctx, "Are you sure you want to permanently delete the secret "+id.String()+"?") {
+				if err := s.Delete(ctx, id); err != nil {
+					log.Fatalf("Failed to delete secret: %s", err)
+				}
+			}
+			return
+		}
+		if askForConfirmation(ctx, "Are you sure you want to delete the secret "+id.String()+"? It can be restored from the trash until it is purged.") {
+			trashed, err := trash.Trash(ctx, id)
+			if err != nil {
+				log.Fatalf("Failed to delete secret: %s", err)
+			}
+			fmt.Printf("Moved secret to the trash: %s\n", trashed)
+		}
+
+	case cmdTrashList.FullCommand():
+		env := getEnvironment(*trashListEnvironment)
+		trash := openTrashStore(ctx, *trashListEnvironment)
+		trashed, err := trash.ListTrash(ctx, env)
+		if err != nil {
+			log.Fatalf("Failed to list the trash: %s", err)
+		}
+		for _, t := range trashed {
+			fmt.Println(t.String())
+		}
+
+	case cmdTrashRestore.FullCommand():
+		id := getSecretIdentifier(*trashRestoreEnvironment, *trashRestoreService, *trashRestoreKey)
+		trash := openTrashStore(ctx, *trashRestoreEnvironment)
+		trashed, err := trash.ListTrash(ctx, id.Environment)
+		if err != nil {
+			log.Fatalf("Failed to list the trash: %s", err)
+		}
+		var match *store.TrashedSecret
+		for i, t := range trashed {
+			if t.Identifier != id {
+				continue
+			}
+			// the trash is oldest first, so without --deleted-at the last match is the most recent
+			if *trashRestoreDeletedAt == "" || t.DeletedAt.Format(time.RFC3339) == *trashRestoreDeletedAt {
+				match = &trashed[i]
+			}
+		}
+		if match == nil {
+			log.Fatalf("Secret %s was not found in the trash", id.String())
+		}
+		if err := trash.Restore(ctx, *match); err != nil {
+			log.Fatalf("Failed to restore secret: %s", err)
+		}
+		fmt.Printf("Restored secret %s\n", match)
+
+	case cmdTrashPurge.FullCommand():
+		env := getEnvironment(*trashPurgeEnvironment)
+		trash := openTrashStore(ctx, *trashPurgeEnvironment)
+		if !*trashPurgeYes && !askForConfirmation(ctx, fmt.Sprintf("Are you sure you want to permanently delete secrets in %s trashed more than %s ago?", env, *trashPurgeRetention)) {
+			return
+		}
+		purged, err := store.PurgeTrash(ctx, trash, env, *trashPurgeRetention)
+		for _, t := range purged {
+			fmt.Printf("Purged %s\n", t)
+		}
+		if err != nil {
+			log.Fatalf("Failed to purge the trash: %s", err)
 		}
 
 	case cmdWrite.FullCommand():
-		s := store.NewParameterStore(50, *writeEnvironment, *assumeRole)
-		id := store.SecretIdentifier{Environment: getEnvironment(*writeEnvironment), Service: *writeService, Key: *writeKey}
+		s := openStore(ctx, *writeEnvironment)
+		id := getSecretIdentifier(*writeEnvironment, *writeService, *writeKey)
 		// TODO: allow value to be a pointer to a file, or stdin
-		if err := createOrUpdate(s, id, *writeValue); err != nil {
+		var expiration time.Time
+		if *writeExpiresIn != "" {
+			expiresIn, err := parseDuration(*writeExpiresIn)
+			if err != nil || expiresIn <= 0 {
+				log.Fatalf("--expires-in must be a positive duration such as 90d or 12h, got %q", *writeExpiresIn)
+			}
+			if *writeIfVersion != "" {
+				log.Fatal("--expires-in can't be combined with --if-version")
+			}
+			expiration = time.Now().Add(expiresIn)
+		}
+		if *writeIfVersion != "" {
+			version, err := strconv.Atoi(*writeIfVersion)
+			if err != nil || version < 0 {
+				log.Fatalf("--if-version must be a version number, got %q", *writeIfVersion)
+			}
+			if _, err := store.UpdateIfVersion(ctx, s, id, version, *writeValue); err != nil {
+				log.Fatalf("Failed to write secret: %s", err)
+			}
+		} else if err := createOrUpdate(ctx, s, id, *writeValue, expiration); err != nil {
 			log.Fatalf("Failed to write secret: %s", err)
 		}
 		fmt.Printf("Wrote secret %s\n", id.String())
+		if !expiration.IsZero() {
+			fmt.Printf("It expires at %s\n", expiration.UTC().Format(time.RFC3339))
+		}
+
+	case cmdRollback.FullCommand():
+		s := openStore(ctx, *rollbackEnvironment)
+		id := getSecretIdentifier(*rollbackEnvironment, *rollbackService, *rollbackKey)
+		target, err := s.ReadVersion(ctx, id, *rollbackVersion)
+		if err != nil {
+			log.Fatalf("Failed to read version %d of secret: %s", *rollbackVersion, err)
+		}
+		history, err := s.History(ctx, id)
+		if err != nil {
+			log.Fatalf("Failed to read history of secret: %s", err)
+		}
+		if len(history) == 0 {
+			log.Fatalf("Secret %s has no versions to roll back from", id.String())
+		}
+		current := history[0]
+		for _, meta := range history {
+			if meta.Version > current.Version {
+				current = meta
+			}
+		}
+		if current.Version == target.Meta.Version {
+			fmt.Printf("Secret %s is already at version %d\n", id.String(), current.Version)
+			return
+		}
+		fmt.Printf("Versions of secret %s:\n", id.String())
+		for _, meta := range history {
+			marker := ""
+			if meta.Version == current.Version {
+				marker = " (current)"
+			} else if meta.Version == target.Meta.Version {
+				marker = " (restoring)"
+			}
+			fmt.Printf("  %d\tcreated %s%s\n", meta.Version, meta.Created.Format(time.RFC3339), marker)
+		}
+		if !askForConfirmation(ctx, fmt.Sprintf("Are you sure you want to restore version %d of the secret %s as a new version?", target.Meta.Version, id.String())) {
+			return
+		}
+		// only write if nobody else has written while we were asking for confirmation. Like Update, this writes
+		// every region or, if a region fails, reverts them all
+		secret, err := store.UpdateIfVersion(ctx, s, id, current.Version, target.Data)
+		if err != nil {
+			log.Fatalf("Failed to roll back secret: %s", err)
+		}
+		fmt.Printf("Restored version %d of secret %s as version %d\n", target.Meta.Version, id.String(), secret.Meta.Version)
+
+	case cmdHistory.FullCommand():
+		s := openStore(ctx, *historyEnvironment)
+		id := getSecretIdentifier(*historyEnvironment, *historyService, *historyKey)
+		history, err := s.History(ctx, id)
+		if err != nil {
+			log.Fatalf("Failed to read history of secret: %s", err)
+		}
+		sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+		if *historyFormat == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(history); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tCREATED\tAUTHOR\tLABELS\tTIER\tDESCRIPTION")
+		for _, meta := range history {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", meta.Version, meta.Created.Format(time.RFC3339), meta.Author,
+				strings.Join(meta.Labels, ","), meta.Tier, meta.Description)
+		}
+		w.Flush()
+
+	case cmdLabel.FullCommand():
+		s := openStore(ctx, *labelEnvironment)
+		id := getSecretIdentifier(*labelEnvironment, *labelService, *labelKey)
+		labeler, ok := s.(store.Labeler)
+		if !ok || !store.Implements[store.Labeler](s) {
+			log.Fatalf("The secret store %s doesn't support labels", *storeURL)
+		}
+		if err := store.ValidateLabel(*labelName); err != nil {
+			log.Fatal(err)
+		}
+		history, err := s.History(ctx, id)
+		if err != nil {
+			log.Fatalf("Failed to read history of secret: %s", err)
+		}
+		previous := -1
+		for _, meta := range history {
+			for _, l := range meta.Labels {
+				if l == *labelName {
+					previous = meta.Version
+				}
+			}
+		}
+		if previous == *labelVersion {
+			fmt.Printf("Label %s is already on version %d of secret %s\n", *labelName, previous, id.String())
+			return
+		}
+		if previous >= 0 && !askForConfirmation(ctx, fmt.Sprintf("Are you sure you want to move label %s of the secret %s from version %d to version %d?", *labelName, id.String(), previous, *labelVersion)) {
+			return
+		}
+		if err := labeler.Label(ctx, id, *labelVersion, *labelName); err != nil {
+			log.Fatalf("Failed to label secret: %s", err)
+		}
+		fmt.Printf("Labeled version %d of secret %s as %s\n", *labelVersion, id.String(), *labelName)
+
+	case cmdExpiring.FullCommand():
+		s := openStore(ctx, *expiringEnvironment)
+		within, err := parseDuration(*expiringWithin)
+		if err != nil || within < 0 {
+			log.Fatalf("--within must be a duration such as 30d or 12h, got %q", *expiringWithin)
+		}
+		env := getEnvironment(*expiringEnvironment)
+		now := time.Now()
+		expiring, err := store.ListExpiring(ctx, s, env, now.Add(within))
+		if err != nil {
+			log.Fatalf("Failed to list expiring secrets: %s", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SECRET\tEXPIRATION\tSTATUS")
+		for _, e := range expiring {
+			status := fmt.Sprintf("expires in %s", formatDays(e.Expiration.Sub(now)))
+			if !e.Expiration.After(now) {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.Identifier.String(), e.Expiration.UTC().Format(time.RFC3339), status)
+		}
+		w.Flush()
+
+	case cmdList.FullCommand():
+		s := openStore(ctx, *listEnvironment)
+		ids, err := store.ListPrefix(ctx, s, getEnvironment(*listEnvironment), *listService, *listPrefix)
+		if err != nil {
+			log.Fatalf("Failed to list secrets for %s in %s: %s", *listService, *listEnvironment, err)
+		}
+		for _, id := range ids {
+			fmt.Println(id.String())
+		}
 
 	case cmdHealth.FullCommand():
-		s := store.NewParameterStore(50, *healthEnvironment, *assumeRole)
-		var stateOfSecrets = map[string]string{}
-		for _, region := range s.GetOrderedRegions() {
-			s.ParamRegion = region
-			fmt.Printf("Checking store region %s\n", s.ParamRegion)
-			var secrets []store.SecretIdentifier
-			var err error
-			var secretValue store.Secret
-			if secrets, err = s.List(getEnvironment(*healthEnvironment), *healthService); err != nil {
-				log.Fatalf("Failed to list secrets for : %s in %s: %s", *healthService, *healthEnvironment, err)
-			}
-			for _, id := range secrets {
-				if secretValue, err = s.Read(id); err != nil {
-					fmt.Printf("Error reading secret %s in region %s. %s \n", id.String(), region, err)
+		s := openStore(ctx, *healthEnvironment)
+		// stores without regions are checked once, as a single region
+		regions := []string{""}
+		if ps, ok := parameterStoreOf(s); ok {
+			// the primary region goes first, so the other regions are compared with it
+			regions = []string{ps.ParamRegion}
+			for _, region := range ps.GetOrderedRegions() {
+				if region != ps.ParamRegion {
+					regions = append(regions, region)
+				}
+			}
+		}
+		var stateOfSecrets = map[store.SecretIdentifier]string{}
+		var seen []store.SecretIdentifier
+		for _, region := range regions {
+			checking := "store region " + region
+			if region == "" {
+				checking = "store " + *storeURL
+			}
+			fmt.Printf("Checking %s\n", checking)
+			// each region is read through s, so that wrappers such as PolicyStore check it
+			secrets, err := store.ReadService(store.WithRegion(ctx, region), s, getEnvironment(*healthEnvironment), *healthService)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Fatal(ctx.Err())
 				}
-				if val, ok := stateOfSecrets[id.String()]; ok {
-					if secretValue.Data != val {
-						fmt.Printf("Secret %s differs in region %s from us-west-1. \n", id.String(), region)
+				log.Fatalf("Failed to read secrets for : %s in %s: %s", *healthService, *healthEnvironment, err)
+			}
+			ids := make([]store.SecretIdentifier, 0, len(secrets))
+			for id := range secrets {
+				ids = append(ids, id)
+			}
+			sort.Sort(store.ByIDString(ids))
+			for _, id := range seen {
+				if _, ok := secrets[id]; !ok {
+					fmt.Printf("Secret %s is missing in region %s. \n", id.String(), region)
+				}
+			}
+			for _, id := range ids {
+				if val, ok := stateOfSecrets[id]; ok {
+					if secrets[id].Data != val {
+						fmt.Printf("Secret %s differs in region %s from %s. \n", id.String(), region, regions[0])
 					}
 				} else {
-					stateOfSecrets[id.String()] = secretValue.Data
+					stateOfSecrets[id] = secrets[id].Data
+					seen = append(seen, id)
 				}
 			}
-			fmt.Printf("Finished checking secrets in region %s.\n", region)
+			fmt.Printf("Finished checking secrets in %s.\n", checking)
+		}
+	}
+
+}
+
+// openStore opens the secret store selected by --store. The environment, --assume, --rate-limit, --max-retries
+// and --consistency flags are passed to the backend as query parameters, unless the URL already sets them. The
+// store is wrapped to enforce --policy and record to --audit, if they are set.
+func openStore(ctx context.Context, environment string) store.ContextSecretStore {
+	u, err := url.Parse(*storeURL)
+	if err != nil {
+		log.Fatalf("Invalid --store URL %q: %s", *storeURL, err)
+	}
+	query := u.Query()
+	if query.Get("env") == "" {
+		query.Set("env", environment)
+	}
+	if query.Get("assume") == "" {
+		query.Set("assume", strconv.FormatBool(*assumeRole))
+	}
+	if *rateLimit != "" && query.Get("rate-limit") == "" {
+		query.Set("rate-limit", *rateLimit)
+	}
+	if *maxRetries != "" && query.Get("max-retries") == "" {
+		query.Set("max-retries", *maxRetries)
+	}
+	if *consistency != "" && query.Get("consistency") == "" {
+		query.Set("consistency", *consistency)
+	}
+	u.RawQuery = query.Encode()
+	s, err := store.Open(u.String())
+	if err != nil {
+		log.Fatalf("Failed to open secret store: %s", err)
+	}
+	var identity store.CallerIdentity
+	if auditSink != nil || (policy != nil && policy.UsesIdentity()) {
+		if identity, err = store.LookupEnvironmentCallerIdentity(ctx, environment, *assumeRole); err != nil {
+			log.Fatalf("Failed to look up who you are for the policy or audit trail: %s", err)
+		}
+	}
+	if policy != nil {
+		s = store.NewPolicyStore(s, policy, store.PolicyCaller{Identity: identity, Assumed: *assumeRole})
+	}
+	if auditSink != nil {
+		// the audit trail wraps the policy, so that denied calls are recorded too
+		audited, err := store.NewAuditingStore(s, store.AuditConfig{Sink: auditSink, Identity: identity, FingerprintKey: []byte(*auditKey)})
+		if err != nil {
+			log.Fatalf("Failed to set up audit trail: %s", err)
+		}
+		s = audited
+	}
+	return s
+}
+
+// parameterStoreOf finds the ParameterStore that s is, or wraps, so that a command can pick its region. Calls
+// are still made through s, so that wrappers such as PolicyStore check them.
+func parameterStoreOf(s store.ContextSecretStore) (*store.ParameterStore, bool) {
+	for {
+		if ps, ok := s.(*store.ParameterStore); ok {
+			return ps, true
+		}
+		wrapper, ok := s.(store.Wrapper)
+		if !ok {
+			return nil, false
 		}
+		s = wrapper.Unwrap()
 	}
+}
 
+// openTrashStore opens the secret store like openStore, or fatally errors if it doesn't support the trash
+func openTrashStore(ctx context.Context, environment string) store.TrashStore {
+	s := openStore(ctx, environment)
+	trash, ok := s.(store.TrashStore)
+	if !ok || !store.Implements[store.TrashStore](s) {
+		log.Fatalf("The secret store %s doesn't support the trash", *storeURL)
+	}
+	return trash
 }
 
-// getEnvironment returns the Environment enum value based on the string, or fatally errors if the string
-// is not 'development' or 'production'
+// getEnvironment returns the Environment based on the string, or fatally errors if the string
+// is not a configured environment
 func getEnvironment(environment string) store.Environment {
-	if environment == "development" {
-		return store.DevelopmentEnvironment
-	} else if environment == "ci-test" {
-		return store.CITestEnvironment
-	} else if environment != "production" {
-		log.Fatal("Environment flag must be 'development' or 'production'")
-	}
-	return store.ProductionEnvironment
+	env, err := store.ParseEnvironment(environment)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return env
+}
+
+// getSecretIdentifier returns the validated SecretIdentifier for the flags, or fatally errors if it is invalid
+func getSecretIdentifier(environment, service, key string) store.SecretIdentifier {
+	id, err := store.NewSecretIdentifier(getEnvironment(environment), service, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return id
 }
 
-// askForConfirmation asks the user for confirmation.
+// askForConfirmation asks the user for confirmation. It returns false if ctx is cancelled while waiting.
 // See https://gist.github.com/m4ng0squ4sh/3dcbb0c8f6cfe9c66ab8008f55f8f28b
-func askForConfirmation(s string) bool {
+func askForConfirmation(ctx context.Context, s string) bool {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
 		fmt.Printf("%s [y/n]: ", s)
-		response, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatal(err)
+		lines := make(chan string, 1)
+		go func() {
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				log.Fatal(err)
+			}
+			lines <- response
+		}()
+
+		var response string
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return false
+		case response = <-lines:
 		}
 
 		response = strings.ToLower(strings.TrimSpace(response))
@@ -147,17 +591,43 @@ func askForConfirmation(s string) bool {
 	}
 }
 
-func createOrUpdate(s store.SecretStore, id store.SecretIdentifier, value string) error {
-	var err error
+// createOrUpdate writes a secret, creating it if it doesn't exist. Unless expiration is zero, the secret
+// expires at expiration, which needs a store that implements ExpiringWriter.
+func createOrUpdate(ctx context.Context, s store.ContextSecretStore, id store.SecretIdentifier, value string, expiration time.Time) error {
+	if expiration.IsZero() {
+		err := s.Create(ctx, id, value)
+		if _, ok := err.(*store.IdentifierAlreadyExistsError); ok {
+			_, err = s.Update(ctx, id, value)
+		}
+		return err
+	}
+	writer, ok := s.(store.ExpiringWriter)
+	if !ok || !store.Implements[store.ExpiringWriter](s) {
+		return fmt.Errorf("the secret store %s doesn't support expiration", *storeURL)
+	}
+	err := writer.CreateWithExpiration(ctx, id, value, expiration)
+	if _, ok := err.(*store.IdentifierAlreadyExistsError); ok {
+		_, err = writer.UpdateWithExpiration(ctx, id, value, expiration)
+	}
+	return err
+}
 
-	err = s.Create(id, value)
-	if err != nil {
-		if _, ok := err.(*store.IdentifierAlreadyExistsError); !ok {
-			return err
-		} else {
-			_, err = s.Update(id, value)
+// parseDuration parses a duration like time.ParseDuration, but also accepts a number of days, e.g. 90d
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
 		}
+		return time.Duration(n) * 24 * time.Hour, nil
 	}
+	return time.ParseDuration(s)
+}
 
-	return err
+// formatDays formats a duration as whole days, or hours when it is less than a day
+func formatDays(d time.Duration) string {
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
 }
@@ -5,7 +5,21 @@ import subprocess
 import sys
 
 ENVS = ["development", "production"]
-REGIONS = ["us-west-1", "us-east-1", "us-west-2", "us-east-2"]
+# stealth's default regions; environments can configure their own with --config
+REGIONS = ["us-west-1", "us-west-2", "us-east-1"]
+PRIMARY_REGION = "us-west-1"
+
+def load_regions(config_file):
+    """Reads each environment's regions and primary region from a stealth --config file."""
+    regions = {env: (REGIONS, PRIMARY_REGION) for env in ENVS}
+    if not config_file:
+        return regions
+    with open(config_file, 'r', encoding='utf-8') as f:
+        for env in json.load(f).get("environments", []):
+            env_regions = env.get("regions") or REGIONS
+            primary = env.get("primary_region") or (PRIMARY_REGION if PRIMARY_REGION in env_regions else env_regions[0])
+            regions[env["name"]] = (env_regions, primary)
+    return regions
 
 def list_secrets(env, app):
     try:
@@ -55,16 +69,16 @@ def check_aws_authentication_and_exit():
         print(f"Could not authenticate to AWS. Make sure to login with `saml2aws`.")
         sys.exit(0)
 
-def main(applications_file, is_deploy):
+def main(applications_file, is_deploy, config_file):
     check_aws_authentication_and_exit() 
     apps = parse_applications(applications_file)
-    
-    # the deployment parameters is only deployed to us-west-1
-    regions = REGIONS
-    if is_deploy:
-        regions = ["us-west-1"]
+    env_regions = load_regions(config_file)
      
     for env in ENVS:
+        regions, primary = env_regions[env]
+        # the deployment parameters are only deployed to the primary region
+        if is_deploy:
+            regions = [primary]
         for region in regions:
             print(f"Processing apps in {env}")
             for i, app in enumerate(apps):
@@ -94,5 +108,13 @@ if __name__ == '__main__':
     )
     my_parser.set_defaults(is_deploy=False)
 
+    my_parser.add_argument(
+        '--config',
+        '-c',
+        action='store',
+        dest='config_file',
+        help='A stealth --config file, to tag the regions it configures for each environment',
+    )
+
     args = my_parser.parse_args()
-    main(args.file_input, args.is_deploy)
\ No newline at end of file
+    main(args.file_input, args.is_deploy, args.config_file)
\ No newline at end of file
@@ -0,0 +1,129 @@
+package store
+
+import "context"
+
+// legacyStore exposes a ContextSecretStore through the SecretStore interface
+type legacyStore struct {
+	store ContextSecretStore
+}
+
+// NewLegacyStore adapts a ContextSecretStore to the SecretStore interface.
+// Every call is made with context.Background(), so it is never cancelled.
+func NewLegacyStore(s ContextSecretStore) SecretStore {
+	return &legacyStore{store: s}
+}
+
+// Create creates a Secret in the wrapped store
+func (s *legacyStore) Create(id SecretIdentifier, value string) error {
+	return s.store.Create(context.Background(), id, value)
+}
+
+// Read reads the latest version of a Secret from the wrapped store
+func (s *legacyStore) Read(id SecretIdentifier) (Secret, error) {
+	return s.store.Read(context.Background(), id)
+}
+
+// ReadVersion reads a specific version of a Secret from the wrapped store
+func (s *legacyStore) ReadVersion(id SecretIdentifier, version int) (Secret, error) {
+	return s.store.ReadVersion(context.Background(), id, version)
+}
+
+// Update updates a Secret in the wrapped store
+func (s *legacyStore) Update(id SecretIdentifier, value string) (Secret, error) {
+	return s.store.Update(context.Background(), id, value)
+}
+
+// List gets secrets within a namespace from the wrapped store
+func (s *legacyStore) List(env Environment, service string) ([]SecretIdentifier, error) {
+	return s.store.List(context.Background(), env, service)
+}
+
+// ListAll gets all secrets within an environment from the wrapped store
+func (s *legacyStore) ListAll(env Environment) ([]SecretIdentifier, error) {
+	return s.store.ListAll(context.Background(), env)
+}
+
+// History gets the history of a Secret from the wrapped store
+func (s *legacyStore) History(id SecretIdentifier) ([]SecretMeta, error) {
+	return s.store.History(context.Background(), id)
+}
+
+// Delete deletes all versions of a Secret from the wrapped store
+func (s *legacyStore) Delete(id SecretIdentifier) error {
+	return s.store.Delete(context.Background(), id)
+}
+
+// contextStore exposes a SecretStore through the ContextSecretStore interface
+type contextStore struct {
+	store SecretStore
+}
+
+// NewContextStore adapts a SecretStore to the ContextSecretStore interface.
+// The wrapped store cannot observe the context, so it is only checked before each call is made.
+func NewContextStore(s SecretStore) ContextSecretStore {
+	return &contextStore{store: s}
+}
+
+// Create creates a Secret in the wrapped store
+func (s *contextStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Create(id, value)
+}
+
+// Read reads the latest version of a Secret from the wrapped store
+func (s *contextStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	return s.store.Read(id)
+}
+
+// ReadVersion reads a specific version of a Secret from the wrapped store
+func (s *contextStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	return s.store.ReadVersion(id, version)
+}
+
+// Update updates a Secret in the wrapped store
+func (s *contextStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	return s.store.Update(id, value)
+}
+
+// List gets secrets within a namespace from the wrapped store
+func (s *contextStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	if err := ctx.Err(); err != nil {
+		return []SecretIdentifier{}, err
+	}
+	return s.store.List(env, service)
+}
+
+// ListAll gets all secrets within an environment from the wrapped store
+func (s *contextStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	if err := ctx.Err(); err != nil {
+		return []SecretIdentifier{}, err
+	}
+	return s.store.ListAll(env)
+}
+
+// History gets the history of a Secret from the wrapped store
+func (s *contextStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return []SecretMeta{}, err
+	}
+	return s.store.History(id)
+}
+
+// Delete deletes all versions of a Secret from the wrapped store
+func (s *contextStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.store.Delete(id)
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// The actions AuditingStore records
+const (
+	AuditActionCreate          = "create"
+	AuditActionUpdate          = "update"
+	AuditActionUpdateIfVersion = "update-if-version"
+	AuditActionDelete          = "delete"
+	AuditActionReadVersion     = "read-version"
+	AuditActionTrash           = "trash"
+	AuditActionRestore         = "restore"
+	AuditActionPurge           = "purge"
+	AuditActionLabel           = "label"
+	AuditActionReadLabel       = "read-label"
+)
+
+// CallerIdentity is who makes the calls that AuditingStore records
+type CallerIdentity struct {
+	// Account is the AWS account of the caller, if known
+	Account string `json:"account,omitempty"`
+	// ARN identifies the caller, e.g. an IAM user, or a role session
+	ARN string `json:"arn,omitempty"`
+	// UserID is the caller's unique ID, if known
+	UserID string `json:"user_id,omitempty"`
+	// Role is the role the caller assumed, if any
+	Role string `json:"role,omitempty"`
+}
+
+// LookupCallerIdentity asks STS who the credentials in cfg belong to
+func LookupCallerIdentity(ctx context.Context, cfg aws.Config) (CallerIdentity, error) {
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return CallerIdentity{}, err
+	}
+	identity := CallerIdentity{
+		Account: aws.ToString(out.Account),
+		ARN:     aws.ToString(out.Arn),
+		UserID:  aws.ToString(out.UserId),
+	}
+	identity.Role = roleFromARN(identity.ARN)
+	return identity, nil
+}
+
+// LookupEnvironmentCallerIdentity asks STS who the caller managing an environment's secrets is, with the same
+// credentials Parameter Store would use. If assume is set, that is the environment's role.
+func LookupEnvironmentCallerIdentity(ctx context.Context, env string, assume bool) (CallerIdentity, error) {
+	return LookupCallerIdentity(ctx, getV2Config(environmentPrimaryRegion(env), env, assume))
+}
+
+// roleFromARN gets the role name from the ARN of an assumed role session, or "" for other ARNs
+func roleFromARN(arn string) string {
+	// arn:aws:sts::<account>:assumed-role/<role>/<session>
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return ""
+	}
+	resource := strings.Split(parts[5], "/")
+	if len(resource) < 2 || resource[0] != "assumed-role" {
+		return ""
+	}
+	return resource[1]
+}
+
+// AuditRecord records a call to a store. It never includes the secret's value, only a fingerprint of it.
+type AuditRecord struct {
+	Time   time.Time      `json:"time"`
+	Action string         `json:"action"`
+	Caller CallerIdentity `json:"caller"`
+	Host   string         `json:"host,omitempty"`
+	// Environment, Service and Key identify the secret
+	Environment string `json:"environment"`
+	Service     string `json:"service"`
+	Key         string `json:"key"`
+	// Version is the version written or read, if the call succeeded and the store reported it
+	Version *int `json:"version,omitempty"`
+	// ExpectedVersion is the version a conditional update expected the secret to be at
+	ExpectedVersion *int `json:"expected_version,omitempty"`
+	// Expiration is when a secret that was written expires, if it was written with one
+	Expiration *time.Time `json:"expiration,omitempty"`
+	// Label is the label that was attached or read
+	Label string `json:"label,omitempty"`
+	// DeletedAt identifies the trashed secret that was trashed, restored or purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Fingerprint is a keyed HMAC-SHA256 of the value written or read, so records of the same value can be
+	// matched up without revealing it
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Error is the error the call failed with, if any
+	Error string `json:"error,omitempty"`
+}
+
+// AuditSink is where AuditingStore writes its records
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record AuditRecord) error
+}
+
+// WriterAuditSink appends records to a writer as JSON lines
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink creates a sink that appends JSON lines to w
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+// NewStdoutAuditSink creates a sink that writes JSON lines to standard output
+func NewStdoutAuditSink() *WriterAuditSink {
+	return NewWriterAuditSink(os.Stdout)
+}
+
+// WriteAudit appends a record as a line of JSON
+func (s *WriterAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// one write per record, so that records from several processes appending to a file don't interleave
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// FileAuditSink appends records to a file as JSON lines
+type FileAuditSink struct {
+	*WriterAuditSink
+	file *os.File
+}
+
+// NewFileAuditSink opens a file to append JSON lines to, creating it if it doesn't exist
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{WriterAuditSink: NewWriterAuditSink(file), file: file}, nil
+}
+
+// Close closes the file
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// WebhookAuditSink posts each record as JSON to a URL
+type WebhookAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookAuditSink creates a sink that posts records to url. If client is nil, a client with a 10 second
+// timeout is used.
+func NewWebhookAuditSink(url string, client *http.Client) *WebhookAuditSink {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &WebhookAuditSink{url: url, client: client}
+}
+
+// WriteAudit posts a record, failing unless the webhook responds with a 2xx status
+func (s *WebhookAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// OpenAuditSink opens a sink from a target: "-" for standard output, an http or https URL for a webhook, or
+// otherwise the path of a file
+func OpenAuditSink(target string) (AuditSink, error) {
+	switch {
+	case target == "-":
+		return NewStdoutAuditSink(), nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return NewWebhookAuditSink(target, nil), nil
+	default:
+		return NewFileAuditSink(target)
+	}
+}
+
+// AuditError occurs when a call to an AuditingStore succeeded, but couldn't be recorded
+type AuditError struct {
+	Action     string
+	Identifier SecretIdentifier
+	Err        error
+}
+
+func (e *AuditError) Error() string {
+	return fmt.Sprintf("Unable to record %s of secret with identifier %s in the audit log: %s", e.Action, e.Identifier, e.Err)
+}
+
+func (e *AuditError) Unwrap() error {
+	return e.Err
+}
+
+// Fingerprint is a keyed HMAC-SHA256 of a value, in hex
+func Fingerprint(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
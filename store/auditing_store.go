@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// AuditConfig configures an AuditingStore
+type AuditConfig struct {
+	// Sink is where records are written
+	Sink AuditSink
+	// Identity is the caller recorded in every record, e.g. from LookupCallerIdentity
+	Identity CallerIdentity
+	// Host is the host recorded in every record. Defaults to the machine's hostname.
+	Host string
+	// FingerprintKey is the HMAC key values are fingerprinted with. Keep it secret, since anyone with the key
+	// can check guesses of a value against its fingerprint.
+	FingerprintKey []byte
+}
+
+// AuditingStore wraps a store to record who creates, updates, deletes, trashes, labels and reads versions of
+// secrets. Each call is recorded once it returns, whether it succeeded or not. If a call succeeded but couldn't be
+// recorded, it returns an AuditError.
+//
+// AuditingStore implements BatchReader, PrefixLister, ServiceReader, ConditionalUpdater and ExpirationLister,
+// falling back like the package's helpers when the wrapped store doesn't. It also implements TrashStore, Labeler
+// and ExpiringWriter, whose calls fail with an UnsupportedError when the wrapped store doesn't implement them;
+// check with Implements. Calls made through Unwrap aren't recorded.
+type AuditingStore struct {
+	store  ContextSecretStore
+	config AuditConfig
+	// now is the clock, which tests replace
+	now func() time.Time
+}
+
+// NewAuditingStore wraps a store to record its calls
+func NewAuditingStore(s ContextSecretStore, config AuditConfig) (*AuditingStore, error) {
+	if config.Sink == nil {
+		return nil, errors.New("an audit sink is required")
+	}
+	if len(config.FingerprintKey) == 0 {
+		return nil, errors.New("an audit fingerprint key is required")
+	}
+	if config.Host == "" {
+		config.Host, _ = os.Hostname()
+	}
+	return &AuditingStore{store: s, config: config, now: time.Now}, nil
+}
+
+// Unwrap returns the wrapped store
+func (s *AuditingStore) Unwrap() ContextSecretStore {
+	return s.store
+}
+
+// record writes a record of a call to the sink, returning the call's error, or an AuditError if the call
+// succeeded but the record couldn't be written
+func (s *AuditingStore) record(ctx context.Context, record AuditRecord, id SecretIdentifier, err error) error {
+	record.Time = s.now().UTC()
+	record.Caller = s.config.Identity
+	record.Host = s.config.Host
+	record.Environment = id.EnvironmentString()
+	record.Service = id.Service
+	record.Key = id.Key
+	if err != nil {
+		record.Error = err.Error()
+		record.Version = nil
+		record.Fingerprint = ""
+	}
+	// the call has already been made, so record it even if the caller has given up on it
+	if auditErr := s.config.Sink.WriteAudit(context.WithoutCancel(ctx), record); auditErr != nil && err == nil {
+		return &AuditError{Action: record.Action, Identifier: id, Err: auditErr}
+	}
+	return err
+}
+
+// fingerprint fingerprints a value with the configured key
+func (s *AuditingStore) fingerprint(value string) string {
+	return Fingerprint(s.config.FingerprintKey, value)
+}
+
+// Create creates a Secret in the wrapped store, and records it
+func (s *AuditingStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	err := s.store.Create(ctx, id, value)
+	version := 0
+	return s.record(ctx, AuditRecord{Action: AuditActionCreate, Version: &version, Fingerprint: s.fingerprint(value)}, id, err)
+}
+
+// Read reads the latest version of a Secret from the wrapped store. Reads of the latest version aren't recorded.
+func (s *AuditingStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	return s.store.Read(ctx, id)
+}
+
+// ReadVersion reads a specific version of a Secret from the wrapped store, and records it
+func (s *AuditingStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	secret, err := s.store.ReadVersion(ctx, id, version)
+	record := AuditRecord{Action: AuditActionReadVersion, Version: &version, Fingerprint: s.fingerprint(secret.Data)}
+	return secret, s.record(ctx, record, id, err)
+}
+
+// ReadMany reads the latest version of each secret from the wrapped store
+func (s *AuditingStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	return ReadMany(ctx, s.store, ids)
+}
+
+// Update updates a Secret in the wrapped store, and records it
+func (s *AuditingStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	secret, err := s.store.Update(ctx, id, value)
+	record := AuditRecord{Action: AuditActionUpdate, Version: &secret.Meta.Version, Fingerprint: s.fingerprint(value)}
+	return secret, s.record(ctx, record, id, err)
+}
+
+// UpdateIfVersion updates a Secret in the wrapped store if it is at expectedVersion, and records it
+func (s *AuditingStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	secret, err := UpdateIfVersion(ctx, s.store, id, expectedVersion, value)
+	record := AuditRecord{
+		Action:          AuditActionUpdateIfVersion,
+		Version:         &secret.Meta.Version,
+		ExpectedVersion: &expectedVersion,
+		Fingerprint:     s.fingerprint(value),
+	}
+	return secret, s.record(ctx, record, id, err)
+}
+
+// List gets secrets within a namespace from the wrapped store
+func (s *AuditingStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	return s.store.List(ctx, env, service)
+}
+
+// ListPrefix gets secrets within a namespace whose keys start with prefix from the wrapped store
+func (s *AuditingStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	return ListPrefix(ctx, s.store, env, service, prefix)
+}
+
+// ReadService reads every secret within a namespace from the wrapped store
+func (s *AuditingStore) ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	return ReadService(ctx, s.store, env, service)
+}
+
+// ListAll gets all secrets within an environment from the wrapped store
+func (s *AuditingStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	return s.store.ListAll(ctx, env)
+}
+
+// History gets the history of a Secret from the wrapped store
+func (s *AuditingStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	return s.store.History(ctx, id)
+}
+
+// Delete deletes all versions of a Secret from the wrapped store, and records it
+func (s *AuditingStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	err := s.store.Delete(ctx, id)
+	return s.record(ctx, AuditRecord{Action: AuditActionDelete}, id, err)
+}
+
+// CreateWithExpiration creates a Secret that expires in the wrapped store, and records it
+func (s *AuditingStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	if err == nil {
+		err = writer.CreateWithExpiration(ctx, id, value, expiration)
+	}
+	version := 0
+	record := AuditRecord{Action: AuditActionCreate, Version: &version, Expiration: &expiration, Fingerprint: s.fingerprint(value)}
+	return s.record(ctx, record, id, err)
+}
+
+// UpdateWithExpiration updates a Secret in the wrapped store and makes it expire, and records it
+func (s *AuditingStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	var secret Secret
+	if err == nil {
+		secret, err = writer.UpdateWithExpiration(ctx, id, value, expiration)
+	}
+	record := AuditRecord{Action: AuditActionUpdate, Version: &secret.Meta.Version, Expiration: &expiration, Fingerprint: s.fingerprint(value)}
+	return secret, s.record(ctx, record, id, err)
+}
+
+// ListExpiring gets the secrets within an environment that expire before cutoff from the wrapped store
+func (s *AuditingStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	return ListExpiring(ctx, s.store, env, cutoff)
+}
+
+// Label attaches a label to a version of a Secret in the wrapped store, and records it
+func (s *AuditingStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	if err == nil {
+		err = labeler.Label(ctx, id, version, label)
+	}
+	return s.record(ctx, AuditRecord{Action: AuditActionLabel, Version: &version, Label: label}, id, err)
+}
+
+// ReadLabel reads the version of a Secret a label is attached to from the wrapped store, and records it
+func (s *AuditingStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	var secret Secret
+	if err == nil {
+		secret, err = labeler.ReadLabel(ctx, id, label)
+	}
+	record := AuditRecord{Action: AuditActionReadLabel, Version: &secret.Meta.Version, Label: label, Fingerprint: s.fingerprint(secret.Data)}
+	return secret, s.record(ctx, record, id, err)
+}
+
+// Trash moves a Secret into the trash of the wrapped store, and records it
+func (s *AuditingStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	var trashed TrashedSecret
+	if err == nil {
+		trashed, err = trash.Trash(ctx, id)
+	}
+	record := AuditRecord{Action: AuditActionTrash}
+	if err == nil {
+		record.DeletedAt = &trashed.DeletedAt
+	}
+	return trashed, s.record(ctx, record, id, err)
+}
+
+// ListTrash gets the trashed secrets within an environment from the wrapped store
+func (s *AuditingStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return nil, err
+	}
+	return trash.ListTrash(ctx, env)
+}
+
+// Restore moves a trashed secret out of the trash of the wrapped store, and records it
+func (s *AuditingStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err == nil {
+		err = trash.Restore(ctx, trashed)
+	}
+	return s.record(ctx, AuditRecord{Action: AuditActionRestore, DeletedAt: &trashed.DeletedAt}, trashed.Identifier, err)
+}
+
+// Purge permanently deletes a trashed secret from the wrapped store, and records it
+func (s *AuditingStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err == nil {
+		err = trash.Purge(ctx, trashed)
+	}
+	return s.record(ctx, AuditRecord{Action: AuditActionPurge, DeletedAt: &trashed.DeletedAt}, trashed.Identifier, err)
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// auditRecords parses the JSON lines a WriterAuditSink wrote
+func auditRecords(t *testing.T, b *bytes.Buffer) []AuditRecord {
+	records := []AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var record AuditRecord
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+// failingAuditSink fails every write
+type failingAuditSink struct{}
+
+func (failingAuditSink) WriteAudit(ctx context.Context, record AuditRecord) error {
+	return errors.New("sink unavailable")
+}
+
+func TestAuditingStore(t *testing.T) {
+	ctx := context.Background()
+	var b bytes.Buffer
+	identity := CallerIdentity{Account: "123456789012", ARN: "arn:aws:sts::123456789012:assumed-role/SecretsManagement/jane", Role: "SecretsManagement"}
+	s, err := NewAuditingStore(NewMemoryStore(), AuditConfig{
+		Sink:           NewWriterAuditSink(&b),
+		Identity:       identity,
+		Host:           "laptop",
+		FingerprintKey: []byte("key"),
+	})
+	assert.NoError(t, err)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("creates, updates, deletes and version reads are recorded without the value")
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	_, err = s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	_, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	_, err = s.ReadVersion(ctx, id, 0)
+	assert.NoError(t, err)
+	_, err = s.UpdateIfVersion(ctx, id, 0, "qux")
+	assert.IsType(t, &VersionConflictError{}, err)
+	assert.NoError(t, s.Delete(ctx, id))
+	assert.NotContains(t, b.String(), `"baz"`)
+
+	records := auditRecords(t, &b)
+	assert.Len(t, records, 5)
+	actions := []string{}
+	for _, record := range records {
+		actions = append(actions, record.Action)
+		assert.Equal(t, record.Caller, identity)
+		assert.Equal(t, record.Host, "laptop")
+		assert.Equal(t, record.Service, id.Service)
+		assert.Equal(t, record.Key, id.Key)
+	}
+	assert.Equal(t, actions, []string{AuditActionCreate, AuditActionUpdate, AuditActionReadVersion, AuditActionUpdateIfVersion, AuditActionDelete})
+	assert.Equal(t, *records[1].Version, 1)
+	assert.Equal(t, records[1].Fingerprint, Fingerprint([]byte("key"), "baz"))
+	assert.NotEqual(t, records[1].Fingerprint, Fingerprint([]byte("other key"), "baz"))
+	t.Log("the version read has the same fingerprint as the write that created it")
+	assert.Equal(t, records[2].Fingerprint, records[0].Fingerprint)
+	t.Log("failed calls are recorded with their error")
+	assert.Equal(t, *records[3].ExpectedVersion, 0)
+	assert.Nil(t, records[3].Version)
+	assert.NotEmpty(t, records[3].Error)
+
+	t.Log("calls that succeed but can't be recorded fail with an AuditError")
+	s, err = NewAuditingStore(NewMemoryStore(), AuditConfig{Sink: failingAuditSink{}, FingerprintKey: []byte("key")})
+	assert.NoError(t, err)
+	err = s.Create(ctx, id, "bar")
+	assert.IsType(t, &AuditError{}, err)
+	assert.ErrorContains(t, err, "sink unavailable")
+
+	_, err = NewAuditingStore(NewMemoryStore(), AuditConfig{Sink: failingAuditSink{}})
+	assert.Error(t, err)
+}
+
+func TestAuditingStoreOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	var b bytes.Buffer
+	s, err := NewAuditingStore(NewMemoryStore(), AuditConfig{Sink: NewWriterAuditSink(&b), FingerprintKey: []byte("key")})
+	assert.NoError(t, err)
+	id := GetRandomTestSecretIdentifier()
+	expiration := time.Now().Add(time.Hour).UTC()
+
+	t.Log("expiring writes, labels, label reads and trash calls are recorded")
+	assert.True(t, Implements[TrashStore](s))
+	assert.NoError(t, s.CreateWithExpiration(ctx, id, "bar", expiration))
+	_, err = s.UpdateWithExpiration(ctx, id, "baz", expiration)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Label(ctx, id, 0, "stable"))
+	_, err = s.ReadLabel(ctx, id, "stable")
+	assert.NoError(t, err)
+	trashed, err := s.Trash(ctx, id)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Restore(ctx, trashed))
+	trashed, err = s.Trash(ctx, id)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Purge(ctx, trashed))
+	assert.NotContains(t, b.String(), `"baz"`)
+
+	records := auditRecords(t, &b)
+	actions := []string{}
+	for _, record := range records {
+		actions = append(actions, record.Action)
+	}
+	assert.Equal(t, actions, []string{AuditActionCreate, AuditActionUpdate, AuditActionLabel, AuditActionReadLabel,
+		AuditActionTrash, AuditActionRestore, AuditActionTrash, AuditActionPurge})
+	assert.True(t, records[1].Expiration.Equal(expiration))
+	assert.Equal(t, records[2].Label, "stable")
+	assert.Equal(t, *records[2].Version, 0)
+	assert.Equal(t, records[3].Fingerprint, Fingerprint([]byte("key"), "bar"))
+	assert.True(t, records[5].DeletedAt.Equal(*records[4].DeletedAt))
+	assert.Equal(t, records[7].Key, id.Key)
+
+	t.Log("calls the wrapped store doesn't support fail, and are recorded")
+	b.Reset()
+	s, err = NewAuditingStore(NewMockStore(), AuditConfig{Sink: NewWriterAuditSink(&b), FingerprintKey: []byte("key")})
+	assert.NoError(t, err)
+	assert.False(t, Implements[TrashStore](s))
+	_, err = s.Trash(ctx, id)
+	assert.IsType(t, &UnsupportedError{}, err)
+	records = auditRecords(t, &b)
+	assert.Len(t, records, 1)
+	assert.NotEmpty(t, records[0].Error)
+}
+
+func TestAuditSinks(t *testing.T) {
+	ctx := context.Background()
+	record := AuditRecord{Time: time.Now().UTC(), Action: AuditActionDelete, Service: "foo", Key: "bar"}
+
+	t.Log("the file sink appends to the file")
+	path := filepath.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, os.WriteFile(path, []byte("{}\n"), 0600))
+	sink, err := OpenAuditSink(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.WriteAudit(ctx, record))
+	assert.NoError(t, sink.(*FileAuditSink).Close())
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Count(string(contents), "\n"), 2)
+	assert.Contains(t, string(contents), `"action":"delete"`)
+
+	t.Log("the webhook sink posts each record, and fails if the webhook does")
+	var received []AuditRecord
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var posted AuditRecord
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+		assert.Equal(t, r.Header.Get("Content-Type"), "application/json")
+		received = append(received, posted)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	sink, err = OpenAuditSink(server.URL)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.WriteAudit(ctx, record))
+	assert.Equal(t, received, []AuditRecord{record})
+	status = http.StatusInternalServerError
+	assert.Error(t, sink.WriteAudit(ctx, record))
+}
+
+func TestRoleFromARN(t *testing.T) {
+	assert.Equal(t, roleFromARN("arn:aws:sts::123456789012:assumed-role/SecretsManagement/jane"), "SecretsManagement")
+	assert.Equal(t, roleFromARN("arn:aws:iam::123456789012:user/jane"), "")
+	assert.Equal(t, roleFromARN("not an arn"), "")
+}
@@ -0,0 +1,428 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL is how long CachingStore keeps a secret it has read, unless configured otherwise
+	DefaultCacheTTL = time.Minute
+	// DefaultNegativeCacheTTL is how long CachingStore remembers that a secret doesn't exist, unless configured otherwise
+	DefaultNegativeCacheTTL = 10 * time.Second
+	// DefaultCacheMaxEntries is how many reads CachingStore keeps, unless configured otherwise
+	DefaultCacheMaxEntries = 1000
+)
+
+// CacheConfig configures a CachingStore
+type CacheConfig struct {
+	// TTL is how long a secret that was read is kept. Defaults to DefaultCacheTTL.
+	TTL time.Duration
+	// NegativeTTL is how long an IdentifierNotFoundError is kept. Defaults to DefaultNegativeCacheTTL;
+	// a negative value turns off negative caching.
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of reads kept, which bounds memory use. The least recently used entry is
+	// evicted to make room for a new one. Defaults to DefaultCacheMaxEntries.
+	MaxEntries int
+}
+
+// CacheStats counts how a CachingStore's reads were served
+type CacheStats struct {
+	// Hits are reads served from the cache, including cached IdentifierNotFoundErrors
+	Hits uint64
+	// Misses are reads passed on to the wrapped store
+	Misses uint64
+	// Evictions are entries dropped to stay within MaxEntries
+	Evictions uint64
+	// Entries is the number of entries currently kept
+	Entries int
+}
+
+// cacheKey identifies a cached read: a version of a secret, or its latest version if version is latestVersion,
+// read with the read consistency and from the region a call asked for, if any. Reads with different read
+// consistencies or regions are cached apart, so that e.g. a strict read isn't served what an available read found.
+type cacheKey struct {
+	id          SecretIdentifier
+	version     int
+	consistency ReadConsistency
+	region      string
+}
+
+// readCacheKey gets the cacheKey of a read made with ctx
+func readCacheKey(ctx context.Context, id SecretIdentifier, version int) cacheKey {
+	return cacheKey{id: id, version: version, consistency: readConsistencyOf(ctx), region: regionOf(ctx)}
+}
+
+// latestVersion is the version of a cacheKey for reads of a secret's latest version
+const latestVersion = -1
+
+// cacheEntry is a cached read, which is either a secret or the IdentifierNotFoundError reading it returned
+type cacheEntry struct {
+	key     cacheKey
+	secret  Secret
+	err     error
+	expires time.Time
+}
+
+// CachingStore wraps a store to cache reads of secrets. Each entry expires after the configured TTL, or when
+// the secret itself expires if that is sooner. Writes made through the CachingStore invalidate the entries of
+// the secret they write, but writes made elsewhere are only seen once the entries expire.
+//
+// CachingStore implements BatchReader, PrefixLister, ServiceReader, ConditionalUpdater and ExpirationLister,
+// falling back like the package's helpers when the wrapped store doesn't. It also implements TrashStore, Labeler
+// and ExpiringWriter, whose calls fail with an UnsupportedError when the wrapped store doesn't implement them;
+// check with Implements. Writes made through Unwrap don't invalidate the cache.
+type CachingStore struct {
+	store  ContextSecretStore
+	config CacheConfig
+	// now is the clock, which tests replace
+	now func() time.Time
+
+	mu sync.Mutex
+	// entries indexes the elements of lru by secret, then by key
+	entries map[SecretIdentifier]map[cacheKey]*list.Element
+	// lru has the entries, most recently used first
+	lru *list.List
+	// generation counts invalidations, so that a read which raced with a write isn't cached
+	generation uint64
+	stats      CacheStats
+}
+
+// NewCachingStore wraps a store to cache its reads
+func NewCachingStore(s ContextSecretStore, config CacheConfig) *CachingStore {
+	if config.TTL <= 0 {
+		config.TTL = DefaultCacheTTL
+	}
+	if config.NegativeTTL == 0 {
+		config.NegativeTTL = DefaultNegativeCacheTTL
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultCacheMaxEntries
+	}
+	return &CachingStore{
+		store:   s,
+		config:  config,
+		now:     time.Now,
+		entries: map[SecretIdentifier]map[cacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Unwrap returns the wrapped store
+func (s *CachingStore) Unwrap() ContextSecretStore {
+	return s.store
+}
+
+// Stats returns the cache's hit and miss counts so far
+func (s *CachingStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Entries = s.lru.Len()
+	return stats
+}
+
+// Invalidate drops every cached read of a secret, e.g. after it was written by someone else
+func (s *CachingStore) Invalidate(id SecretIdentifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	for _, element := range s.entries[id] {
+		s.lru.Remove(element)
+	}
+	delete(s.entries, id)
+}
+
+// Flush drops every cached read
+func (s *CachingStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.entries = map[SecretIdentifier]map[cacheKey]*list.Element{}
+	s.lru.Init()
+}
+
+// get looks up a cached read, counting a hit or a miss. It also returns the generation, which put needs.
+func (s *CachingStore) get(key cacheKey) (cacheEntry, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key.id][key]
+	if ok && s.now().Before(element.Value.(*cacheEntry).expires) {
+		s.stats.Hits++
+		s.lru.MoveToFront(element)
+		return *element.Value.(*cacheEntry), s.generation, true
+	}
+	if ok {
+		s.remove(element)
+	}
+	s.stats.Misses++
+	return cacheEntry{}, s.generation, false
+}
+
+// remove drops an entry. The caller must hold s.mu.
+func (s *CachingStore) remove(element *list.Element) {
+	key := element.Value.(*cacheEntry).key
+	s.lru.Remove(element)
+	delete(s.entries[key.id], key)
+	if len(s.entries[key.id]) == 0 {
+		delete(s.entries, key.id)
+	}
+}
+
+// put caches the result of a read, unless the cache was invalidated since generation. Only secrets and
+// IdentifierNotFoundErrors are cached.
+func (s *CachingStore) put(generation uint64, key cacheKey, secret Secret, err error) {
+	entry := &cacheEntry{key: key, secret: secret}
+	now := s.now()
+	if _, ok := err.(*IdentifierNotFoundError); ok {
+		if s.config.NegativeTTL < 0 {
+			return
+		}
+		entry.err = err
+		entry.expires = now.Add(s.config.NegativeTTL)
+	} else if err != nil {
+		return
+	} else {
+		entry.expires = now.Add(s.config.TTL)
+		// don't serve a secret after it has expired in the store
+		if expiration := secret.Meta.Expiration; !expiration.IsZero() && expiration.Before(entry.expires) {
+			entry.expires = expiration
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation != s.generation {
+		return
+	}
+	if element, ok := s.entries[key.id][key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	if s.entries[key.id] == nil {
+		s.entries[key.id] = map[cacheKey]*list.Element{}
+	}
+	s.entries[key.id][key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.config.MaxEntries {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// read serves a read from the cache, or makes it with fn and caches the result
+func (s *CachingStore) read(key cacheKey, fn func() (Secret, error)) (Secret, error) {
+	entry, generation, ok := s.get(key)
+	if ok {
+		return entry.secret, entry.err
+	}
+	secret, err := fn()
+	s.put(generation, key, secret, err)
+	return secret, err
+}
+
+// Create creates a Secret in the wrapped store, dropping a cached IdentifierNotFoundError for it
+func (s *CachingStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	defer s.Invalidate(id)
+	return s.store.Create(ctx, id, value)
+}
+
+// Read reads the latest version of a Secret, from the cache if it is there
+func (s *CachingStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	return s.read(readCacheKey(ctx, id, latestVersion), func() (Secret, error) {
+		return s.store.Read(ctx, id)
+	})
+}
+
+// ReadVersion reads a specific version of a Secret, from the cache if it is there
+func (s *CachingStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	return s.read(readCacheKey(ctx, id, version), func() (Secret, error) {
+		return s.store.ReadVersion(ctx, id, version)
+	})
+}
+
+// ReadMany reads the latest version of each secret, reading the ones that aren't cached in one ReadMany
+func (s *CachingStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	results := map[SecretIdentifier]Secret{}
+	missing := []SecretIdentifier{}
+	var generation uint64
+	for _, id := range ids {
+		if err := id.Validate(); err != nil {
+			return nil, err
+		}
+		entry, g, ok := s.get(readCacheKey(ctx, id, latestVersion))
+		if !ok {
+			if len(missing) == 0 {
+				generation = g
+			}
+			missing = append(missing, id)
+		} else if entry.err == nil {
+			results[id] = entry.secret
+		}
+	}
+	if len(missing) == 0 {
+		return results, nil
+	}
+	secrets, err := ReadMany(ctx, s.store, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range missing {
+		key := readCacheKey(ctx, id, latestVersion)
+		if secret, ok := secrets[id]; ok {
+			results[id] = secret
+			s.put(generation, key, secret, nil)
+		} else {
+			s.put(generation, key, Secret{}, &IdentifierNotFoundError{Identifier: id})
+		}
+	}
+	return results, nil
+}
+
+// Update updates a Secret in the wrapped store, and drops its cached reads
+func (s *CachingStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	defer s.Invalidate(id)
+	return s.store.Update(ctx, id, value)
+}
+
+// UpdateIfVersion updates a Secret in the wrapped store if it is at expectedVersion, and drops its cached reads
+func (s *CachingStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	defer s.Invalidate(id)
+	return UpdateIfVersion(ctx, s.store, id, expectedVersion, value)
+}
+
+// List gets secrets within a namespace from the wrapped store. Listing isn't cached.
+func (s *CachingStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	return s.store.List(ctx, env, service)
+}
+
+// ListPrefix gets secrets within a namespace whose keys start with prefix from the wrapped store
+func (s *CachingStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	return ListPrefix(ctx, s.store, env, service, prefix)
+}
+
+// ReadService reads every secret within a namespace from the wrapped store, and caches them
+func (s *CachingStore) ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	s.mu.Lock()
+	generation := s.generation
+	s.mu.Unlock()
+	secrets, err := ReadService(ctx, s.store, env, service)
+	if err != nil {
+		return nil, err
+	}
+	for id, secret := range secrets {
+		s.put(generation, readCacheKey(ctx, id, latestVersion), secret, nil)
+	}
+	return secrets, nil
+}
+
+// ListAll gets all secrets within an environment from the wrapped store. Listing isn't cached.
+func (s *CachingStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	return s.store.ListAll(ctx, env)
+}
+
+// History gets the history of a Secret from the wrapped store. History isn't cached.
+func (s *CachingStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	return s.store.History(ctx, id)
+}
+
+// Delete deletes all versions of a Secret from the wrapped store, and drops its cached reads
+func (s *CachingStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	defer s.Invalidate(id)
+	return s.store.Delete(ctx, id)
+}
+
+// CreateWithExpiration creates a Secret that expires in the wrapped store, dropping a cached
+// IdentifierNotFoundError for it
+func (s *CachingStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	if err != nil {
+		return err
+	}
+	defer s.Invalidate(id)
+	return writer.CreateWithExpiration(ctx, id, value, expiration)
+}
+
+// UpdateWithExpiration updates a Secret in the wrapped store and makes it expire, and drops its cached reads
+func (s *CachingStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	if err != nil {
+		return Secret{}, err
+	}
+	defer s.Invalidate(id)
+	return writer.UpdateWithExpiration(ctx, id, value, expiration)
+}
+
+// ListExpiring gets the secrets within an environment that expire before cutoff from the wrapped store.
+// Listing isn't cached.
+func (s *CachingStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	return ListExpiring(ctx, s.store, env, cutoff)
+}
+
+// Label attaches a label to a version of a Secret in the wrapped store, and drops its cached reads, whose
+// labels it changes
+func (s *CachingStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	if err != nil {
+		return err
+	}
+	defer s.Invalidate(id)
+	return labeler.Label(ctx, id, version, label)
+}
+
+// ReadLabel reads the version of a Secret a label is attached to from the wrapped store. Since labels move,
+// these reads aren't cached.
+func (s *CachingStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	if err != nil {
+		return Secret{}, err
+	}
+	return labeler.ReadLabel(ctx, id, label)
+}
+
+// Trash moves a Secret into the trash of the wrapped store, and drops its cached reads
+func (s *CachingStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return TrashedSecret{}, err
+	}
+	defer s.Invalidate(id)
+	return trash.Trash(ctx, id)
+}
+
+// ListTrash gets the trashed secrets within an environment from the wrapped store. Listing isn't cached.
+func (s *CachingStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return nil, err
+	}
+	return trash.ListTrash(ctx, env)
+}
+
+// Restore moves a trashed secret out of the trash of the wrapped store, dropping a cached
+// IdentifierNotFoundError for it
+func (s *CachingStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return err
+	}
+	defer s.Invalidate(trashed.Identifier)
+	return trash.Restore(ctx, trashed)
+}
+
+// Purge permanently deletes a trashed secret from the wrapped store. Trashed secrets aren't cached.
+func (s *CachingStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return err
+	}
+	return trash.Purge(ctx, trashed)
+}
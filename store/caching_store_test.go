@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingStore(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStore()
+	s := NewCachingStore(inner, CacheConfig{TTL: time.Minute, NegativeTTL: time.Second})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("missing secrets are cached until the negative TTL passes")
+	_, err := s.Read(ctx, id)
+	assert.IsType(t, &IdentifierNotFoundError{}, err)
+	assert.NoError(t, inner.Create(ctx, id, "bar"))
+	_, err = s.Read(ctx, id)
+	assert.IsType(t, &IdentifierNotFoundError{}, err)
+	now = now.Add(2 * time.Second)
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Equal(t, s.Stats(), CacheStats{Hits: 1, Misses: 2, Entries: 1})
+
+	t.Log("writes made elsewhere are seen once the TTL passes")
+	_, err = inner.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	now = now.Add(2 * time.Minute)
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+
+	t.Log("writes made through the cache are seen straight away")
+	_, err = s.Update(ctx, id, "qux")
+	assert.NoError(t, err)
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "qux")
+	assert.NoError(t, s.Delete(ctx, id))
+	_, err = s.Read(ctx, id)
+	assert.IsType(t, &IdentifierNotFoundError{}, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("secrets aren't served after they expire")
+	_, err = inner.UpdateWithExpiration(ctx, id, "baz", now.Add(time.Second))
+	assert.NoError(t, err)
+	s.Invalidate(id)
+	_, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	misses := s.Stats().Misses
+	now = now.Add(2 * time.Second)
+	_, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, s.Stats().Misses, misses+1)
+}
+
+func TestCachingStoreReadMany(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStore()
+	s := NewCachingStore(inner, CacheConfig{})
+	id1, id2, missing := GetRandomTestSecretIdentifier(), GetRandomTestSecretIdentifier(), GetRandomTestSecretIdentifier()
+	assert.NoError(t, inner.Create(ctx, id1, "bar"))
+	assert.NoError(t, inner.Create(ctx, id2, "baz"))
+
+	t.Log("cached secrets are served from the cache, and the rest are read together")
+	_, err := s.Read(ctx, id1)
+	assert.NoError(t, err)
+	secrets, err := ReadMany(ctx, s, []SecretIdentifier{id1, id2, missing})
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+	assert.Equal(t, secrets[id2].Data, "baz")
+	assert.Equal(t, s.Stats(), CacheStats{Hits: 1, Misses: 3, Entries: 3})
+
+	secrets, err = ReadMany(ctx, s, []SecretIdentifier{id1, id2, missing})
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+	assert.Equal(t, s.Stats(), CacheStats{Hits: 4, Misses: 3, Entries: 3})
+}
+
+func TestCachingStoreReadConsistency(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStore()
+	s := NewCachingStore(inner, CacheConfig{})
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, inner.Create(ctx, id, "bar"))
+
+	t.Log("reads that ask for a read consistency are cached apart from other reads")
+	available := WithReadConsistency(ctx, ReadConsistencyAvailable)
+	_, err := s.Read(available, id)
+	assert.NoError(t, err)
+	_, err = inner.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	secret, err := s.Read(WithReadConsistency(ctx, ReadConsistencyStrict), id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	secrets, err := s.ReadMany(ctx, []SecretIdentifier{id})
+	assert.NoError(t, err)
+	assert.Equal(t, secrets[id].Data, "baz")
+	secret, err = s.Read(available, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Equal(t, s.Stats(), CacheStats{Hits: 1, Misses: 3, Entries: 3})
+}
+
+func TestCachingStoreTrash(t *testing.T) {
+	ctx := context.Background()
+	s := NewCachingStore(NewMemoryStore(), CacheConfig{})
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("trashing and restoring a secret through the cache drops its cached reads")
+	_, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	trashed, err := s.Trash(ctx, id)
+	assert.NoError(t, err)
+	_, err = s.Read(ctx, id)
+	assert.IsType(t, &IdentifierNotFoundError{}, err)
+	assert.NoError(t, s.Restore(ctx, trashed))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("expiring writes drop cached reads too")
+	_, err = s.UpdateWithExpiration(ctx, id, "baz", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+
+	t.Log("stores without the trash aren't reported as supporting it")
+	assert.False(t, Implements[TrashStore](NewCachingStore(NewMockStore(), CacheConfig{})))
+	_, err = NewCachingStore(NewMockStore(), CacheConfig{}).Trash(ctx, id)
+	assert.IsType(t, &UnsupportedError{}, err)
+}
+
+func TestCachingStoreMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryStore()
+	s := NewCachingStore(inner, CacheConfig{MaxEntries: 2})
+	ids := []SecretIdentifier{GetRandomTestSecretIdentifier(), GetRandomTestSecretIdentifier(), GetRandomTestSecretIdentifier()}
+	for _, id := range ids {
+		assert.NoError(t, inner.Create(ctx, id, "bar"))
+	}
+
+	t.Log("the least recently used entry is evicted")
+	for _, id := range []SecretIdentifier{ids[0], ids[1], ids[0], ids[2], ids[0]} {
+		_, err := s.Read(ctx, id)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, s.Stats(), CacheStats{Hits: 2, Misses: 3, Evictions: 1, Entries: 2})
+	_, err := s.Read(ctx, ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, s.Stats().Misses, uint64(4))
+}
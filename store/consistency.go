@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ReadConsistency selects which regions a multi-region store reads a secret from
+type ReadConsistency string
+
+const (
+	// ReadConsistencyStrict reads every region, and fails if any of them fails. This is the default.
+	ReadConsistencyStrict ReadConsistency = "strict"
+	// ReadConsistencyPrimary reads only the primary region
+	ReadConsistencyPrimary ReadConsistency = "primary"
+	// ReadConsistencyAvailable reads every region at once, and uses the first region, starting with the primary
+	// region, that has the secret. Regions that are still being read then are canceled. How the regions that
+	// answered differ from it is reported as a RegionDivergence.
+	ReadConsistencyAvailable ReadConsistency = "available"
+)
+
+// ParseReadConsistency parses the name of a read consistency mode, e.g. primary
+func ParseReadConsistency(name string) (ReadConsistency, error) {
+	switch mode := ReadConsistency(name); mode {
+	case ReadConsistencyStrict, ReadConsistencyPrimary, ReadConsistencyAvailable:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid read consistency %q: must be %s, %s or %s", name, ReadConsistencyStrict, ReadConsistencyPrimary, ReadConsistencyAvailable)
+}
+
+// readConsistencyContextKey is the context key of the read consistency of a call
+type readConsistencyContextKey struct{}
+
+// WithReadConsistency makes the reads made with ctx use mode, instead of the store's own read consistency
+func WithReadConsistency(ctx context.Context, mode ReadConsistency) context.Context {
+	return context.WithValue(ctx, readConsistencyContextKey{}, mode)
+}
+
+// readConsistencyOf gets the read consistency the calls made with ctx asked for, or "" if they didn't
+func readConsistencyOf(ctx context.Context) ReadConsistency {
+	mode, _ := ctx.Value(readConsistencyContextKey{}).(ReadConsistency)
+	return mode
+}
+
+type regionContextKey struct{}
+
+// WithRegion makes the reads made with ctx that go to a single region, such as ReadService, History and reads
+// with ReadConsistencyPrimary, go to region instead of the store's primary region. Stores without regions, and
+// stores that don't have region, ignore it.
+func WithRegion(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, regionContextKey{}, region)
+}
+
+// regionOf gets the region the calls made with ctx asked for, or "" if they didn't
+func regionOf(ctx context.Context) string {
+	region, _ := ctx.Value(regionContextKey{}).(string)
+	return region
+}
+
+// readConsistencyFrom gets the read consistency of the calls made with ctx, or fallback if it doesn't set one
+func readConsistencyFrom(ctx context.Context, fallback ReadConsistency) ReadConsistency {
+	if mode := readConsistencyOf(ctx); mode != "" {
+		return mode
+	}
+	if fallback == "" {
+		return ReadConsistencyStrict
+	}
+	return fallback
+}
+
+// RegionDivergence describes how the regions of a multi-region store differed during a read with
+// ReadConsistencyAvailable
+type RegionDivergence struct {
+	Identifier SecretIdentifier
+	// Region is the region the secret was read from
+	Region string
+	// Errors are the errors of the regions that couldn't be read, by region
+	Errors map[string]error
+	// Versions are the versions of the regions whose secret differs from Region's, by region. A region where
+	// the secret doesn't exist has version -1.
+	Versions map[string]int
+}
+
+func (d RegionDivergence) String() string {
+	parts := []string{}
+	for _, region := range sortedRegions(d.Errors) {
+		parts = append(parts, fmt.Sprintf("region %s failed: %s", region, d.Errors[region]))
+	}
+	for _, region := range sortedRegions(d.Versions) {
+		if d.Versions[region] < 0 {
+			parts = append(parts, fmt.Sprintf("region %s doesn't have it", region))
+		} else {
+			parts = append(parts, fmt.Sprintf("region %s differs at version %d", region, d.Versions[region]))
+		}
+	}
+	return fmt.Sprintf("secret (%s) was read from region %s, but %s", d.Identifier, d.Region, strings.Join(parts, "; "))
+}
+
+// logDivergence is how stores report divergences when they aren't given a function to report them to
+func logDivergence(ctx context.Context, divergence RegionDivergence) {
+	log.Printf("warning: %s", divergence)
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReadConsistency(t *testing.T) {
+	for _, name := range []string{"strict", "primary", "available"} {
+		mode, err := ParseReadConsistency(name)
+		assert.NoError(t, err)
+		assert.Equal(t, string(mode), name)
+	}
+	_, err := ParseReadConsistency("eventual")
+	assert.Error(t, err)
+}
+
+func TestParameterStoreReadConsistency(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2", "us-east-1"})
+	divergences := []RegionDivergence{}
+	s.OnDivergence = func(ctx context.Context, divergence RegionDivergence) {
+		divergences = append(divergences, divergence)
+	}
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	missing := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "missing"}
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	fakes["us-east-1"].down = true
+
+	t.Log("strict reads fail when any region is down")
+	_, err := s.Read(ctx, id)
+	assert.Error(t, err)
+	_, err = s.ReadMany(ctx, []SecretIdentifier{id})
+	assert.Error(t, err)
+
+	t.Log("primary reads only read the primary region, and can be chosen per call")
+	primary := WithReadConsistency(ctx, ReadConsistencyPrimary)
+	secret, err := s.Read(primary, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	_, err = s.Read(primary, missing)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: missing, Region: "us-west-1"})
+	secrets, err := s.ReadMany(primary, []SecretIdentifier{id, missing})
+	assert.NoError(t, err)
+	assert.Equal(t, secrets[id].Data, "bar")
+	assert.Empty(t, divergences)
+
+	t.Log("available reads are served by the primary region when it has the secret")
+	s.ReadConsistency = ReadConsistencyAvailable
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	_, err = s.Read(ctx, missing)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: missing, Region: "us-west-1"})
+	for _, divergence := range divergences {
+		assert.Equal(t, divergence.Region, "us-west-1")
+		assert.Equal(t, sortedRegions(divergence.Errors), []string{"us-east-1"})
+	}
+
+	t.Log("a call can still ask for strict reads")
+	_, err = s.Read(WithReadConsistency(ctx, ReadConsistencyStrict), id)
+	assert.Error(t, err)
+
+	t.Log("a slow primary region isn't passed over for a region that answers sooner, which is reported if it differs")
+	name := getParamNameFromName(id)
+	fakes["us-east-1"].down = false
+	fakes["us-west-1"].delay = 100 * time.Millisecond
+	fakes["us-west-2"].parameters[name] = []string{"bar", "baz"}
+	divergences = nil
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Len(t, divergences, 1)
+	assert.Equal(t, divergences[0].Region, "us-west-1")
+	assert.Equal(t, divergences[0].Versions["us-west-2"], 1)
+	assert.Contains(t, divergences[0].String(), "region us-west-2 differs at version 1")
+	fakes["us-west-1"].delay = 0
+	fakes["us-west-2"].parameters[name] = []string{"bar"}
+
+	t.Log("a primary region without the secret falls back to the next region, and is reported as missing it")
+	fakes["us-west-1"].parameters[name] = nil
+	divergences = nil
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Len(t, divergences, 1)
+	assert.Equal(t, divergences[0].Region, "us-west-2")
+	assert.Equal(t, divergences[0].Versions["us-west-1"], -1)
+	assert.Contains(t, divergences[0].String(), "region us-west-1 doesn't have it")
+	divergences = nil
+	secrets, err = s.ReadMany(ctx, []SecretIdentifier{id})
+	assert.NoError(t, err)
+	assert.Equal(t, secrets[id].Data, "bar")
+	assert.Len(t, divergences, 1)
+	assert.Equal(t, divergences[0].Versions["us-west-1"], -1)
+	fakes["us-west-1"].parameters[name] = []string{"bar"}
+
+	t.Log("available reads fall back from the primary region when it fails")
+	fakes["us-west-1"].down = true
+	divergences = nil
+	secret, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Len(t, divergences, 1)
+	assert.Equal(t, divergences[0].Region, "us-west-2")
+	assert.Equal(t, sortedRegions(divergences[0].Errors), []string{"us-west-1"})
+	assert.Contains(t, divergences[0].String(), "region us-west-1 failed")
+
+	t.Log("ReadMany falls back too")
+	divergences = nil
+	secrets, err = s.ReadMany(ctx, []SecretIdentifier{id, missing})
+	assert.NoError(t, err)
+	assert.Equal(t, secrets, map[SecretIdentifier]Secret{id: secret})
+	t.Log("the missing secret is looked for in every region, so its read reports the failed region too")
+	assert.Len(t, divergences, 2)
+	for _, divergence := range divergences {
+		assert.Equal(t, divergence.Region, "us-west-2")
+		assert.Equal(t, sortedRegions(divergence.Errors), []string{"us-west-1"})
+	}
+
+	t.Log("available reads fail when every region is down")
+	fakes["us-west-1"].down = true
+	fakes["us-west-2"].down = true
+	fakes["us-east-1"].down = true
+	_, err = s.Read(ctx, id)
+	assert.Error(t, err)
+	_, err = s.ReadMany(ctx, []SecretIdentifier{id})
+	assert.Error(t, err)
+}
+
+func TestParameterStoreWithRegion(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	fakes["us-west-2"].parameters[getParamNameFromName(id)] = []string{"bar", "baz"}
+
+	t.Log("reads of a single region go to the region a call asks for, without changing the store's primary region")
+	primary := WithReadConsistency(ctx, ReadConsistencyPrimary)
+	secret, err := s.Read(WithRegion(primary, "us-west-2"), id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	history, err := s.History(WithRegion(ctx, "us-west-2"), id)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, s.ParamRegion, "us-west-1")
+	secret, err = s.Read(primary, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("a region the store doesn't have is ignored")
+	secret, err = s.Read(WithRegion(primary, "eu-west-1"), id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("reads of different regions are cached apart")
+	c := NewCachingStore(s, CacheConfig{})
+	secret, err = c.Read(primary, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	secret, err = c.Read(WithRegion(primary, "us-west-2"), id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+}
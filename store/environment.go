@@ -0,0 +1,222 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Environment is an index into the configured environments, used to access different Stealth stores
+type Environment int
+
+const (
+	// ProductionEnvironment is an index for prod
+	ProductionEnvironment Environment = iota
+	// DevelopmentEnvironment is an index for dev
+	DevelopmentEnvironment
+	// CITestEnvironment is an index for ci-test
+	CITestEnvironment
+)
+
+// EnvironmentConfig describes an environment that secrets can belong to
+type EnvironmentConfig struct {
+	// Name is how the environment is written in identifiers and on the command line, e.g. "production"
+	Name string `json:"name"`
+	// PathPrefix is where the environment's secrets live in path-based stores. Defaults to "/" + Name.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// RoleARN is the AWS role assumed to manage the environment's secrets, if any
+	RoleARN string `json:"role_arn,omitempty"`
+	// Regions are the AWS regions the environment's secrets are replicated to, in the order they are written.
+	// Defaults to us-west-1, us-west-2 and us-east-1.
+	Regions []string `json:"regions,omitempty"`
+	// PrimaryRegion is the region reads and listings go to, which must be one of Regions. Defaults to
+	// DefaultRegion if it is one of them, and otherwise to the first.
+	PrimaryRegion string `json:"primary_region,omitempty"`
+}
+
+// environmentsFile is the format of an environments config file
+type environmentsFile struct {
+	Environments []EnvironmentConfig `json:"environments"`
+}
+
+var (
+	environmentsMu sync.RWMutex
+	// environments is the single source of truth for environments; an Environment indexes into it
+	environments = []EnvironmentConfig{
+		{Name: "production", PathPrefix: "/production", RoleARN: "arn:aws:iam::195275663288:role/SecretsManagement"},
+		{Name: "development", PathPrefix: "/development", RoleARN: "arn:aws:iam::577638400844:role/SecretsManagement"},
+		{Name: "ci-test", PathPrefix: "/ci-test"},
+	}
+)
+
+// RegisterEnvironment adds an environment, or replaces the config of the environment with the same name.
+// Replacing keeps the environment's index, so the default environments keep their constants.
+func RegisterEnvironment(cfg EnvironmentConfig) (Environment, error) {
+	if !isValidPathSegment(cfg.Name) {
+		return -1, fmt.Errorf("invalid environment name: %q", cfg.Name)
+	}
+	if cfg.PathPrefix == "" {
+		cfg.PathPrefix = "/" + cfg.Name
+	}
+	cfg.PathPrefix = "/" + strings.Trim(cfg.PathPrefix, "/")
+	for _, segment := range strings.Split(strings.TrimPrefix(cfg.PathPrefix, "/"), "/") {
+		if !isValidPathSegment(segment) {
+			return -1, fmt.Errorf("invalid path prefix for environment %s: %q", cfg.Name, cfg.PathPrefix)
+		}
+	}
+	cfg.Regions = append([]string{}, cfg.Regions...)
+	seen := map[string]bool{}
+	for _, region := range cfg.Regions {
+		if region == "" || seen[region] {
+			return -1, fmt.Errorf("invalid regions for environment %s: %q", cfg.Name, cfg.Regions)
+		}
+		seen[region] = true
+	}
+	if cfg.PrimaryRegion != "" {
+		regions := cfg.Regions
+		if len(regions) == 0 {
+			regions = orderedRegions
+		}
+		if !slices.Contains(regions, cfg.PrimaryRegion) {
+			return -1, fmt.Errorf("primary region %s of environment %s is not one of its regions %q", cfg.PrimaryRegion, cfg.Name, regions)
+		}
+	}
+
+	environmentsMu.Lock()
+	defer environmentsMu.Unlock()
+	index := len(environments)
+	for i, existing := range environments {
+		if existing.Name == cfg.Name {
+			index = i
+		} else if prefixesOverlap(existing.PathPrefix, cfg.PathPrefix) {
+			return -1, fmt.Errorf("path prefix %s of environment %s overlaps environment %s", cfg.PathPrefix, cfg.Name, existing.Name)
+		}
+	}
+	if index == len(environments) {
+		environments = append(environments, cfg)
+	} else {
+		environments[index] = cfg
+	}
+	return Environment(index), nil
+}
+
+// isValidPathSegment checks that a name can be used as one segment of a secret's path
+func isValidPathSegment(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/. \t\n")
+}
+
+// prefixesOverlap checks if secrets under one path prefix could be mistaken for secrets under the other
+func prefixesOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// LoadEnvironments registers every environment in a JSON config file of the form
+// {"environments": [{"name": "staging", "path_prefix": "/staging", "role_arn": "arn:...", "regions": ["us-west-2"],
+// "primary_region": "us-west-2"}]}
+func LoadEnvironments(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file environmentsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("unable to parse environments config %s: %s", path, err)
+	}
+	for _, cfg := range file.Environments {
+		if _, err := RegisterEnvironment(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Environments returns every configured environment, in index order
+func Environments() []Environment {
+	environmentsMu.RLock()
+	defer environmentsMu.RUnlock()
+	envs := make([]Environment, len(environments))
+	for i := range environments {
+		envs[i] = Environment(i)
+	}
+	return envs
+}
+
+// ParseEnvironment converts a name like "production" into the corresponding Environment
+func ParseEnvironment(name string) (Environment, error) {
+	environmentsMu.RLock()
+	defer environmentsMu.RUnlock()
+	for i, cfg := range environments {
+		if cfg.Name == name {
+			return Environment(i), nil
+		}
+	}
+	return -1, &InvalidEnvironmentError{Identifier: name}
+}
+
+// Config returns the environment's config, and whether the environment is configured
+func (e Environment) Config() (EnvironmentConfig, bool) {
+	environmentsMu.RLock()
+	defer environmentsMu.RUnlock()
+	if e < 0 || int(e) >= len(environments) {
+		return EnvironmentConfig{}, false
+	}
+	cfg := environments[e]
+	cfg.Regions = append([]string{}, cfg.Regions...)
+	return cfg, true
+}
+
+// IsValid checks if the environment is among the configured environments
+func (e Environment) IsValid() bool {
+	_, ok := e.Config()
+	return ok
+}
+
+func (e Environment) String() string {
+	cfg, ok := e.Config()
+	if !ok {
+		return "unknown"
+	}
+	return cfg.Name
+}
+
+// pathPrefix returns where the environment's secrets live in path-based stores, without a leading slash
+func (e Environment) pathPrefix() string {
+	cfg, _ := e.Config()
+	return strings.TrimPrefix(cfg.PathPrefix, "/")
+}
+
+// regions returns the AWS regions the environment's secrets are replicated to, in the order they are written
+func (e Environment) regions() []string {
+	cfg, _ := e.Config()
+	if len(cfg.Regions) == 0 {
+		return append([]string{}, orderedRegions...)
+	}
+	return cfg.Regions
+}
+
+// primaryRegion returns the region reads of the environment's secrets go to
+func (e Environment) primaryRegion() string {
+	cfg, _ := e.Config()
+	if cfg.PrimaryRegion != "" {
+		return cfg.PrimaryRegion
+	}
+	return defaultRegionOf(e.regions())
+}
+
+// environmentFromPath finds the environment whose path prefix starts a path like development/oauth/foo-bar,
+// and returns the rest of the path, e.g. oauth/foo-bar. A leading slash on the path is ignored.
+func environmentFromPath(path string) (Environment, string, bool) {
+	path = strings.TrimPrefix(path, "/")
+	environmentsMu.RLock()
+	defer environmentsMu.RUnlock()
+	for i, cfg := range environments {
+		prefix := strings.TrimPrefix(cfg.PathPrefix, "/") + "/"
+		if strings.HasPrefix(path, prefix) {
+			return Environment(i), strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return -1, "", false
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	t.Log("names round trip for the default environments")
+	for _, env := range []Environment{ProductionEnvironment, DevelopmentEnvironment, CITestEnvironment} {
+		parsed, err := ParseEnvironment(env.String())
+		assert.NoError(t, err)
+		assert.Equal(t, parsed, env)
+		assert.Equal(t, SecretIdentifier{Environment: env}.EnvironmentString(), env.String())
+	}
+	assert.Equal(t, CITestEnvironment.String(), "ci-test")
+
+	t.Log("unknown environments fail to parse")
+	_, err := ParseEnvironment("ci")
+	assert.Equal(t, err, &InvalidEnvironmentError{Identifier: "ci"})
+	assert.Equal(t, Environment(-1).String(), "unknown")
+	assert.False(t, Environment(-1).IsValid())
+}
+
+func TestRegisterEnvironment(t *testing.T) {
+	ctx := context.Background()
+	name := "staging-" + randSeq(6)
+	env, err := RegisterEnvironment(EnvironmentConfig{Name: name, PathPrefix: "/" + name + "/v2", Regions: []string{"us-west-2"}})
+	assert.NoError(t, err)
+	parsed, err := ParseEnvironment(name)
+	assert.NoError(t, err)
+	assert.Equal(t, parsed, env)
+	assert.Contains(t, Environments(), env)
+	assert.Equal(t, environmentRegions(name), []string{"us-west-2"})
+
+	t.Log("path-based names use the path prefix")
+	id := SecretIdentifier{Environment: env, Service: "service", Key: "foo"}
+	assert.Equal(t, getParamNameFromName(id), "/"+name+"/v2/service/foo")
+	idFromName, err := getSecretIDFromParamName("/" + name + "/v2/service/foo")
+	assert.NoError(t, err)
+	assert.Equal(t, idFromName, id)
+	idFromName, err = getSecretIDFromSecretsManagerName(getSecretsManagerName(id))
+	assert.NoError(t, err)
+	assert.Equal(t, idFromName, id)
+
+	t.Log("registered environments can hold secrets")
+	for storeName, s := range ContextStores() {
+		t.Logf("---- %s ----\n", storeName)
+		assert.NoError(t, s.Create(ctx, id, "bar"))
+		ids, err := s.ListAll(ctx, env)
+		assert.NoError(t, err)
+		assert.Contains(t, ids, id)
+		assert.NoError(t, s.Delete(ctx, id))
+	}
+
+	t.Log("re-registering an environment replaces its config and keeps its index")
+	again, err := RegisterEnvironment(EnvironmentConfig{Name: name})
+	assert.NoError(t, err)
+	assert.Equal(t, again, env)
+	cfg, ok := env.Config()
+	assert.True(t, ok)
+	assert.Equal(t, cfg.PathPrefix, "/"+name)
+
+	t.Log("invalid or overlapping environments are rejected")
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: "has.dot"})
+	assert.Error(t, err)
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: "other-" + randSeq(6), PathPrefix: "/production/other"})
+	assert.Error(t, err)
+}
+
+func TestLoadEnvironments(t *testing.T) {
+	name := "sandbox-" + randSeq(6)
+	path := filepath.Join(t.TempDir(), "stealth.json")
+	config := `{"environments": [{"name": "` + name + `", "role_arn": "arn:aws:iam::123456789012:role/SecretsManagement"}]}`
+	assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+	assert.NoError(t, LoadEnvironments(path))
+
+	env, err := ParseEnvironment(name)
+	assert.NoError(t, err)
+	cfg, _ := env.Config()
+	assert.Equal(t, cfg.PathPrefix, "/"+name)
+	assert.Equal(t, environmentRoleARN(name), "arn:aws:iam::123456789012:role/SecretsManagement")
+	assert.Equal(t, environmentRegions(name), orderedRegions)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json"), 0600))
+	assert.Error(t, LoadEnvironments(path))
+}
+
+func TestEnvironmentRegions(t *testing.T) {
+	name := "regional-" + randSeq(6)
+	_, err := RegisterEnvironment(EnvironmentConfig{Name: name, Regions: []string{"us-east-2", "us-west-2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, environmentRegions(name), []string{"us-east-2", "us-west-2"})
+	t.Log("without a primary region, reads go to the default region if the environment has it, or else the first")
+	assert.Equal(t, environmentPrimaryRegion(name), "us-east-2")
+	assert.Equal(t, environmentPrimaryRegion("production"), DefaultRegion)
+
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: name, Regions: []string{"us-east-2", "us-west-2"}, PrimaryRegion: "us-west-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, environmentPrimaryRegion(name), "us-west-2")
+	assert.Equal(t, environmentRegions(name), []string{"us-east-2", "us-west-2"}, "the primary region doesn't change the write order")
+
+	t.Log("the primary region must be one of the regions, which can't repeat")
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: name, Regions: []string{"us-east-2"}, PrimaryRegion: "us-west-1"})
+	assert.Error(t, err)
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: name, PrimaryRegion: "eu-west-1"})
+	assert.Error(t, err)
+	_, err = RegisterEnvironment(EnvironmentConfig{Name: name, Regions: []string{"us-east-2", "us-east-2"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ExpiringWriter is implemented by stores that can write secrets that expire. Once a secret has expired it
+// can no longer be read, and the store may delete it.
+type ExpiringWriter interface {
+	// CreateWithExpiration creates a secret like Create, which expires at expiration
+	CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error
+
+	// UpdateWithExpiration updates a secret like Update, and makes it expire at expiration
+	UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error)
+}
+
+// ExpiringSecret is a secret with an expiration
+type ExpiringSecret struct {
+	Identifier SecretIdentifier
+	Expiration time.Time
+}
+
+// ExpirationLister is implemented by stores that can find expiring secrets without reading every secret
+type ExpirationLister interface {
+	// ListExpiring gets the secrets within an environment that expire before cutoff, soonest first
+	ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error)
+}
+
+// ListExpiring gets the secrets within an environment that expire before cutoff, soonest first. It uses the
+// store's ListExpiring if it implements ExpirationLister, and otherwise reads every secret in the environment
+// and checks its Expiration.
+func ListExpiring(ctx context.Context, s ContextSecretStore, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	if lister, ok := s.(ExpirationLister); ok {
+		return lister.ListExpiring(ctx, env, cutoff)
+	}
+	ids, err := s.ListAll(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := ReadMany(ctx, s, ids)
+	if err != nil {
+		return nil, err
+	}
+	results := []ExpiringSecret{}
+	for id, secret := range secrets {
+		if expiration := secret.Meta.Expiration; !expiration.IsZero() && expiration.Before(cutoff) {
+			results = append(results, ExpiringSecret{Identifier: id, Expiration: expiration})
+		}
+	}
+	sortExpiring(results)
+	return results, nil
+}
+
+// sortExpiring sorts expiring secrets soonest first
+func sortExpiring(secrets []ExpiringSecret) {
+	sort.Slice(secrets, func(i, j int) bool {
+		if !secrets[i].Expiration.Equal(secrets[j].Expiration) {
+			return secrets[i].Expiration.Before(secrets[j].Expiration)
+		}
+		return secrets[i].Identifier.String() < secrets[j].Identifier.String()
+	})
+}
+
+// SecretExpiredError occurs when reading a secret that has expired
+type SecretExpiredError struct {
+	Identifier SecretIdentifier
+	Expiration time.Time
+}
+
+func (e *SecretExpiredError) Error() string {
+	return fmt.Sprintf("Secret %s expired at %s", e.Identifier, e.Expiration.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultRegionParallelism is how many regions ParameterStore and SecretsManagerStore call at once, unless
+// configured otherwise
+const DefaultRegionParallelism = 4
+
+// forEachRegion calls fn for every region, running up to parallelism calls at once, and returns the errors of
+// the regions where fn failed. A parallelism below 1 calls every region at once.
+func forEachRegion(ctx context.Context, regions []string, parallelism int, fn func(ctx context.Context, region string) error) map[string]error {
+	if parallelism < 1 {
+		parallelism = len(regions)
+	}
+	var mu sync.Mutex
+	failures := map[string]error{}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(1, parallelism))
+	for _, region := range regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if err := fn(ctx, region); err != nil {
+				mu.Lock()
+				failures[region] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// retryRegions calls fn for every region, then once more for the regions where it failed, and returns the
+// errors of the regions where the retry failed too
+func retryRegions(ctx context.Context, regions []string, parallelism int, fn func(ctx context.Context, region string) error) map[string]error {
+	failures := forEachRegion(ctx, regions, parallelism, fn)
+	if len(failures) == 0 {
+		return failures
+	}
+	return forEachRegion(ctx, sortedRegions(failures), parallelism, fn)
+}
+
+// regionResult is what a call to one region returned
+type regionResult[T any] struct {
+	region string
+	value  T
+	err    error
+}
+
+// firstHealthy calls read in every region at once, and returns the result of the first region, in the order of
+// regions, whose read is healthy. Slower regions are waited for, so that a region that answers sooner doesn't win
+// over one before it. It also returns every result that had arrived by then, by region, or false along with all of
+// the results if no region was healthy. Reads still in flight are canceled.
+func firstHealthy[T any](ctx context.Context, regions []string, read func(ctx context.Context, region string) (T, error), healthy func(err error) bool) (regionResult[T], map[string]regionResult[T], bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// buffered, so that the reads that are canceled don't block
+	results := make(chan regionResult[T], len(regions))
+	for _, region := range regions {
+		go func() {
+			value, err := read(ctx, region)
+			results <- regionResult[T]{region: region, value: value, err: err}
+		}()
+	}
+	answered := map[string]regionResult[T]{}
+	for _, region := range regions {
+		for {
+			if _, ok := answered[region]; ok {
+				break
+			}
+			result := <-results
+			answered[result.region] = result
+		}
+		if !healthy(answered[region].err) {
+			continue
+		}
+	drain:
+		for {
+			select {
+			case result := <-results:
+				answered[result.region] = result
+			default:
+				break drain
+			}
+		}
+		return answered[region], answered, true
+	}
+	return regionResult[T]{}, answered, false
+}
+
+// sortedRegions returns the regions of a map keyed by region, sorted
+func sortedRegions[V any](m map[string]V) []string {
+	regions := make([]string, 0, len(m))
+	for region := range m {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// MultiRegionError occurs when a write to a multi-region store failed in some regions. The store reverts the
+// write in every region when it can, so that the regions stay consistent; Reverted says whether it did.
+type MultiRegionError struct {
+	// Operation is the write that failed, e.g. create
+	Operation  string
+	Identifier SecretIdentifier
+	// Errors are the errors of the regions the write failed in, by region
+	Errors map[string]error
+	// Reverted says whether the write was undone in every region
+	Reverted bool
+	// RevertErrors are the errors of the regions the write couldn't be undone in, by region
+	RevertErrors map[string]error
+}
+
+func (e *MultiRegionError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Error during %s of secret (%s) in %s", e.Operation, e.Identifier, formatRegionErrors(e.Errors))
+	switch {
+	case e.Reverted:
+		b.WriteString(". reverted it in every region. try again")
+	case len(e.RevertErrors) > 0:
+		fmt.Fprintf(&b, ". unable to revert it in %s. regions may be inconsistent, try again", formatRegionErrors(e.RevertErrors))
+	default:
+		b.WriteString(". try again")
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors of every region, so that errors.As finds, e.g., a ParameterNotFound in any of them
+func (e *MultiRegionError) Unwrap() []error {
+	errs := []error{}
+	for _, region := range sortedRegions(e.Errors) {
+		errs = append(errs, e.Errors[region])
+	}
+	return errs
+}
+
+// formatRegionErrors formats per-region errors as "region us-east-1: <error>; region us-west-2: <error>"
+func formatRegionErrors(errs map[string]error) string {
+	parts := []string{}
+	for _, region := range sortedRegions(errs) {
+		parts = append(parts, fmt.Sprintf("region %s: %s", region, errs[region]))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// joinRegionErrors is like formatRegionErrors, but returns an error that wraps the error of every region, so that
+// errors.As still finds them
+func joinRegionErrors(errs map[string]error) error {
+	formats := []string{}
+	args := []any{}
+	for _, region := range sortedRegions(errs) {
+		formats = append(formats, "region %s: %w")
+		args = append(args, region, errs[region])
+	}
+	return fmt.Errorf(strings.Join(formats, "; "), args...)
+}
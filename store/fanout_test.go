@@ -0,0 +1,468 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForEachRegion(t *testing.T) {
+	regions := []string{"us-west-1", "us-west-2", "us-east-1", "us-east-2", "eu-west-1"}
+	var running, most int32
+	var mu sync.Mutex
+	called := []string{}
+	failures := forEachRegion(context.Background(), regions, 2, func(ctx context.Context, region string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		most = max(most, n)
+		called = append(called, region)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		if strings.HasPrefix(region, "us-east") {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+
+	t.Log("every region is called, at most parallelism at once, and failures are reported by region")
+	assert.ElementsMatch(t, called, regions)
+	assert.Equal(t, most, int32(2))
+	assert.Equal(t, sortedRegions(failures), []string{"us-east-1", "us-east-2"})
+}
+
+// fakeSSM is a stand-in for the SSM API in one region, which keeps every version and label of its parameters and
+// can be made to fail writes, or every call
+type fakeSSM struct {
+	mu         sync.Mutex
+	parameters map[string][]string
+	// policies and tiers are what each version of a parameter was written with, by parameter
+	policies map[string][]string
+	tiers    map[string][]string
+	// labels are the 1-indexed versions labels are attached to, by parameter and label
+	labels map[string]map[string]int
+	// failWrites is how many of the next writes fail
+	failWrites int
+	// down makes every call fail, with downCode as the error code if it is set
+	down     bool
+	downCode string
+	// delay holds every call for that long before answering it
+	delay time.Duration
+	// interloper, if set, is written by another writer right before the next PutParameter
+	interloper string
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the request's context is only canceled once its body has been read
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	delay := f.delay
+	f.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var input struct {
+		Name             string
+		Names            []string
+		Value            string
+		Overwrite        bool
+		Labels           []string
+		ParameterVersion int
+		Policies         string
+		Tier             string
+	}
+	json.Unmarshal(body, &input)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type":%q,"message":"failed"}`, code)
+	}
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	if f.down && f.downCode != "" {
+		fail(f.downCode)
+		return
+	}
+	if f.down {
+		fail("InternalServerError")
+		return
+	}
+	if operation != "GetParameter" && operation != "GetParameters" && f.failWrites > 0 {
+		f.failWrites--
+		fail("InternalServerError")
+		return
+	}
+	name, selector, _ := strings.Cut(input.Name, ":")
+	versions := f.parameters[name]
+	switch operation {
+	case "GetParameter":
+		if len(versions) == 0 {
+			fail("ParameterNotFound")
+			return
+		}
+		version := len(versions)
+		if n, err := strconv.Atoi(selector); err == nil {
+			version = n
+		} else if selector != "" {
+			version = f.labels[name][selector]
+		}
+		if version < 1 || version > len(versions) {
+			fail("ParameterVersionNotFound")
+			return
+		}
+		fmt.Fprintf(w, `{"Parameter":{"Name":%q,"Value":%q,"Version":%d,"LastModifiedDate":1700000000}}`, name, versions[version-1], version)
+	case "GetParameters":
+		parameters := []string{}
+		for _, name := range input.Names {
+			if versions := f.parameters[name]; len(versions) > 0 {
+				parameters = append(parameters, fmt.Sprintf(`{"Name":%q,"Value":%q,"Version":%d,"LastModifiedDate":1700000000}`, name, versions[len(versions)-1], len(versions)))
+			}
+		}
+		fmt.Fprintf(w, `{"Parameters":[%s]}`, strings.Join(parameters, ","))
+	case "PutParameter":
+		if len(versions) > 0 && !input.Overwrite {
+			fail("ParameterAlreadyExists")
+			return
+		}
+		if f.interloper != "" {
+			versions = append(versions, f.interloper)
+			f.interloper = ""
+		}
+		f.parameters[input.Name] = append(versions, input.Value)
+		policies, tiers := f.policies[input.Name], f.tiers[input.Name]
+		if len(versions) == 0 || !input.Overwrite {
+			policies, tiers = nil, nil
+		}
+		// versions written without policies or tiers, e.g. by a test, have none
+		for len(policies) < len(versions) {
+			policies, tiers = append(policies, ""), append(tiers, "")
+		}
+		f.policies[input.Name] = append(policies, input.Policies)
+		f.tiers[input.Name] = append(tiers, input.Tier)
+		fmt.Fprintf(w, `{"Version":%d}`, len(versions)+1)
+	case "GetParameterHistory":
+		if len(versions) == 0 {
+			fail("ParameterNotFound")
+			return
+		}
+		history := []map[string]interface{}{}
+		for i, value := range versions {
+			labels := []string{}
+			for label, version := range f.labels[name] {
+				if version == i+1 {
+					labels = append(labels, label)
+				}
+			}
+			sort.Strings(labels)
+			parameter := map[string]interface{}{"Name": name, "Value": value, "Version": i + 1, "LastModifiedDate": 1700000000, "Labels": labels}
+			if tiers := f.tiers[name]; i < len(tiers) && tiers[i] != "" {
+				parameter["Tier"] = tiers[i]
+			}
+			if policies := f.policies[name]; i < len(policies) && policies[i] != "" {
+				var texts []json.RawMessage
+				json.Unmarshal([]byte(policies[i]), &texts)
+				inline := []map[string]string{}
+				for _, text := range texts {
+					var policy struct{ Type string }
+					json.Unmarshal(text, &policy)
+					inline = append(inline, map[string]string{"PolicyText": string(text), "PolicyType": policy.Type, "PolicyStatus": "Pending"})
+				}
+				parameter["Policies"] = inline
+			}
+			history = append(history, parameter)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parameters": history})
+	case "DeleteParameter":
+		if len(versions) == 0 {
+			fail("ParameterNotFound")
+			return
+		}
+		delete(f.parameters, input.Name)
+		delete(f.policies, input.Name)
+		delete(f.tiers, input.Name)
+		delete(f.labels, input.Name)
+		fmt.Fprint(w, `{}`)
+	case "LabelParameterVersion", "UnlabelParameterVersion":
+		if len(versions) == 0 {
+			fail("ParameterNotFound")
+			return
+		}
+		if input.ParameterVersion < 1 || input.ParameterVersion > len(versions) {
+			fail("ParameterVersionNotFound")
+			return
+		}
+		if f.labels[name] == nil {
+			f.labels[name] = map[string]int{}
+		}
+		for _, label := range input.Labels {
+			if operation == "LabelParameterVersion" {
+				f.labels[name][label] = input.ParameterVersion
+			} else if f.labels[name][label] == input.ParameterVersion {
+				delete(f.labels[name], label)
+			}
+		}
+		fmt.Fprintf(w, `{"InvalidLabels":[],"ParameterVersion":%d}`, input.ParameterVersion)
+	default:
+		fail("UnsupportedOperation")
+	}
+}
+
+// labeled returns the 1-indexed version a label is attached to, or 0 if it isn't attached
+func (f *fakeSSM) labeled(name, label string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.labels[name][label]
+}
+
+// latest returns the latest value of a parameter, or "" if it doesn't exist
+func (f *fakeSSM) latest(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if versions := f.parameters[name]; len(versions) > 0 {
+		return versions[len(versions)-1]
+	}
+	return ""
+}
+
+// newFakeParameterStore creates a ParameterStore whose regions are fakeSSMs
+func newFakeParameterStore(t *testing.T, regions []string) (*ParameterStore, map[string]*fakeSSM) {
+	// no retries, so that each failed write fails once
+	limiter := NewRateLimiter(RateLimitConfig{RequestsPerSecond: -1, MaxRetries: -1})
+	fakes := map[string]*fakeSSM{}
+	s := &ParameterStore{ParamRegion: regions[0], RegionParallelism: 2, regions: regions, ssmClients: map[string]*ssm.Client{}}
+	for _, region := range regions {
+		fakes[region] = &fakeSSM{
+			parameters: map[string][]string{},
+			policies:   map[string][]string{},
+			tiers:      map[string][]string{},
+			labels:     map[string]map[string]int{},
+		}
+		server := httptest.NewServer(fakes[region])
+		t.Cleanup(server.Close)
+		s.ssmClients[region] = ssm.New(ssm.Options{
+			Region:       region,
+			Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+			BaseEndpoint: aws.String(server.URL),
+		}, limiter.ssmOptions(region))
+	}
+	return s, fakes
+}
+
+func TestParameterStoreFanOut(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2", "us-east-1"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	name := getParamNameFromName(id)
+
+	t.Log("writes go to every region")
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("a region that fails once is retried")
+	fakes["us-east-1"].failWrites = 1
+	_, err = s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(name), "baz")
+	}
+
+	t.Log("a region that fails again makes the update fail, reported by region, and it is reverted everywhere")
+	fakes["us-east-1"].failWrites = 2
+	_, err = s.Update(ctx, id, "qux")
+	var multiRegionErr *MultiRegionError
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-east-1"})
+	assert.True(t, multiRegionErr.Reverted)
+	assert.Contains(t, err.Error(), "region us-east-1: ")
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(name), "baz")
+	}
+
+	t.Log("a failed create is deleted from the regions it was created in")
+	other := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "other"}
+	fakes["us-west-2"].failWrites = 2
+	err = s.Create(ctx, other, "bar")
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.True(t, multiRegionErr.Reverted)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(getParamNameFromName(other)), "")
+	}
+
+	t.Log("a failed delete reports the regions it failed in")
+	fakes["us-west-1"].failWrites = 2
+	err = s.Delete(ctx, id)
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-west-1"})
+	assert.Equal(t, fakes["us-west-1"].latest(name), "baz")
+	assert.Equal(t, fakes["us-east-1"].latest(name), "")
+}
+
+func TestParameterStoreUpdateIfVersionFanOut(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2", "us-east-1"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	name := getParamNameFromName(id)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("a region that fails once is retried")
+	fakes["us-west-2"].failWrites = 1
+	secret, err := s.UpdateIfVersion(ctx, id, 0, "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 1)
+
+	t.Log("a region that fails again makes the update fail, and every region is reverted")
+	fakes["us-west-2"].failWrites = 2
+	_, err = s.UpdateIfVersion(ctx, id, 1, "qux")
+	var multiRegionErr *MultiRegionError
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-west-2"})
+	assert.True(t, multiRegionErr.Reverted)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(name), "baz")
+	}
+
+	t.Log("another writer that gets to a region first keeps its value there, and the other regions are reverted")
+	other := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "other"}
+	assert.NoError(t, s.Create(ctx, other, "bar"))
+	fakes["us-east-1"].interloper = "interloper"
+	_, err = s.UpdateIfVersion(ctx, other, 0, "baz")
+	assert.Equal(t, err, &VersionConflictError{Identifier: other, Expected: 0, Actual: 1})
+	assert.Equal(t, fakes["us-east-1"].latest(getParamNameFromName(other)), "interloper")
+	assert.Equal(t, fakes["us-west-1"].latest(getParamNameFromName(other)), "bar")
+	assert.Equal(t, fakes["us-west-2"].latest(getParamNameFromName(other)), "bar")
+}
+
+func TestParameterStoreLabelFanOut(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2", "us-east-1"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	name := getParamNameFromName(id)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	_, err := s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+
+	t.Log("labels are attached in every region")
+	assert.NoError(t, s.Label(ctx, id, 0, "stable"))
+	secret, err := s.ReadLabel(ctx, id, "stable")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("a region that fails twice moves the label back in every region")
+	fakes["us-east-1"].failWrites = 2
+	err = s.Label(ctx, id, 1, "stable")
+	var multiRegionErr *MultiRegionError
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.True(t, multiRegionErr.Reverted)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.labeled(name, "stable"), 1)
+	}
+
+	t.Log("a new label that fails is removed from every region")
+	fakes["us-west-1"].failWrites = 2
+	err = s.Label(ctx, id, 1, "canary")
+	assert.True(t, errors.As(err, &multiRegionErr))
+	for _, fake := range fakes {
+		assert.Equal(t, fake.labeled(name, "canary"), 0)
+	}
+
+	t.Log("a missing version is reported as such")
+	assert.Equal(t, s.Label(ctx, id, 5, "stable"), &VersionNotFoundError{Identifier: id, Version: 5})
+	for _, fake := range fakes {
+		assert.Equal(t, fake.labeled(name, "stable"), 1)
+	}
+}
+
+func TestParameterStoreTrashFanOut(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	name := getParamNameFromName(id)
+	expiration := time.Now().Add(30 * 24 * time.Hour).UTC().Truncate(time.Millisecond)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	_, err := s.UpdateWithExpiration(ctx, id, "baz", expiration)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Label(ctx, id, 0, "stable"))
+
+	t.Log("a trashed and restored secret keeps each version's expiration, tier and labels in every region")
+	trashed, err := s.Trash(ctx, id)
+	assert.NoError(t, err)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(name), "")
+		assert.Equal(t, fake.labeled(getTrashParamName(trashed), "stable"), 1)
+	}
+	assert.NoError(t, s.Restore(ctx, trashed))
+	for _, region := range s.GetOrderedRegions() {
+		s.ParamRegion = region
+		history, err := s.History(ctx, id)
+		assert.NoError(t, err)
+		assert.Len(t, history, 2)
+		assert.Equal(t, history[0].Labels, []string{"stable"})
+		assert.True(t, history[0].Expiration.IsZero())
+		assert.Equal(t, history[0].Tier, "")
+		assert.True(t, history[1].Expiration.Equal(expiration))
+		assert.Equal(t, history[1].Tier, string(types.ParameterTierAdvanced))
+		assert.Equal(t, fakes[region].labeled(getTrashParamName(trashed), "stable"), 0)
+	}
+	s.ParamRegion = "us-west-1"
+	secret, err := s.ReadLabel(ctx, id, "stable")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+}
+
+func TestParameterStoreRollbackFanOut(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2", "us-east-1"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	name := getParamNameFromName(id)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	_, err := s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+
+	t.Log("a rollback, which writes the old version back with UpdateIfVersion, is reverted everywhere if a region fails partway")
+	target, err := s.ReadVersion(ctx, id, 0)
+	assert.NoError(t, err)
+	fakes["us-west-2"].failWrites = 2
+	_, err = UpdateIfVersion(ctx, s, id, 1, target.Data)
+	var multiRegionErr *MultiRegionError
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-west-2"})
+	assert.True(t, multiRegionErr.Reverted)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(name), "baz")
+	}
+
+	t.Log("without failures, the old version is restored in every region")
+	other := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "other"}
+	assert.NoError(t, s.Create(ctx, other, "bar"))
+	_, err = s.Update(ctx, other, "baz")
+	assert.NoError(t, err)
+	fakes["us-east-1"].failWrites = 1
+	secret, err := UpdateIfVersion(ctx, s, other, 1, target.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 2)
+	for _, fake := range fakes {
+		assert.Equal(t, fake.latest(getParamNameFromName(other)), "bar")
+	}
+}
@@ -0,0 +1,527 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fileStoreFormatVersion is written to every file, so the format can evolve
+	fileStoreFormatVersion = 1
+	// fileStoreIterations is the PBKDF2 iteration count used when deriving a key from a passphrase
+	fileStoreIterations = 600000
+	// fileStoreKeySize is the size of the AES-256 key, in bytes
+	fileStoreKeySize = 32
+	// fileStoreLockRetry is how long to wait before retrying to acquire a held lock
+	fileStoreLockRetry = 10 * time.Millisecond
+	// FileStorePassphraseEnv is the default environment variable holding the passphrase for file:// stores
+	FileStorePassphraseEnv = "STEALTH_FILE_PASSPHRASE"
+)
+
+func init() {
+	Register("file", openFileStore)
+}
+
+// openFileStore creates a FileStore from a URL of the form file:///path/to/secrets?key-file=/path/to/key.
+// Without key-file, the passphrase is read from the environment variable named by passphrase-env,
+// which defaults to STEALTH_FILE_PASSPHRASE.
+func openFileStore(u *url.URL) (ContextSecretStore, error) {
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("file store URL must include a path, e.g. file:///path/to/secrets")
+	}
+
+	query := u.Query()
+	if keyFile := query.Get("key-file"); keyFile != "" {
+		return NewFileStoreWithKeyFile(path, keyFile)
+	}
+	passphraseEnv := query.Get("passphrase-env")
+	if passphraseEnv == "" {
+		passphraseEnv = FileStorePassphraseEnv
+	}
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return nil, fmt.Errorf("file store requires a key-file or a passphrase in $%s", passphraseEnv)
+	}
+	return NewFileStore(path, passphrase)
+}
+
+// fileEnvelope is the on-disk format of a FileStore: the encrypted contents plus what is needed to decrypt them
+type fileEnvelope struct {
+	FormatVersion int    `json:"format_version"`
+	KDF           string `json:"kdf"`
+	Iterations    int    `json:"iterations,omitempty"`
+	Salt          []byte `json:"salt,omitempty"`
+	Nonce         []byte `json:"nonce"`
+	Ciphertext    []byte `json:"ciphertext"`
+}
+
+// fileRecord is the decrypted history of a single secret
+type fileRecord struct {
+	Environment string   `json:"environment"`
+	Service     string   `json:"service"`
+	Key         string   `json:"key"`
+	Secrets     []Secret `json:"secrets"`
+}
+
+// fileContents is the decrypted contents of a FileStore
+type fileContents struct {
+	Records []fileRecord `json:"records"`
+}
+
+// FileStore is a secret store backed by a single local file, encrypted with AES-256-GCM.
+// The key is either read from a key file, or derived from a passphrase with PBKDF2.
+// Every operation holds a lock on a sidecar .lock file, so several processes can share the same file.
+type FileStore struct {
+	path       string
+	passphrase string
+	key        []byte
+
+	// derivedKeys caches keys derived from the passphrase, by salt, since derivation is deliberately slow
+	derivedMu   sync.Mutex
+	derivedKeys map[string][]byte
+}
+
+// NewFileStore creates a secret store in the file at path, encrypted with a key derived from passphrase.
+// The file is created on the first write.
+func NewFileStore(path, passphrase string) (*FileStore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("file store passphrase must not be empty")
+	}
+	return &FileStore{path: path, passphrase: passphrase, derivedKeys: map[string][]byte{}}, nil
+}
+
+// NewFileStoreWithKeyFile creates a secret store in the file at path, encrypted with the key in keyFile.
+// See GenerateFileStoreKey for creating a key file.
+func NewFileStoreWithKeyFile(path, keyFile string) (*FileStore, error) {
+	encoded, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file store key: %s", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != fileStoreKeySize {
+		return nil, fmt.Errorf("file store key in %s must be %d base64-encoded bytes", keyFile, fileStoreKeySize)
+	}
+	return &FileStore{path: path, key: key}, nil
+}
+
+// GenerateFileStoreKey writes a new random key, base64-encoded, to keyFile. It refuses to overwrite an existing file.
+func GenerateFileStoreKey(keyFile string) error {
+	key := make([]byte, fileStoreKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Create creates a secret in the store
+func (s *FileStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	return s.update(ctx, func(contents *fileContents) error {
+		if findFileRecord(contents, id) != nil {
+			return &IdentifierAlreadyExistsError{Identifier: id}
+		}
+		contents.Records = append(contents.Records, fileRecord{
+			Environment: id.EnvironmentString(),
+			Service:     id.Service,
+			Key:         id.Key,
+			Secrets:     []Secret{{Data: value, Meta: SecretMeta{Created: time.Now().UTC(), Version: 0}}},
+		})
+		return nil
+	})
+}
+
+// Read a secret from the store
+func (s *FileStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var secret Secret
+	err := s.view(ctx, func(contents *fileContents) error {
+		record := findFileRecord(contents, id)
+		if record == nil {
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		}
+		secret = record.Secrets[len(record.Secrets)-1]
+		return nil
+	})
+	return secret, err
+}
+
+// ReadVersion reads a version of a secret
+func (s *FileStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var secret Secret
+	err := s.view(ctx, func(contents *fileContents) error {
+		record := findFileRecord(contents, id)
+		if record == nil {
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		}
+		if version < 0 || version >= len(record.Secrets) {
+			return &VersionNotFoundError{Version: version, Identifier: id}
+		}
+		secret = record.Secrets[version]
+		return nil
+	})
+	return secret, err
+}
+
+// Update updates a secret in the secret store
+func (s *FileStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var secret Secret
+	err := s.update(ctx, func(contents *fileContents) error {
+		record := findFileRecord(contents, id)
+		if record == nil {
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		}
+		secret = Secret{Data: value, Meta: SecretMeta{Created: time.Now().UTC(), Version: len(record.Secrets)}}
+		record.Secrets = append(record.Secrets, secret)
+		return nil
+	})
+	if err != nil {
+		return Secret{}, err
+	}
+	return secret, nil
+}
+
+// UpdateIfVersion updates a secret only if its latest version is expectedVersion. The check and the write
+// happen under the same file lock.
+func (s *FileStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var secret Secret
+	err := s.update(ctx, func(contents *fileContents) error {
+		record := findFileRecord(contents, id)
+		if record == nil {
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		}
+		if actual := len(record.Secrets) - 1; actual != expectedVersion {
+			return &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: actual}
+		}
+		secret = Secret{Data: value, Meta: SecretMeta{Created: time.Now().UTC(), Version: len(record.Secrets)}}
+		record.Secrets = append(record.Secrets, secret)
+		return nil
+	})
+	if err != nil {
+		return Secret{}, err
+	}
+	return secret, nil
+}
+
+// List gets all secret identifiers within a namespace
+func (s *FileStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	ids, err := s.ListAll(ctx, env)
+	if err != nil {
+		return []SecretIdentifier{}, err
+	}
+	if service == "" {
+		return ids, nil
+	}
+	results := []SecretIdentifier{}
+	for _, id := range ids {
+		if id.Service == service {
+			results = append(results, id)
+		}
+	}
+	return results, nil
+}
+
+// ListAll gets all secret identifiers within an environment
+func (s *FileStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	if !env.IsValid() {
+		return []SecretIdentifier{}, fmt.Errorf("env %d is invalid", env)
+	}
+
+	results := []SecretIdentifier{}
+	err := s.view(ctx, func(contents *fileContents) error {
+		for _, record := range contents.Records {
+			recordEnv, err := ParseEnvironment(record.Environment)
+			if err != nil || recordEnv != env {
+				continue
+			}
+			results = append(results, SecretIdentifier{Environment: recordEnv, Service: record.Service, Key: record.Key})
+		}
+		return nil
+	})
+	if err != nil {
+		return []SecretIdentifier{}, err
+	}
+	sort.Sort(ByIDString(results))
+	return results, nil
+}
+
+// History gets all historical versions of a secret
+func (s *FileStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := id.Validate(); err != nil {
+		return []SecretMeta{}, err
+	}
+	results := []SecretMeta{}
+	err := s.view(ctx, func(contents *fileContents) error {
+		record := findFileRecord(contents, id)
+		if record == nil {
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		}
+		for _, secret := range record.Secrets {
+			results = append(results, secret.Meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return []SecretMeta{}, err
+	}
+	return results, nil
+}
+
+// Delete deletes all versions of a secret
+func (s *FileStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	return s.update(ctx, func(contents *fileContents) error {
+		for i := range contents.Records {
+			if fileRecordMatches(&contents.Records[i], id) {
+				contents.Records = append(contents.Records[:i], contents.Records[i+1:]...)
+				return nil
+			}
+		}
+		return &IdentifierNotFoundError{Identifier: id, Region: ""}
+	})
+}
+
+// findFileRecord returns the record for id, or nil if there is none
+func findFileRecord(contents *fileContents, id SecretIdentifier) *fileRecord {
+	for i := range contents.Records {
+		if fileRecordMatches(&contents.Records[i], id) {
+			return &contents.Records[i]
+		}
+	}
+	return nil
+}
+
+func fileRecordMatches(record *fileRecord, id SecretIdentifier) bool {
+	return record.Environment == id.EnvironmentString() && record.Service == id.Service && record.Key == id.Key
+}
+
+// view runs fn against the contents of the file while holding a shared lock
+func (s *FileStore) view(ctx context.Context, fn func(contents *fileContents) error) error {
+	unlock, err := s.lock(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, _, err := s.load()
+	if err != nil {
+		return err
+	}
+	return fn(contents)
+}
+
+// update runs fn against the contents of the file while holding an exclusive lock, and writes
+// the contents back if fn succeeds
+func (s *FileStore) update(ctx context.Context, fn func(contents *fileContents) error) error {
+	unlock, err := s.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, envelope, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := fn(contents); err != nil {
+		return err
+	}
+	return s.save(contents, envelope)
+}
+
+// lock acquires a lock on the sidecar lock file, waiting until it is available or ctx is done
+func (s *FileStore) lock(ctx context.Context, exclusive bool) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		locked, err := tryLockFile(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %s", s.path, err)
+		}
+		if locked {
+			break
+		}
+		if err := sleepContext(ctx, fileStoreLockRetry); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// load reads and decrypts the file. A missing file is treated as an empty store.
+// The returned envelope is nil if the file does not exist yet.
+func (s *FileStore) load() (*fileContents, *fileEnvelope, error) {
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &fileContents{}, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var envelope fileEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse file store %s: %s", s.path, err)
+	}
+	if envelope.FormatVersion != fileStoreFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported file store format version %d in %s", envelope.FormatVersion, s.path)
+	}
+	aead, err := s.cipher(&envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		// GCM authentication fails if the key is wrong, or if the file was tampered with
+		return nil, nil, &AuthenticationError{}
+	}
+
+	var contents fileContents
+	if err := json.Unmarshal(plaintext, &contents); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse decrypted file store %s: %s", s.path, err)
+	}
+	return &contents, &envelope, nil
+}
+
+// save encrypts and atomically replaces the file. The KDF parameters of previous, if any, are kept
+// so that a passphrase is not re-derived on every write.
+func (s *FileStore) save(contents *fileContents, previous *fileEnvelope) error {
+	envelope := &fileEnvelope{FormatVersion: fileStoreFormatVersion, KDF: "none"}
+	if s.passphrase != "" {
+		envelope.KDF = "pbkdf2-sha256"
+		if previous != nil && previous.KDF == envelope.KDF {
+			envelope.Iterations = previous.Iterations
+			envelope.Salt = previous.Salt
+		} else {
+			envelope.Iterations = fileStoreIterations
+			envelope.Salt = make([]byte, 16)
+			if _, err := rand.Read(envelope.Salt); err != nil {
+				return err
+			}
+		}
+	}
+	aead, err := s.cipher(envelope)
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+	envelope.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return err
+	}
+	envelope.Ciphertext = aead.Seal(nil, envelope.Nonce, plaintext, nil)
+
+	raw, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// cipher returns the AES-GCM cipher for the key described by envelope
+func (s *FileStore) cipher(envelope *fileEnvelope) (cipher.AEAD, error) {
+	key := s.key
+	if s.passphrase != "" {
+		if envelope.KDF != "pbkdf2-sha256" {
+			return nil, &AuthenticationError{}
+		}
+		var err error
+		if key, err = s.deriveKey(envelope.Salt, envelope.Iterations); err != nil {
+			return nil, err
+		}
+	} else if envelope.KDF != "none" {
+		return nil, &AuthenticationError{}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives the key for the passphrase and salt, caching the result
+func (s *FileStore) deriveKey(salt []byte, iterations int) ([]byte, error) {
+	s.derivedMu.Lock()
+	defer s.derivedMu.Unlock()
+	cacheKey := fmt.Sprintf("%d:%x", iterations, salt)
+	if key, ok := s.derivedKeys[cacheKey]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, s.passphrase, salt, iterations, fileStoreKeySize)
+	if err != nil {
+		return nil, err
+	}
+	s.derivedKeys[cacheKey] = key
+	return key, nil
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorePassphrase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "secrets")
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("secrets written by one store can be read by another with the same passphrase")
+	s1, err := NewFileStore(path, "correct horse")
+	assert.NoError(t, err)
+	assert.NoError(t, s1.Create(ctx, id, "bar"))
+	_, err = s1.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	s2, err := NewFileStore(path, "correct horse")
+	assert.NoError(t, err)
+	secret, err := s2.ReadVersion(ctx, id, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	secret, err = s2.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	assert.Equal(t, secret.Meta.Version, 1)
+
+	t.Log("the file does not contain the secret in plain text")
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), id.Key)
+
+	t.Log("a wrong passphrase fails to authenticate")
+	s3, err := NewFileStore(path, "battery staple")
+	assert.NoError(t, err)
+	_, err = s3.Read(ctx, id)
+	assert.Equal(t, err, &AuthenticationError{})
+	_, err = s3.Update(ctx, id, "qux")
+	assert.Equal(t, err, &AuthenticationError{})
+
+	t.Log("a key file cannot open a passphrase-encrypted store")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	assert.NoError(t, GenerateFileStoreKey(keyFile))
+	s4, err := NewFileStoreWithKeyFile(path, keyFile)
+	assert.NoError(t, err)
+	_, err = s4.Read(ctx, id)
+	assert.Equal(t, err, &AuthenticationError{})
+}
+
+func TestFileStoreConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets")
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, GenerateFileStoreKey(keyFile))
+	id := GetRandomTestSecretIdentifier()
+
+	// each writer opens the lock file separately, as separate processes would
+	writers := 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := NewFileStoreWithKeyFile(path, keyFile)
+			assert.NoError(t, err)
+			writerID := id
+			writerID.Key = fmt.Sprintf("%s%d", id.Key, i)
+			assert.NoError(t, s.Create(ctx, writerID, "bar"))
+		}(i)
+	}
+	wg.Wait()
+
+	t.Log("no writes were lost")
+	s, err := NewFileStoreWithKeyFile(path, keyFile)
+	assert.NoError(t, err)
+	ids, err := s.List(ctx, id.Environment, id.Service)
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids), writers)
+}
+
+func TestOpenFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	assert.NoError(t, GenerateFileStoreKey(keyFile))
+	id := GetRandomTestSecretIdentifier()
+
+	s, err := Open("file://" + filepath.Join(dir, "secrets") + "?key-file=" + keyFile)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("the passphrase can come from the environment")
+	t.Setenv("TEST_STEALTH_PASSPHRASE", "correct horse")
+	s, err = Open("file://" + filepath.Join(dir, "other") + "?passphrase-env=TEST_STEALTH_PASSPHRASE")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("errors without a key")
+	t.Setenv(FileStorePassphraseEnv, "")
+	_, err = Open("file://" + filepath.Join(dir, "other"))
+	assert.Error(t, err)
+}
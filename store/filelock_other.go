@@ -0,0 +1,18 @@
+//go:build !unix
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLockFile is not implemented on this platform, so FileStore refuses to run rather than risk corrupting the file
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	return false, errors.New("file locking is not supported on this platform")
+}
+
+// unlockFile releases a lock taken by tryLockFile
+func unlockFile(f *os.File) error {
+	return nil
+}
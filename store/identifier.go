@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// servicePattern is the charset allowed in services
+	servicePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+	// keyPattern allows keys nested under a service with slashes, e.g. db/password
+	keyPattern = regexp.MustCompile(`^[a-z0-9-]+(/[a-z0-9-]+)*$`)
+
+	// identifierEscaper escapes the dotted form's separator out of services and keys, so that it stays
+	// unambiguous even for identifiers that don't validate, e.g. ones listed from a backend
+	identifierEscaper = strings.NewReplacer("%", "%25", ".", "%2E")
+)
+
+// NewSecretIdentifier creates a SecretIdentifier, checking that it is valid
+func NewSecretIdentifier(env Environment, service, key string) (SecretIdentifier, error) {
+	id := SecretIdentifier{Environment: env, Service: service, Key: key}
+	if err := id.Validate(); err != nil {
+		return SecretIdentifier{}, err
+	}
+	return id, nil
+}
+
+// ParseSecretIdentifier parses and validates an identifier written in any of these forms:
+//
+//	development.oauth.db/password
+//	/development/oauth/db/password
+//	arn:aws:ssm:us-west-1:123456789012:parameter/development/oauth/db/password
+//
+// In the dotted form, '%' and '.' in the service and key are percent-escaped, as String() writes them.
+func ParseSecretIdentifier(s string) (SecretIdentifier, error) {
+	switch {
+	case strings.HasPrefix(s, "arn:"):
+		// arn:partition:service:region:account:resource
+		parts := strings.SplitN(s, ":", 6)
+		if len(parts) != 6 || parts[2] != "ssm" || !strings.HasPrefix(parts[5], "parameter/") {
+			return SecretIdentifier{}, &InvalidIdentifierError{Input: s, Reason: "not an SSM parameter ARN"}
+		}
+		return parseSecretIdentifierPath(s, strings.TrimPrefix(parts[5], "parameter"))
+	case strings.HasPrefix(s, "/"):
+		return parseSecretIdentifierPath(s, s)
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return SecretIdentifier{}, &InvalidIdentifierError{Input: s, Reason: "expected environment.service.key"}
+	}
+	env, err := ParseEnvironment(parts[0])
+	if err != nil {
+		return SecretIdentifier{}, &InvalidEnvironmentError{Identifier: s}
+	}
+	service, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return SecretIdentifier{}, &InvalidIdentifierError{Input: s, Reason: "bad escape in service"}
+	}
+	key, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return SecretIdentifier{}, &InvalidIdentifierError{Input: s, Reason: "bad escape in key"}
+	}
+	return NewSecretIdentifier(env, service, key)
+}
+
+// parseSecretIdentifierPath parses a path like /development/oauth/foo-bar, found in the input s
+func parseSecretIdentifierPath(s, path string) (SecretIdentifier, error) {
+	env, rest, ok := environmentFromPath(path)
+	if !ok {
+		return SecretIdentifier{}, &InvalidEnvironmentError{Identifier: s}
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 {
+		return SecretIdentifier{}, &InvalidIdentifierError{Input: s, Reason: "expected /environment/service/key"}
+	}
+	return NewSecretIdentifier(env, parts[0], parts[1])
+}
+
+// Validate checks that the identifier's environment is configured, and that its service and key
+// only use lowercase letters, digits and dashes. Keys may be nested with slashes, e.g. db/password.
+func (id SecretIdentifier) Validate() error {
+	if !id.Environment.IsValid() {
+		return &InvalidIdentifierError{Identifier: id, Reason: fmt.Sprintf("environment %d is not configured", id.Environment)}
+	}
+	if !servicePattern.MatchString(id.Service) {
+		return &InvalidIdentifierError{Identifier: id, Reason: "service must only use a-z, 0-9 and -"}
+	}
+	if !keyPattern.MatchString(id.Key) {
+		return &InvalidIdentifierError{Identifier: id, Reason: "key must be segments of a-z, 0-9 and -, separated by /"}
+	}
+	return nil
+}
+
+// escapeIdentifierPart escapes a service or key for the dotted form of an identifier
+func escapeIdentifierPart(s string) string {
+	return identifierEscaper.Replace(s)
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -14,7 +15,15 @@ type SecretMeta struct {
 	Created    time.Time `json:"created"`
 	Expiration time.Time `json:"expiration"`
 	Version    int       `json:"version"`
-	// TODO: Add other useful metadata?
+	// Labels are the labels attached to this version, e.g. stable. Stores that implement Labeler fill them
+	// in on History; not every store includes them when reading a secret.
+	Labels []string `json:"labels,omitempty"`
+	// Author is who wrote this version, e.g. the ARN of an IAM user or role
+	Author string `json:"author,omitempty"`
+	// Description is the description the secret had at this version
+	Description string `json:"description,omitempty"`
+	// Tier is the storage tier of this version, e.g. Standard or Advanced in Parameter Store
+	Tier string `json:"tier,omitempty"`
 }
 
 // Secret is the unit the secret store
@@ -25,30 +34,6 @@ type Secret struct {
 	Meta SecretMeta `json:"meta"`
 }
 
-// Environment is an Enum to access different Stealth stores
-type Environment int
-
-const (
-	// ProductionEnvironment is an index for prod
-	ProductionEnvironment Environment = iota
-	// DevelopmentEnvironment is an index for dev
-	DevelopmentEnvironment
-	// CITestEnvironment is an index for ci-test
-	CITestEnvironment
-)
-
-func (e Environment) String() string {
-	environments := [...]string{
-		"production",
-		"development",
-		"ci",
-	}
-	if e < ProductionEnvironment || e > CITestEnvironment {
-		return "unknown"
-	}
-	return environments[e]
-}
-
 // SecretIdentifier is a lookup key for a secret, including the production flag, the service name, and the specific key
 type SecretIdentifier struct {
 	Environment  Environment
@@ -57,57 +42,13 @@ type SecretIdentifier struct {
 
 // EnvironmentString returns the environment used for the secret identifier, as a string
 func (id SecretIdentifier) EnvironmentString() string {
-	if id.Environment == ProductionEnvironment {
-		return "production"
-	} else if id.Environment == DevelopmentEnvironment {
-		return "development"
-	} else if id.Environment == CITestEnvironment {
-		return "ci-test"
-	}
-	// Error
-	return ""
-}
-
-// isValidEnvironmentInt checks if an int is among our supported environments.
-// Our environments are represented as an enum
-func isValidEnvironmentInt(env Environment) bool {
-	for _, val := range []Environment{ProductionEnvironment, DevelopmentEnvironment, CITestEnvironment} {
-		if env == val {
-			return true
-		}
-	}
-	return false
-}
-
-// environmentStringToInt converts a string like "production" into the corresponding environment int.
-// Our environments are represented as an Enum.
-func environmentStringToInt(s string) (Environment, error) {
-	if s == "production" {
-		return ProductionEnvironment, nil
-	} else if s == "development" {
-		return DevelopmentEnvironment, nil
-	} else if s == "ci-test" {
-		return CITestEnvironment, nil
-	}
-	return -1, fmt.Errorf("invalid environment: %s", s)
+	return id.Environment.String()
 }
 
-// String() returns the key used for the secret identifier
+// String() returns the key used for the secret identifier, e.g. production.api.db/password.
+// '%' and '.' in the service and key are percent-escaped, so the form is unambiguous.
 func (id SecretIdentifier) String() string {
-	return fmt.Sprintf("%s.%s.%s", id.EnvironmentString(), id.Service, id.Key)
-}
-
-// stringToSecretIdentifier() returns the key used for the secret identifier
-func stringToSecretIdentifier(s string) (SecretIdentifier, error) {
-	parts := strings.SplitN(s, ".", 4)
-	if len(parts) != 3 {
-		return SecretIdentifier{}, fmt.Errorf("unable to create SecretIdentifier from string -- couldn't split: %s", s)
-	}
-	env, err := environmentStringToInt(parts[0])
-	if err != nil {
-		return SecretIdentifier{}, &InvalidEnvironmentError{Identifier: s}
-	}
-	return SecretIdentifier{env, parts[1], parts[2]}, nil
+	return fmt.Sprintf("%s.%s.%s", id.EnvironmentString(), escapeIdentifierPart(id.Service), escapeIdentifierPart(id.Key))
 }
 
 // SecretStore is the CRUD-like interface for Secrets
@@ -138,6 +79,167 @@ type SecretStore interface {
 	Delete(id SecretIdentifier) error
 }
 
+// ContextSecretStore is the context-aware variant of SecretStore. Every method takes a context.Context
+// which bounds all backend calls made on its behalf, so callers can cancel them or attach a deadline.
+type ContextSecretStore interface {
+	// Creates a Secret in the secret store. Version is guaranteed to be zero if no error is returned.
+	Create(ctx context.Context, id SecretIdentifier, value string) error
+
+	// Read a Secret from the store. Returns the latest version of the secret.
+	Read(ctx context.Context, id SecretIdentifier) (Secret, error)
+
+	// ReadVersion reads a specific version of a secret from the store.
+	// Version is 0-indexed
+	ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error)
+
+	// Updates a Secret from the store and increments version number.
+	Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error)
+
+	// List gets secrets within a namespace (env/service)>
+	List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error)
+
+	// ListAll gets all secrets within a environment (env)>
+	ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error)
+
+	// History gets history for a secret, returning all versions from the store.
+	History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error)
+
+	// Delete deletes all versions of a secret
+	Delete(ctx context.Context, id SecretIdentifier) error
+}
+
+// PrefixLister is implemented by stores that can list the secrets whose keys start with a prefix without
+// listing the whole namespace
+type PrefixLister interface {
+	// ListPrefix gets secrets within a namespace (env/service) whose keys start with prefix, e.g. db/
+	ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error)
+}
+
+// ListPrefix gets secrets within a namespace (env/service) whose keys start with prefix. It uses the store's
+// ListPrefix if it implements PrefixLister, and otherwise filters the store's List.
+func ListPrefix(ctx context.Context, s ContextSecretStore, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	if lister, ok := s.(PrefixLister); ok {
+		return lister.ListPrefix(ctx, env, service, prefix)
+	}
+	ids, err := s.List(ctx, env, service)
+	if err != nil {
+		return ids, err
+	}
+	return filterKeyPrefix(ids, prefix), nil
+}
+
+// filterKeyPrefix keeps the identifiers whose keys start with prefix
+func filterKeyPrefix(ids []SecretIdentifier, prefix string) []SecretIdentifier {
+	results := []SecretIdentifier{}
+	for _, id := range ids {
+		if strings.HasPrefix(id.Key, prefix) {
+			results = append(results, id)
+		}
+	}
+	return results
+}
+
+// BatchReader is implemented by stores that can read many secrets with fewer backend calls than one Read each
+type BatchReader interface {
+	// ReadMany reads the latest version of each secret. Secrets that don't exist are left out of the result.
+	ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error)
+}
+
+// ReadMany reads the latest version of each secret, leaving out secrets that don't exist. It uses the store's
+// ReadMany if it implements BatchReader, and otherwise reads the secrets one at a time.
+func ReadMany(ctx context.Context, s ContextSecretStore, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	if reader, ok := s.(BatchReader); ok {
+		return reader.ReadMany(ctx, ids)
+	}
+	results := map[SecretIdentifier]Secret{}
+	for _, id := range ids {
+		secret, err := s.Read(ctx, id)
+		if _, ok := err.(*IdentifierNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		results[id] = secret
+	}
+	return results, nil
+}
+
+// ServiceReader is implemented by stores that can read every secret of a service at once
+type ServiceReader interface {
+	// ReadService reads the latest version of every secret within a namespace (env/service)
+	ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error)
+}
+
+// ReadService reads the latest version of every secret within a namespace (env/service). It uses the store's
+// ReadService if it implements ServiceReader, and otherwise lists the service and reads what it finds.
+func ReadService(ctx context.Context, s ContextSecretStore, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	if reader, ok := s.(ServiceReader); ok {
+		return reader.ReadService(ctx, env, service)
+	}
+	ids, err := s.List(ctx, env, service)
+	if err != nil {
+		return nil, err
+	}
+	return ReadMany(ctx, s, ids)
+}
+
+// ConditionalUpdater is implemented by stores that can update a secret only if it is still at an expected version
+type ConditionalUpdater interface {
+	// UpdateIfVersion updates a secret like Update, but fails with a VersionConflictError if its latest
+	// version isn't expectedVersion. Version is 0-indexed
+	UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error)
+}
+
+// UpdateIfVersion updates a secret only if its latest version is expectedVersion, and otherwise fails with a
+// VersionConflictError. It uses the store's UpdateIfVersion if it implements ConditionalUpdater. Otherwise it
+// checks the version with Read before calling Update, which narrows the window for a conflicting write but
+// doesn't close it.
+func UpdateIfVersion(ctx context.Context, s ContextSecretStore, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if updater, ok := s.(ConditionalUpdater); ok {
+		return updater.UpdateIfVersion(ctx, id, expectedVersion, value)
+	}
+	current, err := s.Read(ctx, id)
+	if err != nil {
+		return Secret{}, err
+	}
+	if current.Meta.Version != expectedVersion {
+		return Secret{}, &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: current.Meta.Version}
+	}
+	return s.Update(ctx, id, value)
+}
+
+// Wrapper is implemented by stores that wrap another store, such as CachingStore
+type Wrapper interface {
+	// Unwrap returns the wrapped store
+	Unwrap() ContextSecretStore
+}
+
+// Implements says whether s implements the optional interface T, such as TrashStore. Wrappers such as
+// CachingStore implement optional interfaces by passing calls on to the store they wrap, so a wrapper only
+// implements T if the stores it wraps do too.
+func Implements[T any](s ContextSecretStore) bool {
+	for {
+		if _, ok := s.(T); !ok {
+			return false
+		}
+		wrapper, ok := s.(Wrapper)
+		if !ok {
+			return true
+		}
+		s = wrapper.Unwrap()
+	}
+}
+
+// optionalInterface gets the optional interface T, named name, of a store that a wrapper passes a call on to,
+// or an UnsupportedError if the store doesn't implement it
+func optionalInterface[T any](s ContextSecretStore, name string) (T, error) {
+	impl, ok := s.(T)
+	if !ok {
+		return impl, &UnsupportedError{Interface: name}
+	}
+	return impl, nil
+}
+
 // IdentifierNotFoundError occurs when a secret identifier cannot be found (during Read, History, Update)
 type IdentifierNotFoundError struct {
 	Identifier SecretIdentifier
@@ -151,13 +253,25 @@ func (e *IdentifierNotFoundError) Error() string {
 	return fmt.Sprintf("Identifier not found: %s", e.Identifier)
 }
 
-// InvalidIdentifierError occurs when a malformed identifier argument is given to a SecretStore method
+// InvalidIdentifierError occurs when a malformed identifier argument is given to a SecretStore method,
+// or a string can't be parsed as an identifier
 type InvalidIdentifierError struct {
 	Identifier SecretIdentifier
+	// Input is the string that failed to parse, if the identifier came from one
+	Input string
+	// Reason says what is wrong with the identifier
+	Reason string
 }
 
 func (e *InvalidIdentifierError) Error() string {
-	return fmt.Sprintf("The given identifier is invalid: %s", e.Identifier)
+	identifier := e.Identifier.String()
+	if e.Input != "" {
+		identifier = e.Input
+	}
+	if e.Reason == "" {
+		return fmt.Sprintf("The given identifier is invalid: %s", identifier)
+	}
+	return fmt.Sprintf("The given identifier is invalid: %s: %s", identifier, e.Reason)
 }
 
 // InvalidEnvironmentError occurs when a parameter name is using non-compatible environment name
@@ -166,7 +280,23 @@ type InvalidEnvironmentError struct {
 }
 
 func (e *InvalidEnvironmentError) Error() string {
-	return fmt.Sprintf("environment is not compatible. supplied %s, expects `production`, `development`, or `ci-test`.", e.Identifier)
+	names := []string{}
+	for _, env := range Environments() {
+		names = append(names, "`"+env.String()+"`")
+	}
+	return fmt.Sprintf("environment is not compatible. supplied %s, expects one of %s.", e.Identifier, strings.Join(names, ", "))
+}
+
+// VersionConflictError occurs when UpdateIfVersion finds a secret at a different version than expected,
+// usually because someone else updated it first
+type VersionConflictError struct {
+	Identifier SecretIdentifier
+	Expected   int
+	Actual     int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("Version conflict for %s: expected version %d, but it is at version %d", e.Identifier, e.Expected, e.Actual)
 }
 
 // IdentifierAlreadyExistsError occurs when Create is called and an identifier already exists
@@ -198,12 +328,44 @@ func (e *AuthenticationError) Error() string {
 // AuthorizationError occurs when a user lacks sufficient access to interact with a Secret (read-only? read/write?)
 type AuthorizationError struct {
 	Identifier SecretIdentifier
+	// Reason explains why access was denied, if known, e.g. the reason of the policy rule that denied it
+	Reason string
 }
 
 func (e *AuthorizationError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("Unauthorized to access secret with identifier: %s: %s", e.Identifier, e.Reason)
+	}
 	return fmt.Sprintf("Unauthorized to access secret with identifier: %s", e.Identifier)
 }
 
+// ThrottlingError occurs when a store rejects a request because it is receiving too many, e.g. Vault's 429
+type ThrottlingError struct {
+	Identifier SecretIdentifier
+	// Err is the store's error
+	Err error
+}
+
+func (e *ThrottlingError) Error() string {
+	return fmt.Sprintf("Throttled accessing secret with identifier: %s: %s", e.Identifier, e.Err)
+}
+
+// Unwrap returns the store's error
+func (e *ThrottlingError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedError occurs when a wrapper such as CachingStore is called through an optional interface, such as
+// TrashStore, that the store it wraps doesn't implement
+type UnsupportedError struct {
+	// Interface is the optional interface, e.g. TrashStore
+	Interface string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("The secret store doesn't support %s", e.Interface)
+}
+
 // ByIDString allows sorting SecretIdentifiers by Key
 type ByIDString []SecretIdentifier
 
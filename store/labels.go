@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// labelPattern is the charset allowed in labels. It follows Parameter Store's rules, so that a label that
+// works in one store works in all of them.
+var labelPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,99}$`)
+
+// Labeler is implemented by stores that can attach labels, such as stable or canary, to versions of a secret,
+// so that consumers can be pinned to a named version instead of always taking the latest
+type Labeler interface {
+	// Label attaches label to a version of a secret, moving it from whichever version had it before.
+	// Version is 0-indexed
+	Label(ctx context.Context, id SecretIdentifier, version int, label string) error
+
+	// ReadLabel reads the version of a secret that label is attached to
+	ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error)
+}
+
+// ValidateLabel checks that a label starts with a letter, only uses letters, digits, '.', '-' and '_',
+// is at most 100 characters long, and doesn't start with the reserved prefixes aws or ssm
+func ValidateLabel(label string) error {
+	if !labelPattern.MatchString(label) {
+		return &InvalidLabelError{Label: label, Reason: "must start with a letter and only use a-z, A-Z, 0-9, '.', '-' and '_', up to 100 characters"}
+	}
+	if lower := strings.ToLower(label); strings.HasPrefix(lower, "aws") || strings.HasPrefix(lower, "ssm") {
+		return &InvalidLabelError{Label: label, Reason: "must not start with aws or ssm"}
+	}
+	return nil
+}
+
+// InvalidLabelError occurs when a malformed label is given to Label or ReadLabel
+type InvalidLabelError struct {
+	Label string
+	// Reason says what is wrong with the label
+	Reason string
+}
+
+func (e *InvalidLabelError) Error() string {
+	return fmt.Sprintf("The given label is invalid: %s: %s", e.Label, e.Reason)
+}
+
+// LabelNotFoundError occurs when no version of a secret has a label (during ReadLabel)
+type LabelNotFoundError struct {
+	Identifier SecretIdentifier
+	Label      string
+}
+
+func (e *LabelNotFoundError) Error() string {
+	return fmt.Sprintf("Label %s not found for identifier: %s", e.Label, e.Identifier)
+}
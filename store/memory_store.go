@@ -1,92 +1,357 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"sort"
+	"sync"
+	"time"
 )
 
+func init() {
+	Register("memory", openMemoryStore)
+}
+
+var (
+	namedMemoryStoresMu sync.Mutex
+	namedMemoryStores   = map[string]ContextSecretStore{}
+)
+
+// openMemoryStore creates a MemoryStore from a URL. memory:// returns a new, empty store, while
+// memory://name returns the same store for every Open of that name within the process.
+func openMemoryStore(u *url.URL) (ContextSecretStore, error) {
+	if u.Host == "" {
+		return NewMemoryStore(), nil
+	}
+	namedMemoryStoresMu.Lock()
+	defer namedMemoryStoresMu.Unlock()
+	s, ok := namedMemoryStores[u.Host]
+	if !ok {
+		s = NewMemoryStore()
+		namedMemoryStores[u.Host] = s
+	}
+	return s, nil
+}
+
 // mHistory has all versions of a secret, and its revocation status
 type mHistory struct {
 	// Secrets contains all versions of a secret
 	Secrets []Secret
 }
 
-// MemoryStore is an in-memory secret store, for testing
+// latest is the latest version of the secret
+func (h mHistory) latest() Secret {
+	return h.Secrets[len(h.Secrets)-1]
+}
+
+// expiration is when the secret expires, set by its latest version, or the zero time if it doesn't
+func (h mHistory) expiration() time.Time {
+	return h.latest().Meta.Expiration
+}
+
+// expired is whether the secret has expired
+func (h mHistory) expired() bool {
+	expiration := h.expiration()
+	return !expiration.IsZero() && !time.Now().Before(expiration)
+}
+
+// clone copies the history, so that later writes to either copy don't show up in the other
+func (h mHistory) clone() mHistory {
+	return mHistory{Secrets: slices.Clone(h.Secrets)}
+}
+
+// MemoryStore is an in-memory secret store, for testing. It is safe for concurrent use, and behaves like
+// ParameterStore in a single region: versions are 0-indexed, every version records when it was created,
+// and an expiration carries over to later versions until it is replaced.
 type MemoryStore struct {
+	mu      sync.RWMutex
 	history map[SecretIdentifier]mHistory
+	trash   map[TrashedSecret]mHistory
 }
 
-// Create creates a secret in the store
-func (s *MemoryStore) Create(id SecretIdentifier, value string) error {
-	var (
-		history mHistory
-		ok      bool
-	)
-
-	// Initialize secret if does not exist
-	if history, ok = s.history[id]; ok {
-		return &IdentifierAlreadyExistsError{Identifier: id}
+// MemorySnapshot is a copy of the contents of a MemoryStore, including its trash
+type MemorySnapshot struct {
+	history map[SecretIdentifier]mHistory
+	trash   map[TrashedSecret]mHistory
+}
+
+// Snapshot copies the contents of the store, so that they can be put back with RestoreSnapshot
+func (s *MemoryStore) Snapshot() MemorySnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return MemorySnapshot{history: cloneHistories(s.history), trash: cloneHistories(s.trash)}
+}
+
+// RestoreSnapshot replaces the contents of the store with a snapshot. A snapshot can be restored any number of times.
+func (s *MemoryStore) RestoreSnapshot(snapshot MemorySnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = cloneHistories(snapshot.history)
+	s.trash = cloneHistories(snapshot.trash)
+}
+
+// cloneHistories deep copies a map of histories
+func cloneHistories[K comparable](histories map[K]mHistory) map[K]mHistory {
+	results := make(map[K]mHistory, len(histories))
+	for key, history := range histories {
+		results[key] = history.clone()
 	}
+	return results
+}
 
-	// Append newest version
-	history.Secrets = []Secret{Secret{Data: value}}
+// Create creates a secret in the store
+func (s *MemoryStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	return s.create(ctx, id, value, time.Time{})
+}
 
-	// Save
-	s.history[id] = history
+// CreateWithExpiration creates a secret in the store which expires at expiration
+func (s *MemoryStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	return s.create(ctx, id, value, expiration)
+}
 
+// create creates a secret in the store, which expires at expiration unless it is zero
+func (s *MemoryStore) create(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Initialize secret if does not exist. Like Parameter Store, which deletes expired secrets, an expired
+	// secret is replaced.
+	if history, ok := s.history[id]; ok && !history.expired() {
+		return &IdentifierAlreadyExistsError{Identifier: id}
+	}
+	s.history[id] = mHistory{Secrets: []Secret{{
+		Data: value,
+		Meta: SecretMeta{Created: time.Now().UTC(), Version: 0, Expiration: expiration},
+	}}}
 	return nil
 }
 
 // Read a secret from the store
-func (s *MemoryStore) Read(id SecretIdentifier) (Secret, error) {
-	if history, ok := s.history[id]; ok {
-		return history.Secrets[len(history.Secrets)-1], nil
+func (s *MemoryStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, err := s.readableHistory(id)
+	if err != nil {
+		return Secret{}, err
 	}
-	return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+	return history.latest(), nil
 }
 
-// ReadVersion reads a version of a secret
-func (s *MemoryStore) ReadVersion(id SecretIdentifier, version int) (Secret, error) {
-	if history, ok := s.history[id]; ok {
-		if len(history.Secrets) > version && version >= 0 {
-			return history.Secrets[version], nil
+// readableHistory gets the history of a secret that exists and hasn't expired. The caller must hold s.mu.
+func (s *MemoryStore) readableHistory(id SecretIdentifier) (mHistory, error) {
+	history, ok := s.history[id]
+	if !ok {
+		return mHistory{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+	}
+	if history.expired() {
+		return mHistory{}, &SecretExpiredError{Identifier: id, Expiration: history.expiration()}
+	}
+	return history, nil
+}
+
+// writableHistory gets the history of a secret that exists and hasn't expired, treating an expired secret as
+// missing, since Parameter Store deletes secrets once they expire. The caller must hold s.mu.
+func (s *MemoryStore) writableHistory(id SecretIdentifier) (mHistory, error) {
+	history, err := s.readableHistory(id)
+	var expired *SecretExpiredError
+	if errors.As(err, &expired) {
+		return mHistory{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+	}
+	return history, err
+}
+
+// ReadMany reads the latest version of each secret, leaving out secrets that don't exist or have expired
+func (s *MemoryStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	for _, id := range ids {
+		if err := id.Validate(); err != nil {
+			return nil, err
 		}
-		return Secret{}, &VersionNotFoundError{Version: version, Identifier: id}
 	}
-	return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := map[SecretIdentifier]Secret{}
+	for _, id := range ids {
+		if history, err := s.readableHistory(id); err == nil {
+			results[id] = history.latest()
+		}
+	}
+	return results, nil
+}
+
+// ReadVersion reads a version of a secret
+func (s *MemoryStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, err := s.readableHistory(id)
+	if err != nil {
+		return Secret{}, err
+	}
+	if len(history.Secrets) > version && version >= 0 {
+		return history.Secrets[version], nil
+	}
+	return Secret{}, &VersionNotFoundError{Version: version, Identifier: id}
 }
 
 // Update updates a secret in the secret store
-func (s *MemoryStore) Update(id SecretIdentifier, value string) (Secret, error) {
-	var (
-		history mHistory
-		ok      bool
-	)
+func (s *MemoryStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	return s.UpdateWithExpiration(ctx, id, value, time.Time{})
+}
 
-	// Return error if secret does not exist
-	if history, ok = s.history[id]; !ok {
-		return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+// UpdateWithExpiration updates a secret in the secret store, and makes it expire at expiration. A zero
+// expiration keeps the secret's current expiration.
+func (s *MemoryStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(id, value, expiration)
+}
 
-	// Append newest version
-	version := len(history.Secrets)
-	history.Secrets = append(s.history[id].Secrets, Secret{Data: value, Meta: SecretMeta{Version: version}})
+// update appends a version to a secret, which expires at expiration, or when the secret already did if
+// expiration is zero. The caller must hold s.mu.
+func (s *MemoryStore) update(id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	// Return error if secret does not exist
+	history, err := s.writableHistory(id)
+	if err != nil {
+		return Secret{}, err
+	}
+	if expiration.IsZero() {
+		expiration = history.expiration()
+	}
 
-	// Save
+	// Append newest version, to a copy so that snapshots and readers of the old history aren't affected
+	secret := Secret{
+		Data: value,
+		Meta: SecretMeta{Created: time.Now().UTC(), Version: len(history.Secrets), Expiration: expiration},
+	}
+	history = history.clone()
+	history.Secrets = append(history.Secrets, secret)
 	s.history[id] = history
+	return secret, nil
+}
 
-	return Secret{Data: value}, nil
+// UpdateIfVersion updates a secret only if its latest version is expectedVersion
+func (s *MemoryStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.writableHistory(id)
+	if err != nil {
+		return Secret{}, err
+	}
+	if actual := len(history.Secrets) - 1; actual != expectedVersion {
+		return Secret{}, &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: actual}
+	}
+	return s.update(id, value, time.Time{})
 }
 
-// List gets all secret identifiers within a namespace
-func (s *MemoryStore) List(env Environment, service string) ([]SecretIdentifier, error) {
-	ids, err := s.ListAll(env)
+// Label attaches label to a version of a secret, moving it from whichever version had it before
+func (s *MemoryStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateLabel(label); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.writableHistory(id)
 	if err != nil {
-		return []SecretIdentifier{}, err
+		return err
+	}
+	if version < 0 || version >= len(history.Secrets) {
+		return &VersionNotFoundError{Version: version, Identifier: id}
+	}
+	// copy the versions rather than editing them in place, since earlier reads share their labels
+	secrets := make([]Secret, len(history.Secrets))
+	for i, secret := range history.Secrets {
+		var labels []string
+		for _, l := range secret.Meta.Labels {
+			if l != label {
+				labels = append(labels, l)
+			}
+		}
+		if i == version {
+			labels = append(labels, label)
+		}
+		secret.Meta.Labels = labels
+		secrets[i] = secret
+	}
+	s.history[id] = mHistory{Secrets: secrets}
+	return nil
+}
+
+// ReadLabel reads the version of a secret that label is attached to
+func (s *MemoryStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ValidateLabel(label); err != nil {
+		return Secret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history, err := s.readableHistory(id)
+	if err != nil {
+		return Secret{}, err
+	}
+	for _, secret := range history.Secrets {
+		if slices.Contains(secret.Meta.Labels, label) {
+			return secret, nil
+		}
+	}
+	return Secret{}, &LabelNotFoundError{Identifier: id, Label: label}
+}
+
+// List gets all secret identifiers within a namespace. Like ParameterStore, an empty service lists the
+// whole environment.
+func (s *MemoryStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	ids, err := s.ListAll(ctx, env)
+	if err != nil || service == "" {
+		return ids, err
 	}
 	results := []SecretIdentifier{}
 	for _, id := range ids {
-		if id.Environment == env && id.Service == service {
+		if id.Service == service {
 			results = append(results, id)
 		}
 	}
@@ -94,22 +359,37 @@ func (s *MemoryStore) List(env Environment, service string) ([]SecretIdentifier,
 }
 
 // ListAll gets all secret identifiers within an environment
-func (s *MemoryStore) ListAll(env Environment) ([]SecretIdentifier, error) {
+func (s *MemoryStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	if err := ctx.Err(); err != nil {
+		return []SecretIdentifier{}, err
+	}
 	// validate environment; avoids a panic looking up secrets path below
-	if !isValidEnvironmentInt(env) {
+	if !env.IsValid() {
 		return []SecretIdentifier{}, fmt.Errorf("env %d is invalid", env)
 	}
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	results := []SecretIdentifier{}
 	for id := range s.history {
-		results = append(results, id)
+		if id.Environment == env {
+			results = append(results, id)
+		}
 	}
 	sort.Sort(ByIDString(results))
 	return results, nil
 }
 
 // History gets all historical versions of a secret
-func (s *MemoryStore) History(id SecretIdentifier) ([]SecretMeta, error) {
+func (s *MemoryStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := id.Validate(); err != nil {
+		return []SecretMeta{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return []SecretMeta{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if history, ok := s.history[id]; ok {
 		secrets := make([]SecretMeta, len(history.Secrets))
 		for index, secret := range history.Secrets {
@@ -120,8 +400,33 @@ func (s *MemoryStore) History(id SecretIdentifier) ([]SecretMeta, error) {
 	return []SecretMeta{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
 }
 
+// ListExpiring gets the secrets within an environment that expire before cutoff, soonest first
+func (s *MemoryStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := []ExpiringSecret{}
+	for id, history := range s.history {
+		if expiration := history.expiration(); id.Environment == env && !expiration.IsZero() && expiration.Before(cutoff) {
+			results = append(results, ExpiringSecret{Identifier: id, Expiration: expiration})
+		}
+	}
+	sortExpiring(results)
+	return results, nil
+}
+
 // Delete deletes all versions of a secret
-func (s *MemoryStore) Delete(id SecretIdentifier) error {
+func (s *MemoryStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if _, ok := s.history[id]; ok {
 		delete(s.history, id)
 		return nil
@@ -129,9 +434,80 @@ func (s *MemoryStore) Delete(id SecretIdentifier) error {
 	return &IdentifierNotFoundError{Identifier: id, Region: ""}
 }
 
+// Trash moves a secret and its history into the trash
+func (s *MemoryStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	if err := id.Validate(); err != nil {
+		return TrashedSecret{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return TrashedSecret{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.history[id]
+	if !ok {
+		return TrashedSecret{}, &IdentifierNotFoundError{Identifier: id, Region: ""}
+	}
+	trashed := TrashedSecret{Identifier: id, DeletedAt: time.Now().UTC()}
+	s.trash[trashed] = history
+	delete(s.history, id)
+	return trashed, nil
+}
+
+// ListTrash gets the trashed secrets within an environment, oldest first
+func (s *MemoryStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := []TrashedSecret{}
+	for trashed := range s.trash {
+		if trashed.Identifier.Environment == env {
+			results = append(results, trashed)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].DeletedAt.Before(results[j].DeletedAt) })
+	return results, nil
+}
+
+// Restore moves a trashed secret and its history back out of the trash
+func (s *MemoryStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.trash[trashed]
+	if !ok {
+		return &TrashNotFoundError{Trashed: trashed}
+	}
+	if _, ok := s.history[trashed.Identifier]; ok {
+		return &IdentifierAlreadyExistsError{Identifier: trashed.Identifier}
+	}
+	s.history[trashed.Identifier] = history
+	delete(s.trash, trashed)
+	return nil
+}
+
+// Purge permanently deletes a trashed secret
+func (s *MemoryStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.trash[trashed]; !ok {
+		return &TrashNotFoundError{Trashed: trashed}
+	}
+	delete(s.trash, trashed)
+	return nil
+}
+
 // NewMemoryStore creates an in-memory secret store
-func NewMemoryStore() SecretStore {
+func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		history: map[SecretIdentifier]mHistory{},
+		trash:   map[TrashedSecret]mHistory{},
 	}
 }
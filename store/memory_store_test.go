@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreMetadata(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	id := GetRandomTestSecretIdentifier()
+	before := time.Now().UTC()
+
+	t.Log("versions record when they were created, and Update returns the new version's metadata")
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.False(t, secret.Meta.Created.Before(before))
+	updated, err := s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, updated.Data, "baz")
+	assert.Equal(t, updated.Meta.Version, 1)
+	assert.False(t, updated.Meta.Created.Before(secret.Meta.Created))
+
+	t.Log("an expiration carries over to later versions until it is replaced")
+	expiration := time.Now().Add(time.Hour)
+	_, err = s.UpdateWithExpiration(ctx, id, "qux", expiration)
+	assert.NoError(t, err)
+	updated, err = s.Update(ctx, id, "quux")
+	assert.NoError(t, err)
+	assert.Equal(t, updated.Meta.Expiration, expiration)
+
+	t.Log("listing only includes the requested environment")
+	other := SecretIdentifier{Environment: DevelopmentEnvironment, Service: id.Service, Key: id.Key}
+	assert.NoError(t, s.Create(ctx, other, "bar"))
+	ids, err := s.ListAll(ctx, CITestEnvironment)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{id})
+	ids, err = s.List(ctx, DevelopmentEnvironment, id.Service)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{other})
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	snapshot := s.Snapshot()
+
+	t.Log("writes after a snapshot are undone by restoring it, as many times as needed")
+	for i := 0; i < 2; i++ {
+		_, err := s.Update(ctx, id, "baz")
+		assert.NoError(t, err)
+		assert.NoError(t, s.Create(ctx, GetRandomTestSecretIdentifier(), "qux"))
+		s.RestoreSnapshot(snapshot)
+
+		secret, err := s.Read(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "bar")
+		assert.Equal(t, secret.Meta.Version, 0)
+		ids, err := s.ListAll(ctx, id.Environment)
+		assert.NoError(t, err)
+		assert.Equal(t, ids, []SecretIdentifier{id})
+	}
+}
+
+func TestMemoryStoreConcurrency(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, id, "0"))
+
+	t.Log("concurrent writes each add exactly one version")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Update(ctx, id, "bar")
+			assert.NoError(t, err)
+			_, err = s.Read(ctx, id)
+			assert.NoError(t, err)
+			_, err = s.ListAll(ctx, id.Environment)
+			assert.NoError(t, err)
+			s.Snapshot()
+		}()
+	}
+	wg.Wait()
+	history, err := s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Len(t, history, 21)
+}
@@ -0,0 +1,310 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// LatencyBuckets are the upper bounds of the latency histograms Metrics keeps
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// The error types Metrics counts errors by
+const (
+	ErrorTypeNotFound      = "not_found"
+	ErrorTypeAuthorization = "authorization"
+	ErrorTypeThrottling    = "throttling"
+	ErrorTypeCanceled      = "canceled"
+	ErrorTypeOther         = "other"
+)
+
+// ErrorType classifies an error for metrics: IdentifierNotFoundError and Parameter Store's ParameterNotFound are
+// ErrorTypeNotFound, AuthorizationError, AuthenticationError and AWS access denied errors are
+// ErrorTypeAuthorization, and ThrottlingError and AWS throttling errors are ErrorTypeThrottling. It returns "" for
+// a nil error.
+func ErrorType(err error) string {
+	if err == nil {
+		return ""
+	}
+	var notFound *IdentifierNotFoundError
+	var authorization *AuthorizationError
+	var authentication *AuthenticationError
+	var throttling *ThrottlingError
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeCanceled
+	case errors.As(err, &notFound):
+		return ErrorTypeNotFound
+	case errors.As(err, &authorization) || errors.As(err, &authentication):
+		return ErrorTypeAuthorization
+	case errors.As(err, &throttling):
+		return ErrorTypeThrottling
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		if _, ok := retry.DefaultThrottleErrorCodes[code]; ok || code == "TooManyUpdates" {
+			return ErrorTypeThrottling
+		}
+		switch code {
+		case "ParameterNotFound", "ResourceNotFoundException":
+			return ErrorTypeNotFound
+		case "AccessDeniedException", "UnrecognizedClientException", "ExpiredTokenException":
+			return ErrorTypeAuthorization
+		}
+	}
+	return ErrorTypeOther
+}
+
+// OperationMetrics are the metrics of one operation: a store method, or an API call to one region
+type OperationMetrics struct {
+	// Operation is the store method, e.g. Read, or the API call, e.g. GetParameter
+	Operation string
+	// Region is the region of an API call, or "" for a store method
+	Region string
+	// Calls counts the calls, including failed ones. For API calls, each retry counts as a call.
+	Calls uint64
+	// Errors counts the failed calls by ErrorType
+	Errors map[string]uint64
+	// Retries counts the API calls that were retries
+	Retries uint64
+	// Latency is the total time spent in the calls
+	Latency time.Duration
+	// LatencyBuckets counts the calls that took at most each of the package's LatencyBuckets
+	LatencyBuckets []uint64
+}
+
+// MeanLatency is the average time a call took
+func (m OperationMetrics) MeanLatency() time.Duration {
+	if m.Calls == 0 {
+		return 0
+	}
+	return m.Latency / time.Duration(m.Calls)
+}
+
+// metricsKey identifies an operation's metrics
+type metricsKey struct {
+	operation, region string
+}
+
+// Metrics collects the latency, errors and retries of store methods and of the API calls they make to each
+// region. It is safe for concurrent use. Read it in process with Snapshot, or in the Prometheus text format
+// with WritePrometheus or as an http.Handler.
+type Metrics struct {
+	mu         sync.Mutex
+	operations map[metricsKey]*OperationMetrics
+}
+
+// NewMetrics creates an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{operations: map[metricsKey]*OperationMetrics{}}
+}
+
+// observe records a call to an operation
+func (m *Metrics) observe(operation, region string, latency time.Duration, err error, retry bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricsKey{operation: operation, region: region}
+	metrics, ok := m.operations[key]
+	if !ok {
+		metrics = &OperationMetrics{
+			Operation:      operation,
+			Region:         region,
+			Errors:         map[string]uint64{},
+			LatencyBuckets: make([]uint64, len(LatencyBuckets)),
+		}
+		m.operations[key] = metrics
+	}
+	metrics.Calls++
+	metrics.Latency += latency
+	for i, bucket := range LatencyBuckets {
+		if latency <= bucket {
+			metrics.LatencyBuckets[i]++
+		}
+	}
+	if err != nil {
+		metrics.Errors[ErrorType(err)]++
+	}
+	if retry {
+		metrics.Retries++
+	}
+}
+
+// Snapshot copies the metrics collected so far, sorted by operation then region
+func (m *Metrics) Snapshot() []OperationMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	results := make([]OperationMetrics, 0, len(m.operations))
+	for _, metrics := range m.operations {
+		snapshot := *metrics
+		snapshot.Errors = make(map[string]uint64, len(metrics.Errors))
+		for errorType, count := range metrics.Errors {
+			snapshot.Errors[errorType] = count
+		}
+		snapshot.LatencyBuckets = append([]uint64{}, metrics.LatencyBuckets...)
+		results = append(results, snapshot)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Operation != results[j].Operation {
+			return results[i].Operation < results[j].Operation
+		}
+		return results[i].Region < results[j].Region
+	})
+	return results
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format. Store methods are
+// stealth_store_* metrics, and API calls to each region are stealth_region_* metrics.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	var store, region []OperationMetrics
+	for _, metrics := range m.Snapshot() {
+		if metrics.Region == "" {
+			store = append(store, metrics)
+		} else {
+			region = append(region, metrics)
+		}
+	}
+	var b strings.Builder
+	writePrometheusHistogram(&b, "stealth_store_operation_duration_seconds", "Latency of secret store operations.", store)
+	writePrometheusErrors(&b, "stealth_store_operation_errors_total", "Failed secret store operations, by error type.", store)
+	writePrometheusHistogram(&b, "stealth_region_request_duration_seconds", "Latency of requests to each region, including retries.", region)
+	writePrometheusErrors(&b, "stealth_region_request_errors_total", "Failed requests to each region, by error type.", region)
+	fmt.Fprintf(&b, "# HELP stealth_region_request_retries_total Requests to each region that were retries.\n")
+	fmt.Fprintf(&b, "# TYPE stealth_region_request_retries_total counter\n")
+	for _, metrics := range region {
+		fmt.Fprintf(&b, "stealth_region_request_retries_total{%s} %d\n", prometheusLabels(metrics), metrics.Retries)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+// writePrometheusHistogram writes the latency histograms of operations
+func writePrometheusHistogram(b *strings.Builder, name, help string, operations []OperationMetrics) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, metrics := range operations {
+		labels := prometheusLabels(metrics)
+		for i, bucket := range LatencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bucket.Seconds(), metrics.LatencyBuckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, metrics.Calls)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, metrics.Latency.Seconds())
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, metrics.Calls)
+	}
+}
+
+// writePrometheusErrors writes the error counts of operations
+func writePrometheusErrors(b *strings.Builder, name, help string, operations []OperationMetrics) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, metrics := range operations {
+		errorTypes := make([]string, 0, len(metrics.Errors))
+		for errorType := range metrics.Errors {
+			errorTypes = append(errorTypes, errorType)
+		}
+		sort.Strings(errorTypes)
+		for _, errorType := range errorTypes {
+			fmt.Fprintf(b, "%s{%s,error_type=%q} %d\n", name, prometheusLabels(metrics), errorType, metrics.Errors[errorType])
+		}
+	}
+}
+
+// prometheusLabels formats the labels identifying an operation
+func prometheusLabels(metrics OperationMetrics) string {
+	if metrics.Region == "" {
+		return fmt.Sprintf("operation=%q", metrics.Operation)
+	}
+	return fmt.Sprintf("region=%q,operation=%q", metrics.Region, metrics.Operation)
+}
+
+// metricsContextKey is the context key of the Metrics that API calls are recorded in
+type metricsContextKey struct{}
+
+// withMetrics makes the API calls made with ctx record their metrics in m
+func withMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey{}, m)
+}
+
+// metricsFrom gets the Metrics that API calls made with ctx record their metrics in, if any
+func metricsFrom(ctx context.Context) *Metrics {
+	m, _ := ctx.Value(metricsContextKey{}).(*Metrics)
+	return m
+}
+
+// ssmMetricsOptions makes an SSM client in region record every attempt of a request in the Metrics of the
+// request's context. The attempts are timed right after the Retry middleware, so options that insert their own
+// middleware there afterwards, like a RateLimiter's, run first and their waits aren't counted as latency.
+func ssmMetricsOptions(region string) func(*ssm.Options) {
+	return func(o *ssm.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			if err := stack.Finalize.Insert(attemptCounterMiddleware{}, "Retry", middleware.Before); err != nil {
+				return err
+			}
+			return stack.Finalize.Insert(attemptMetricsMiddleware{region: region}, "Retry", middleware.After)
+		})
+	}
+}
+
+// attemptCounterKey is the context key of the number of attempts made of a request so far
+type attemptCounterKey struct{}
+
+// attemptCounterMiddleware starts counting the attempts of a request, so attemptMetricsMiddleware can tell retries apart
+type attemptCounterMiddleware struct{}
+
+// ID identifies the middleware in the SDK's middleware stack
+func (attemptCounterMiddleware) ID() string {
+	return "StealthAttemptCounter"
+}
+
+// HandleFinalize adds an attempt counter to the request's context
+func (attemptCounterMiddleware) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	return next.HandleFinalize(context.WithValue(ctx, attemptCounterKey{}, new(int)), in)
+}
+
+// attemptMetricsMiddleware records each attempt of a request, and whether it was a retry
+type attemptMetricsMiddleware struct {
+	region string
+}
+
+// ID identifies the middleware in the SDK's middleware stack
+func (attemptMetricsMiddleware) ID() string {
+	return "StealthAttemptMetrics"
+}
+
+// HandleFinalize times an attempt of a request
+func (m attemptMetricsMiddleware) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	metrics := metricsFrom(ctx)
+	if metrics == nil {
+		return next.HandleFinalize(ctx, in)
+	}
+	retried := false
+	// attempts are made one after another, so the counter needs no lock
+	if attempts, ok := ctx.Value(attemptCounterKey{}).(*int); ok {
+		*attempts++
+		retried = *attempts > 1
+	}
+	start := time.Now()
+	out, metadata, err := next.HandleFinalize(ctx, in)
+	metrics.observe(awsmiddleware.GetOperationName(ctx), m.region, time.Since(start), err, retried)
+	return out, metadata, err
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsStore wraps a store to record the latency and errors of its operations in a Metrics. Parameter Store
+// also records each request it makes to a region, including retries, in the same Metrics.
+//
+// MetricsStore implements BatchReader, PrefixLister, ServiceReader, ConditionalUpdater and ExpirationLister, falling
+// back like the package's helpers when the wrapped store doesn't. It also implements TrashStore, Labeler and
+// ExpiringWriter, returning an UnsupportedError when the wrapped store doesn't.
+type MetricsStore struct {
+	store   ContextSecretStore
+	metrics *Metrics
+}
+
+// NewMetricsStore wraps a store to record metrics in m. If m is nil, the store records them in a new Metrics.
+// A Metrics can be shared by several stores.
+func NewMetricsStore(s ContextSecretStore, m *Metrics) *MetricsStore {
+	if m == nil {
+		m = NewMetrics()
+	}
+	return &MetricsStore{store: s, metrics: m}
+}
+
+// Unwrap returns the wrapped store
+func (s *MetricsStore) Unwrap() ContextSecretStore {
+	return s.store
+}
+
+// Metrics returns the Metrics the store records in
+func (s *MetricsStore) Metrics() *Metrics {
+	return s.metrics
+}
+
+// observe runs an operation with a context that records its API calls, and records its latency and error
+func (s *MetricsStore) observe(ctx context.Context, operation string, fn func(context.Context) error) error {
+	start := time.Now()
+	err := fn(withMetrics(ctx, s.metrics))
+	s.metrics.observe(operation, "", time.Since(start), err, false)
+	return err
+}
+
+// Create creates a Secret in the wrapped store
+func (s *MetricsStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	return s.observe(ctx, "Create", func(ctx context.Context) error {
+		return s.store.Create(ctx, id, value)
+	})
+}
+
+// Read reads the latest version of a Secret from the wrapped store
+func (s *MetricsStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "Read", func(ctx context.Context) (err error) {
+		secret, err = s.store.Read(ctx, id)
+		return err
+	})
+	return secret, err
+}
+
+// ReadVersion reads a specific version of a Secret from the wrapped store
+func (s *MetricsStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "ReadVersion", func(ctx context.Context) (err error) {
+		secret, err = s.store.ReadVersion(ctx, id, version)
+		return err
+	})
+	return secret, err
+}
+
+// ReadMany reads the latest version of each secret from the wrapped store
+func (s *MetricsStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	var secrets map[SecretIdentifier]Secret
+	err := s.observe(ctx, "ReadMany", func(ctx context.Context) (err error) {
+		secrets, err = ReadMany(ctx, s.store, ids)
+		return err
+	})
+	return secrets, err
+}
+
+// Update updates a Secret in the wrapped store
+func (s *MetricsStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "Update", func(ctx context.Context) (err error) {
+		secret, err = s.store.Update(ctx, id, value)
+		return err
+	})
+	return secret, err
+}
+
+// UpdateIfVersion updates a Secret in the wrapped store if it is at expectedVersion
+func (s *MetricsStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "UpdateIfVersion", func(ctx context.Context) (err error) {
+		secret, err = UpdateIfVersion(ctx, s.store, id, expectedVersion, value)
+		return err
+	})
+	return secret, err
+}
+
+// List gets secrets within a namespace from the wrapped store
+func (s *MetricsStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	var ids []SecretIdentifier
+	err := s.observe(ctx, "List", func(ctx context.Context) (err error) {
+		ids, err = s.store.List(ctx, env, service)
+		return err
+	})
+	return ids, err
+}
+
+// ListPrefix gets secrets within a namespace whose keys start with prefix from the wrapped store
+func (s *MetricsStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	var ids []SecretIdentifier
+	err := s.observe(ctx, "ListPrefix", func(ctx context.Context) (err error) {
+		ids, err = ListPrefix(ctx, s.store, env, service, prefix)
+		return err
+	})
+	return ids, err
+}
+
+// ReadService reads every secret within a namespace from the wrapped store
+func (s *MetricsStore) ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	var secrets map[SecretIdentifier]Secret
+	err := s.observe(ctx, "ReadService", func(ctx context.Context) (err error) {
+		secrets, err = ReadService(ctx, s.store, env, service)
+		return err
+	})
+	return secrets, err
+}
+
+// ListAll gets all secrets within an environment from the wrapped store
+func (s *MetricsStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	var ids []SecretIdentifier
+	err := s.observe(ctx, "ListAll", func(ctx context.Context) (err error) {
+		ids, err = s.store.ListAll(ctx, env)
+		return err
+	})
+	return ids, err
+}
+
+// History gets the history of a Secret from the wrapped store
+func (s *MetricsStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	var history []SecretMeta
+	err := s.observe(ctx, "History", func(ctx context.Context) (err error) {
+		history, err = s.store.History(ctx, id)
+		return err
+	})
+	return history, err
+}
+
+// Delete deletes all versions of a Secret from the wrapped store
+func (s *MetricsStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	return s.observe(ctx, "Delete", func(ctx context.Context) error {
+		return s.store.Delete(ctx, id)
+	})
+}
+
+// CreateWithExpiration creates a Secret in the wrapped store that expires at expiration
+func (s *MetricsStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	return s.observe(ctx, "CreateWithExpiration", func(ctx context.Context) error {
+		writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+		if err != nil {
+			return err
+		}
+		return writer.CreateWithExpiration(ctx, id, value, expiration)
+	})
+}
+
+// UpdateWithExpiration updates a Secret in the wrapped store and makes it expire at expiration
+func (s *MetricsStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "UpdateWithExpiration", func(ctx context.Context) error {
+		writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+		if err != nil {
+			return err
+		}
+		secret, err = writer.UpdateWithExpiration(ctx, id, value, expiration)
+		return err
+	})
+	return secret, err
+}
+
+// ListExpiring gets the secrets within an environment that expire before cutoff from the wrapped store
+func (s *MetricsStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	var expiring []ExpiringSecret
+	err := s.observe(ctx, "ListExpiring", func(ctx context.Context) (err error) {
+		expiring, err = ListExpiring(ctx, s.store, env, cutoff)
+		return err
+	})
+	return expiring, err
+}
+
+// Label attaches a label to a version of a Secret in the wrapped store
+func (s *MetricsStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	return s.observe(ctx, "Label", func(ctx context.Context) error {
+		labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+		if err != nil {
+			return err
+		}
+		return labeler.Label(ctx, id, version, label)
+	})
+}
+
+// ReadLabel reads the version of a Secret a label is attached to from the wrapped store
+func (s *MetricsStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	var secret Secret
+	err := s.observe(ctx, "ReadLabel", func(ctx context.Context) error {
+		labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+		if err != nil {
+			return err
+		}
+		secret, err = labeler.ReadLabel(ctx, id, label)
+		return err
+	})
+	return secret, err
+}
+
+// Trash moves a Secret into the trash of the wrapped store
+func (s *MetricsStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	var trashed TrashedSecret
+	err := s.observe(ctx, "Trash", func(ctx context.Context) error {
+		trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+		if err != nil {
+			return err
+		}
+		trashed, err = trash.Trash(ctx, id)
+		return err
+	})
+	return trashed, err
+}
+
+// ListTrash gets the trashed secrets within an environment from the wrapped store
+func (s *MetricsStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	var trashed []TrashedSecret
+	err := s.observe(ctx, "ListTrash", func(ctx context.Context) error {
+		trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+		if err != nil {
+			return err
+		}
+		trashed, err = trash.ListTrash(ctx, env)
+		return err
+	})
+	return trashed, err
+}
+
+// Restore moves a trashed secret out of the trash of the wrapped store
+func (s *MetricsStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	return s.observe(ctx, "Restore", func(ctx context.Context) error {
+		trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+		if err != nil {
+			return err
+		}
+		return trash.Restore(ctx, trashed)
+	})
+}
+
+// Purge permanently deletes a trashed secret from the wrapped store
+func (s *MetricsStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	return s.observe(ctx, "Purge", func(ctx context.Context) error {
+		trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+		if err != nil {
+			return err
+		}
+		return trash.Purge(ctx, trashed)
+	})
+}
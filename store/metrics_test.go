@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorType(t *testing.T) {
+	assert.Equal(t, ErrorType(nil), "")
+	assert.Equal(t, ErrorType(&IdentifierNotFoundError{}), ErrorTypeNotFound)
+	assert.Equal(t, ErrorType(&types.ParameterNotFound{}), ErrorTypeNotFound)
+	assert.Equal(t, ErrorType(&AuthorizationError{}), ErrorTypeAuthorization)
+	assert.Equal(t, ErrorType(&AuthenticationError{}), ErrorTypeAuthorization)
+	assert.Equal(t, ErrorType(&smithy.GenericAPIError{Code: "AccessDeniedException"}), ErrorTypeAuthorization)
+	assert.Equal(t, ErrorType(&smithy.GenericAPIError{Code: "ThrottlingException"}), ErrorTypeThrottling)
+	assert.Equal(t, ErrorType(context.Canceled), ErrorTypeCanceled)
+	assert.Equal(t, ErrorType(&VersionConflictError{}), ErrorTypeOther)
+	assert.Equal(t, ErrorType(fmt.Errorf("ParamStore error: %w", &smithy.GenericAPIError{Code: "ThrottlingException"})), ErrorTypeThrottling)
+	assert.Equal(t, ErrorType(&ThrottlingError{}), ErrorTypeThrottling)
+	assert.Equal(t, ErrorType(convertSecretsManagerError(SecretIdentifier{}, "us-west-1", &smithy.GenericAPIError{Code: "ThrottlingException"})), ErrorTypeThrottling)
+}
+
+func TestErrorTypeParameterStore(t *testing.T) {
+	ctx := context.Background()
+	s, fakes := newFakeParameterStore(t, []string{"us-west-1", "us-west-2"})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo"}
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("errors the store wraps are classified by the API error they wrap")
+	fakes["us-west-2"].down = true
+	fakes["us-west-2"].downCode = "ThrottlingException"
+	_, err := s.Read(ctx, id)
+	assert.Equal(t, ErrorType(err), ErrorTypeThrottling)
+	_, err = s.ReadMany(ctx, []SecretIdentifier{id})
+	assert.Equal(t, ErrorType(err), ErrorTypeThrottling)
+	_, err = s.ReadMany(WithReadConsistency(ctx, ReadConsistencyAvailable), []SecretIdentifier{id})
+	assert.NoError(t, err)
+
+	fakes["us-west-1"].down = true
+	fakes["us-west-1"].downCode = "AccessDeniedException"
+	_, err = s.History(ctx, id)
+	assert.Equal(t, ErrorType(err), ErrorTypeAuthorization)
+	_, err = s.ReadMany(WithReadConsistency(ctx, ReadConsistencyAvailable), []SecretIdentifier{id})
+	assert.Contains(t, []string{ErrorTypeThrottling, ErrorTypeAuthorization}, ErrorType(err))
+}
+
+func TestMetricsStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMetricsStore(NewMemoryStore(), nil)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("each operation's calls and errors are counted by type")
+	_, err := s.Read(ctx, id)
+	assert.IsType(t, &IdentifierNotFoundError{}, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	_, err = s.Read(ctx, id)
+	assert.NoError(t, err)
+	snapshot := s.Metrics().Snapshot()
+	assert.Len(t, snapshot, 2)
+	assert.Equal(t, snapshot[0].Operation, "Create")
+	assert.Equal(t, snapshot[0].Calls, uint64(1))
+	assert.Equal(t, snapshot[1].Operation, "Read")
+	assert.Equal(t, snapshot[1].Calls, uint64(2))
+	assert.Equal(t, snapshot[1].Errors, map[string]uint64{ErrorTypeNotFound: 1})
+	assert.Equal(t, snapshot[1].LatencyBuckets[len(LatencyBuckets)-1], uint64(2))
+
+	t.Log("the metrics are written in the Prometheus text format")
+	var b strings.Builder
+	assert.NoError(t, s.Metrics().WritePrometheus(&b))
+	assert.Contains(t, b.String(), "# TYPE stealth_store_operation_duration_seconds histogram\n")
+	assert.Contains(t, b.String(), `stealth_store_operation_duration_seconds_count{operation="Read"} 2`)
+	assert.Contains(t, b.String(), `stealth_store_operation_errors_total{operation="Read",error_type="not_found"} 1`)
+}
+
+func TestMetricsStoreOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	s := NewMetricsStore(NewMemoryStore(), nil)
+	id := GetRandomTestSecretIdentifier()
+	expiration := time.Now().Add(time.Hour)
+
+	t.Log("expiring writes, labels and trash calls are counted, and the store implements their interfaces")
+	assert.True(t, Implements[TrashStore](s))
+	assert.True(t, Implements[Labeler](s))
+	assert.True(t, Implements[ExpiringWriter](s))
+	assert.True(t, Implements[ExpirationLister](s))
+	assert.NoError(t, s.CreateWithExpiration(ctx, id, "bar", expiration))
+	expiring, err := s.ListExpiring(ctx, id.Environment, expiration.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, expiring, 1)
+	assert.NoError(t, s.Label(ctx, id, 0, "stable"))
+	_, err = s.ReadLabel(ctx, id, "stable")
+	assert.NoError(t, err)
+	trashed, err := s.Trash(ctx, id)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Restore(ctx, trashed))
+	operations := map[string]uint64{}
+	for _, m := range s.Metrics().Snapshot() {
+		operations[m.Operation] = m.Calls
+	}
+	assert.Equal(t, operations, map[string]uint64{"CreateWithExpiration": 1, "ListExpiring": 1, "Label": 1,
+		"ReadLabel": 1, "Trash": 1, "Restore": 1})
+
+	t.Log("calls the wrapped store doesn't support fail, and are counted")
+	s = NewMetricsStore(NewMockStore(), nil)
+	assert.False(t, Implements[TrashStore](s))
+	_, err = s.Trash(ctx, id)
+	assert.IsType(t, &UnsupportedError{}, err)
+	snapshot := s.Metrics().Snapshot()
+	assert.Len(t, snapshot, 1)
+	assert.Equal(t, snapshot[0].Calls, uint64(1))
+	assert.Len(t, snapshot[0].Errors, 1)
+}
+
+func TestMetricsRegionRequests(t *testing.T) {
+	fake := &throttlingSSM{throttle: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	l := NewRateLimiter(RateLimitConfig{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	client := ssm.New(ssm.Options{
+		Region:       "us-west-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+		BaseEndpoint: aws.String(server.URL),
+	}, ssmMetricsOptions("us-west-1"), l.ssmOptions("us-west-1"))
+	input := &ssm.GetParameterInput{Name: aws.String("/ci-test/foo/bar")}
+
+	t.Log("requests made without Metrics in the context aren't recorded")
+	_, err := client.GetParameter(context.Background(), input)
+	assert.NoError(t, err)
+
+	t.Log("each attempt of a request is recorded for its region, with retries and throttling counted")
+	fake.requests = 0
+	m := NewMetrics()
+	_, err = client.GetParameter(withMetrics(context.Background(), m), input)
+	assert.NoError(t, err)
+	snapshot := m.Snapshot()
+	assert.Len(t, snapshot, 1)
+	assert.Equal(t, snapshot[0].Operation, "GetParameter")
+	assert.Equal(t, snapshot[0].Region, "us-west-1")
+	assert.Equal(t, snapshot[0].Calls, uint64(3))
+	assert.Equal(t, snapshot[0].Retries, uint64(2))
+	assert.Equal(t, snapshot[0].Errors, map[string]uint64{ErrorTypeThrottling: 2})
+
+	var b strings.Builder
+	assert.NoError(t, m.WritePrometheus(&b))
+	assert.Contains(t, b.String(), `stealth_region_request_retries_total{region="us-west-1",operation="GetParameter"} 2`)
+}
@@ -2,9 +2,14 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,11 +22,6 @@ import (
 	"github.com/pkg/errors"
 )
 
-var secretMgmtRoleByEnv = map[string]string{
-	"development": "arn:aws:iam::577638400844:role/SecretsManagement",
-	"production":  "arn:aws:iam::195275663288:role/SecretsManagement", // future prod role
-}
-
 var DefaultRegion = "us-west-1"
 var Region string
 
@@ -31,6 +31,78 @@ func init() {
 		region = DefaultRegion
 	}
 	Region = region
+
+	Register("ssm", openParameterStore)
+}
+
+// openParameterStore creates a ParameterStore from a URL of the form
+// ssm://?env=production&assume=true&max-results=50&region=us-west-1&rate-limit=40&max-retries=5&parallelism=4&consistency=strict.
+// All query parameters are optional. parallelism is how many regions are called at once, and consistency is the
+// ReadConsistency of reads: strict, primary or available. rate-limit is in requests per second per region, and a negative
+// rate-limit or max-retries turns them off. Without either, the store shares the default rate limiter.
+func openParameterStore(u *url.URL) (ContextSecretStore, error) {
+	query := u.Query()
+	maxResults := int64(50)
+	if v := query.Get("max-results"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid max-results for ssm store: %s", v)
+		}
+		maxResults = n
+	}
+	assume := false
+	if v := query.Get("assume"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assume for ssm store: %s", v)
+		}
+		assume = b
+	}
+	limiter := defaultRateLimiter
+	if query.Get("rate-limit") != "" || query.Get("max-retries") != "" {
+		var config RateLimitConfig
+		if v := query.Get("rate-limit"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f == 0 {
+				return nil, fmt.Errorf("invalid rate-limit for ssm store: %s", v)
+			}
+			config.RequestsPerSecond = f
+		}
+		if v := query.Get("max-retries"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max-retries for ssm store: %s", v)
+			}
+			// 0 means no retries here, rather than the default
+			config.MaxRetries = n
+			if n == 0 {
+				config.MaxRetries = -1
+			}
+		}
+		limiter = NewRateLimiter(config)
+	}
+	s := NewParameterStoreWithRateLimiter(maxResults, query.Get("env"), assume, limiter)
+	if v := query.Get("parallelism"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid parallelism for ssm store: %s", v)
+		}
+		s.RegionParallelism = n
+	}
+	if v := query.Get("consistency"); v != "" {
+		mode, err := ParseReadConsistency(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid consistency for ssm store: %s", v)
+		}
+		s.ReadConsistency = mode
+	}
+	if region := query.Get("region"); region != "" {
+		if _, ok := s.ssmClients[region]; !ok {
+			return nil, fmt.Errorf("invalid region for ssm store: %s", region)
+		}
+		s.ParamRegion = region
+	}
+	return s, nil
 }
 
 // CurrentDeployError occurs when a parameter name has suffix current-deploy.
@@ -43,15 +115,19 @@ func (e *CurrentDeployError) Error() string {
 	return fmt.Sprintf("current-deploy parameter should not be surfaced for parameter %s", e.Identifier)
 }
 
+// orderedRegions are the AWS regions that multi-region stores replicate secrets to, in the order they are written,
+// for environments that don't configure their own
+var orderedRegions = []string{
+	"us-west-1",
+	"us-west-2",
+	"us-east-1",
+}
+
 // GetOrderedRegions provides guarantees that actions on ParamStore will happen
 // within a specific order every time. This is helpful for any errors with inconsistent
-// state
+// state. The regions and their order come from the environment's config.
 func (s *ParameterStore) GetOrderedRegions() []string {
-	return []string{
-		"us-west-1",
-		"us-west-2",
-		"us-east-1",
-	}
+	return append([]string{}, s.regions...)
 }
 
 func getV2Config(region string, env string, assume bool) aws.Config {
@@ -78,7 +154,7 @@ func getV2Config(region string, env string, assume bool) aws.Config {
 	}
 
 	if assume {
-		if arn, ok := secretMgmtRoleByEnv[env]; ok {
+		if arn := environmentRoleARN(env); arn != "" {
 			stsClient := sts.NewFromConfig(cfg)
 			out, err := stsClient.AssumeRole(
 				context.TODO(),
@@ -103,39 +179,85 @@ func getV2Config(region string, env string, assume bool) aws.Config {
 	return cfg
 }
 
-func getAPIClients(env string, assume bool) map[string]*ssm.Client {
-	return map[string]*ssm.Client{
-		"us-west-1": ssm.NewFromConfig(getV2Config("us-west-1", env, assume)),
-		"us-west-2": ssm.NewFromConfig(getV2Config("us-west-2", env, assume)),
-		"us-east-1": ssm.NewFromConfig(getV2Config("us-east-1", env, assume)),
+// environmentRoleARN returns the role configured for managing an environment's secrets, if any
+func environmentRoleARN(env string) string {
+	e, err := ParseEnvironment(env)
+	if err != nil {
+		return ""
 	}
+	cfg, _ := e.Config()
+	return cfg.RoleARN
 }
 
-// getNamespace converts an env, app to a namespace to be used for parameterstore
-func getNamespace(env string, app string) string {
+// environmentRegions returns the regions an environment's secrets are replicated to.
+// Stores that aren't scoped to a configured environment use the default regions.
+func environmentRegions(env string) []string {
+	e, err := ParseEnvironment(env)
+	if err != nil {
+		return append([]string{}, orderedRegions...)
+	}
+	return e.regions()
+}
+
+// environmentPrimaryRegion returns the region reads of an environment's secrets go to
+func environmentPrimaryRegion(env string) string {
+	e, err := ParseEnvironment(env)
+	if err != nil {
+		return defaultRegionOf(orderedRegions)
+	}
+	return e.primaryRegion()
+}
+
+// defaultRegionOf picks the region reads go to: DefaultRegion if it is among regions, otherwise the first region
+func defaultRegionOf(regions []string) string {
+	for _, region := range regions {
+		if region == DefaultRegion {
+			return region
+		}
+	}
+	return regions[0]
+}
+
+func getAPIClients(env string, assume bool, limiter *RateLimiter) map[string]*ssm.Client {
+	clients := map[string]*ssm.Client{}
+	for _, region := range environmentRegions(env) {
+		// metrics first, so that the limiter is inserted closer to Retry and its waits aren't timed
+		clients[region] = ssm.NewFromConfig(getV2Config(region, env, assume), ssmMetricsOptions(region), limiter.ssmOptions(region))
+	}
+	return clients
+}
+
+// getNamespace converts an env, app to a namespace to be used for parameterstore.
+// The env's part of the namespace is its configured path prefix.
+func getNamespace(env Environment, app string) string {
 	if app == "" {
-		return fmt.Sprintf("/%s", env)
+		return fmt.Sprintf("/%s", env.pathPrefix())
 	}
-	return fmt.Sprintf("/%s/%s", env, app)
+	return fmt.Sprintf("/%s/%s", env.pathPrefix(), app)
 }
 
-// getSecretIDFromParamName converts from /development/oauth/foo-bar to SecretIdentifier development.oauth.foo-bar
+// getSecretIDFromParamName converts from /development/oauth/foo-bar to SecretIdentifier development.oauth.foo-bar,
+// and from /development/oauth/db/password to development.oauth.db/password
 func getSecretIDFromParamName(name string) (SecretIdentifier, error) {
-	parts := strings.Split(name, "/")
-	env, err := environmentStringToInt(parts[1])
-	if err != nil {
+	env, rest, ok := environmentFromPath(name)
+	if !ok {
 		return SecretIdentifier{}, &InvalidEnvironmentError{Identifier: name}
 	}
 	if strings.HasSuffix(name, "current-deploy") {
 		return SecretIdentifier{}, &CurrentDeployError{Identifier: name}
 	}
-	return SecretIdentifier{Environment: env, Service: parts[2], Key: parts[3]}, nil
+	// everything after the service is the key, which may be nested, e.g. /production/api/db/password
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return SecretIdentifier{}, fmt.Errorf("unable to create SecretIdentifier from parameter name: %s", name)
+	}
+	return SecretIdentifier{Environment: env, Service: parts[0], Key: parts[1]}, nil
 }
 
 // getParamNameFromName converts from development.oauth.foo-bar to /development/oauth/foo-bar
 // because we want namespaces for parameter naming.
 func getParamNameFromName(id SecretIdentifier) string {
-	return fmt.Sprintf("%s/%s", getNamespace(id.EnvironmentString(), id.Service), id.Key)
+	return fmt.Sprintf("%s/%s", getNamespace(id.Environment, id.Service), id.Key)
 }
 
 // getTagsFromName takes the SecretIdentifier id and returns a list/array of the resource's Tags
@@ -180,15 +302,41 @@ func convertToSSMVersion(version int) int {
 
 // ParameterStore is a secret store that uses AWS SSM Parameter store
 type ParameterStore struct {
-	ParamRegion       string
+	// ParamRegion is the primary region, which reads of a single region go to, unless a call picks another
+	// with WithRegion
+	ParamRegion string
+	// RegionParallelism bounds how many regions are called at once when reading or writing every region.
+	// Defaults to DefaultRegionParallelism; 1 calls one region at a time.
+	RegionParallelism int
+	// ReadConsistency selects which regions reads go to, unless a call sets its own with WithReadConsistency.
+	// Defaults to ReadConsistencyStrict.
+	ReadConsistency ReadConsistency
+	// OnDivergence is called when a read with ReadConsistencyAvailable finds that the regions differ.
+	// Defaults to logging the divergence.
+	OnDivergence      func(ctx context.Context, divergence RegionDivergence)
 	ssmClients        map[string]*ssm.Client
+	regions           []string
 	maxResultsToQuery int64
 	env               string
 	assume            bool
 }
 
 // Create creates a Secret in the secret store. Version is guaranteed to be zero if no error is returned.
-func (s *ParameterStore) Create(id SecretIdentifier, value string) error {
+func (s *ParameterStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	return s.create(ctx, id, value, time.Time{})
+}
+
+// CreateWithExpiration creates a secret which expires at expiration. The expiration is kept as parameter
+// policies, so the secret becomes an advanced parameter.
+func (s *ParameterStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	return s.create(ctx, id, value, expiration)
+}
+
+// create creates a secret, which expires at expiration unless it is zero
+func (s *ParameterStore) create(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
 	name := getParamNameFromName(id)
 	tags := getTagsFromName(id)
 	putParameterInput := &ssm.PutParameterInput{
@@ -198,103 +346,365 @@ func (s *ParameterStore) Create(id SecretIdentifier, value string) error {
 		Tags:      tags,
 		Value:     aws.String(value),
 	}
+	if err := setExpirationPolicies(putParameterInput, expiration); err != nil {
+		return err
+	}
 
-	_, errors := s.readForAllRegions(getParamNameFromName(id))
-	for _, err := range errors {
+	_, regionalErrors := s.readForAllRegions(ctx, name)
+	for _, err := range regionalErrors {
 		// the secret exists in some regions, throw error
 		if err == nil {
 			return &IdentifierAlreadyExistsError{Identifier: id}
 		}
 	}
 
-	var abortOperation bool
-	var failedRegions []string
-	orderedRegions := s.GetOrderedRegions()
-	for _, region := range orderedRegions {
-		regionClient := s.ssmClients[region]
-		_, err := regionClient.PutParameter(context.TODO(), putParameterInput)
-		// If any region fails, we will retry one more time. If retry fails, this Read operation fails.
-		// This guarantee the invariant that the all secret values are consistent across regions.
-		if err != nil {
-			failedRegions = append(failedRegions, region)
+	// If any region fails, we will retry one more time. If retry fails, this Create operation fails.
+	// This guarantee the invariant that the all secret values are consistent across regions.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		_, err := s.ssmClients[region].PutParameter(ctx, putParameterInput)
+		return err
+	})
+
+	// cleanup so that the Create operation is idempotent
+	if len(failures) > 0 {
+		// the cleanup must run even if ctx was cancelled, otherwise regions are left inconsistent
+		cleanupCtx := context.WithoutCancel(ctx)
+		revertFailures := forEachRegion(cleanupCtx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+			_, err := s.ssmClients[region].DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(name)})
+			// the regions the secret was never created in have nothing to revert
+			var pnf *types.ParameterNotFound
+			if errors.As(err, &pnf) {
+				return nil
+			}
+			return err
+		})
+		return &MultiRegionError{Operation: "create", Identifier: id, Errors: failures, Reverted: len(revertFailures) == 0, RevertErrors: revertFailures}
+	}
+
+	return nil
+}
+
+// Read a Secret from the store. Returns the latest version of the secret.
+func (s *ParameterStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	region, resp, err := s.readConsistently(ctx, id, getParamNameFromName(id))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return Secret{}, ctxErr
+	}
+	if err != nil {
+		var pnf *types.ParameterNotFound
+		if errors.As(err, &pnf) {
+			return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
 		}
+		return Secret{}, fmt.Errorf("ParamStore error: %w", err)
 	}
+	return Secret{*resp.Parameter.Value, SecretMeta{Created: *resp.Parameter.LastModifiedDate, Version: convertFromSSMVersion(int(resp.Parameter.Version))}}, nil
+}
 
-	abortOperation = false
-	// lets try one more time for the failed regions
-	if len(failedRegions) > 0 {
-		for _, region := range failedRegions {
-			regionClient := s.ssmClients[region]
-			_, err := regionClient.PutParameter(context.TODO(), putParameterInput)
-			if err != nil {
-				abortOperation = true
-			}
+// maxGetParametersNames is the most names a single GetParameters call accepts
+const maxGetParametersNames = 10
+
+// ReadMany reads the latest version of each secret, batching GetParameters calls in each region.
+// Like Read, ReadConsistencyStrict reads every region at once, and a secret has to exist in every region to be read;
+// secrets that don't are left out of the result. ReadConsistencyAvailable is served by the first region, starting
+// with the primary region, that doesn't fail, and reports how the other regions that answered differ from it.
+func (s *ParameterStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	idsByName := map[string]SecretIdentifier{}
+	names := []string{}
+	for _, id := range ids {
+		if err := id.Validate(); err != nil {
+			return nil, err
+		}
+		name := getParamNameFromName(id)
+		if _, ok := idsByName[name]; !ok {
+			idsByName[name] = id
+			names = append(names, name)
 		}
 	}
 
-	// cleanup so that the Read() operation is idempotent
-	if abortOperation {
-		orderedRegions := s.GetOrderedRegions()
-		for _, region := range orderedRegions {
-			regionClient := s.ssmClients[region]
-			deleteParameterInput := &ssm.DeleteParameterInput{
-				Name: aws.String(getParamNameFromName(id)),
+	mode := readConsistencyFrom(ctx, s.ReadConsistency)
+	if mode == ReadConsistencyPrimary {
+		region := s.primaryRegion(ctx)
+		results, err := s.readManyInRegion(ctx, region, names, idsByName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
-			_, err := regionClient.DeleteParameter(context.TODO(), deleteParameterInput)
-			if err != nil {
-				return fmt.Errorf("Error during cleanup of secret creation for (%s). try again. error: %s", region, err)
+			return nil, fmt.Errorf("ParamStore error in region %s: %w", region, err)
+		}
+		return results, nil
+	}
+	if mode == ReadConsistencyAvailable {
+		read := func(ctx context.Context, region string) (map[SecretIdentifier]Secret, error) {
+			return s.readManyInRegion(ctx, region, names, idsByName)
+		}
+		healthy := func(err error) bool {
+			return err == nil
+		}
+		result, answered, ok := firstHealthy(ctx, s.primaryFirstRegions(ctx), read, healthy)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		failures := map[string]error{}
+		for region, other := range answered {
+			if other.err != nil {
+				failures[region] = other.err
 			}
 		}
-		return fmt.Errorf("Error creating secret (%s). reverted all PutParameter operations. try creating secret again", id)
+		if !ok {
+			return nil, fmt.Errorf("ParamStore error: %w", joinRegionErrors(failures))
+		}
+		results := result.value
+		for _, name := range names {
+			id := idsByName[name]
+			secret, found := results[id]
+			if !found {
+				// the region may just be missing it, so it is read like Read would, from the next region that has it
+				region, resp, err := s.readConsistently(ctx, id, name)
+				if isParameterMissing(err) {
+					continue
+				} else if err != nil {
+					return nil, fmt.Errorf("ParamStore error in region %s: %w", region, err)
+				}
+				results[id] = Secret{*resp.Parameter.Value, SecretMeta{Created: *resp.Parameter.LastModifiedDate, Version: convertFromSSMVersion(int(resp.Parameter.Version))}}
+				continue
+			}
+			divergence := RegionDivergence{Identifier: id, Region: result.region, Errors: failures, Versions: map[string]int{}}
+			for region, other := range answered {
+				if region == result.region || other.err != nil {
+					continue
+				}
+				if otherSecret, otherFound := other.value[id]; !otherFound {
+					divergence.Versions[region] = -1
+				} else if otherSecret.Meta.Version != secret.Meta.Version || otherSecret.Data != secret.Data {
+					divergence.Versions[region] = otherSecret.Meta.Version
+				}
+			}
+			if len(failures) > 0 || len(divergence.Versions) > 0 {
+				s.notifyDivergence(ctx, divergence)
+			}
+		}
+		return results, nil
 	}
 
-	return nil
-}
-
-// Read a Secret from the store. Returns the latest version of the secret.
-func (s *ParameterStore) Read(id SecretIdentifier) (Secret, error) {
-	var resp *ssm.GetParameterOutput
-	regionalOutput, regionalErrors := s.readForAllRegions(getParamNameFromName(id))
+	var mu sync.Mutex
+	regionalResults := map[string]map[SecretIdentifier]Secret{}
 	orderedRegions := s.GetOrderedRegions()
-	for _, region := range orderedRegions {
-		err := regionalErrors[region]
+	failures := forEachRegion(ctx, orderedRegions, s.RegionParallelism, func(ctx context.Context, region string) error {
+		regionResults, err := s.readManyInRegion(ctx, region, names, idsByName)
 		if err != nil {
-			var pnf *types.ParameterNotFound
-			if errors.As(err, &pnf) {
-				return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
+			return err
+		}
+		mu.Lock()
+		regionalResults[region] = regionResults
+		mu.Unlock()
+		return nil
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, region := range orderedRegions {
+		if err := failures[region]; err != nil {
+			return nil, fmt.Errorf("ParamStore error in region %s: %w", region, err)
+		}
+	}
+	results := regionalResults[s.primaryRegion(ctx)]
+	for id := range results {
+		for _, region := range orderedRegions {
+			if _, ok := regionalResults[region][id]; !ok {
+				delete(results, id)
+				break
 			}
-			return Secret{}, fmt.Errorf("ParamStore error: %s", err)
 		}
 	}
-	resp = regionalOutput[s.ParamRegion]
-	return Secret{*resp.Parameter.Value, SecretMeta{Created: *resp.Parameter.LastModifiedDate, Version: convertFromSSMVersion(int(resp.Parameter.Version))}}, nil
+	return results, nil
+}
+
+// readManyInRegion reads the latest version of the parameters with the given names from region, leaving out the
+// ones that don't exist
+func (s *ParameterStore) readManyInRegion(ctx context.Context, region string, names []string, idsByName map[string]SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	results := map[SecretIdentifier]Secret{}
+	regionClient := s.ssmClients[region]
+	for start := 0; start < len(names); start += maxGetParametersNames {
+		resp, err := regionClient.GetParameters(ctx, &ssm.GetParametersInput{
+			Names:          names[start:min(start+maxGetParametersNames, len(names))],
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// names that don't exist come back in resp.InvalidParameters
+		for _, param := range resp.Parameters {
+			results[idsByName[*param.Name]] = Secret{*param.Value, SecretMeta{Created: *param.LastModifiedDate, Version: convertFromSSMVersion(int(param.Version))}}
+		}
+	}
+	return results, nil
 }
 
 // ReadVersion reads a specific version of a secret from the store.
 // Version is 0-indexed
-func (s *ParameterStore) ReadVersion(id SecretIdentifier, version int) (Secret, error) {
-	var resp *ssm.GetParameterOutput
-	regionalOutput, regionalErrors := s.readForAllRegions(getParamNameFromNameAtVersion(id, version))
-	orderedRegions := s.GetOrderedRegions()
-	for _, region := range orderedRegions {
-		err := regionalErrors[region]
+func (s *ParameterStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	region, resp, err := s.readConsistently(ctx, id, getParamNameFromNameAtVersion(id, version))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return Secret{}, ctxErr
+	}
+	if err != nil {
+		var pnf *types.ParameterNotFound
+		var pvnf *types.ParameterVersionNotFound
+		if errors.As(err, &pnf) {
+			return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
+		} else if errors.As(err, &pvnf) {
+			return Secret{}, &VersionNotFoundError{Identifier: id, Version: version}
+		}
+		return Secret{}, fmt.Errorf("ParamStore error: %w", err)
+	}
+	return Secret{*resp.Parameter.Value, SecretMeta{Created: *resp.Parameter.LastModifiedDate, Version: convertFromSSMVersion(int(resp.Parameter.Version))}}, nil
+}
+
+// Label attaches label to a version of a secret in every region, moving it from whichever version had it before.
+// Like writes, labeling goes to every region or none of them: if a region fails, the label is moved back in every
+// region.
+func (s *ParameterStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateLabel(label); err != nil {
+		return err
+	}
+	name := getParamNameFromName(id)
+	// previous are the versions that had the label before, by region, so that they can get it back
+	previous := map[string]int{}
+	regionalOutput, regionalErrors := s.readForAllRegions(ctx, fmt.Sprintf("%s:%s", name, label))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, region := range s.GetOrderedRegions() {
+		if err := regionalErrors[region]; err != nil && !isParameterMissing(err) {
+			return fmt.Errorf("ParamStore error: %w", err)
+		}
+		previous[region], _ = parameterVersionAndValue(regionalOutput[region], regionalErrors[region])
+	}
+
+	labelParameterVersionInput := &ssm.LabelParameterVersionInput{
+		Name:             aws.String(name),
+		Labels:           []string{label},
+		ParameterVersion: aws.Int64(int64(convertToSSMVersion(version))),
+	}
+	// If any region fails, we will retry one more time. If retry fails, labeling fails.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		resp, err := s.ssmClients[region].LabelParameterVersion(ctx, labelParameterVersionInput)
 		if err != nil {
 			var pnf *types.ParameterNotFound
 			var pvnf *types.ParameterVersionNotFound
 			if errors.As(err, &pnf) {
-				return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
+				return &IdentifierNotFoundError{Identifier: id, Region: region}
 			} else if errors.As(err, &pvnf) {
-				return Secret{}, &VersionNotFoundError{Identifier: id, Version: version}
+				return &VersionNotFoundError{Identifier: id, Version: version}
+			}
+			return err
+		}
+		if len(resp.InvalidLabels) > 0 {
+			return &InvalidLabelError{Label: label, Reason: "rejected by Parameter Store"}
+		}
+		return nil
+	})
+	if len(failures) == 0 {
+		return nil
+	}
+
+	// the revert must run even if ctx was cancelled, otherwise regions are left inconsistent
+	revertFailures := forEachRegion(context.WithoutCancel(ctx), s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		return s.restoreLabel(ctx, region, name, label, version, previous[region])
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(revertFailures) == 0 {
+		// every region is back the way it was, so a missing secret or version, or a rejected label, is what
+		// callers need to know about
+		for _, region := range sortedRegions(failures) {
+			switch err := failures[region].(type) {
+			case *IdentifierNotFoundError, *VersionNotFoundError, *InvalidLabelError:
+				return err
 			}
-			return Secret{}, fmt.Errorf("ParamStore error: %s. ", err)
 		}
 	}
-	resp = regionalOutput[s.ParamRegion]
+	return &MultiRegionError{Operation: "label", Identifier: id, Errors: failures, Reverted: len(revertFailures) == 0, RevertErrors: revertFailures}
+}
+
+// restoreLabel moves label back to the version that had it before it was attached to version in one region, or
+// removes it if no version had it
+func (s *ParameterStore) restoreLabel(ctx context.Context, region, name, label string, version, previous int) error {
+	regionClient := s.ssmClients[region]
+	if previous >= 0 {
+		_, err := regionClient.LabelParameterVersion(ctx, &ssm.LabelParameterVersionInput{
+			Name:             aws.String(name),
+			Labels:           []string{label},
+			ParameterVersion: aws.Int64(int64(convertToSSMVersion(previous))),
+		})
+		return err
+	}
+	_, err := regionClient.UnlabelParameterVersion(ctx, &ssm.UnlabelParameterVersionInput{
+		Name:             aws.String(name),
+		Labels:           []string{label},
+		ParameterVersion: aws.Int64(int64(convertToSSMVersion(version))),
+	})
+	// the regions where the parameter or version doesn't exist were never labeled
+	if isParameterMissing(err) {
+		return nil
+	}
+	return err
+}
+
+// ReadLabel reads the version of a secret that label is attached to, using a name:label selector
+func (s *ParameterStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if err := ValidateLabel(label); err != nil {
+		return Secret{}, err
+	}
+	region, resp, err := s.readConsistently(ctx, id, fmt.Sprintf("%s:%s", getParamNameFromName(id), label))
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return Secret{}, ctxErr
+	}
+	if err != nil {
+		var pnf *types.ParameterNotFound
+		var pvnf *types.ParameterVersionNotFound
+		if errors.As(err, &pnf) || errors.As(err, &pvnf) {
+			// a missing label looks like a missing parameter, so check which one it is
+			_, err := s.ssmClients[region].GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(getParamNameFromName(id))})
+			if errors.As(err, &pnf) {
+				return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
+			}
+			return Secret{}, &LabelNotFoundError{Identifier: id, Label: label}
+		}
+		return Secret{}, fmt.Errorf("ParamStore error: %w", err)
+	}
 	return Secret{*resp.Parameter.Value, SecretMeta{Created: *resp.Parameter.LastModifiedDate, Version: convertFromSSMVersion(int(resp.Parameter.Version))}}, nil
 }
 
 // Update updates a Secret from the store and increments version number.
-func (s *ParameterStore) Update(id SecretIdentifier, value string) (Secret, error) {
+func (s *ParameterStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	return s.update(ctx, id, value, time.Time{})
+}
+
+// UpdateWithExpiration updates a secret and makes it expire at expiration. The expiration is kept as
+// parameter policies, so the secret becomes an advanced parameter.
+func (s *ParameterStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	return s.update(ctx, id, value, expiration)
+}
+
+// update updates a secret, and makes it expire at expiration unless it is zero
+func (s *ParameterStore) update(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
 	name := getParamNameFromName(id)
 	putParameterInput := &ssm.PutParameterInput{
 		Name:      aws.String(name),
@@ -302,213 +712,790 @@ func (s *ParameterStore) Update(id SecretIdentifier, value string) (Secret, erro
 		Type:      types.ParameterTypeSecureString,
 		Value:     aws.String(value),
 	}
+	if err := setExpirationPolicies(putParameterInput, expiration); err != nil {
+		return Secret{}, err
+	}
 
-	var abortOperation bool
-	var failedRegions []string
-	oldSecretValue, err := s.Read(id)
+	oldSecretValue, err := s.Read(ctx, id)
 	if err != nil {
 		return Secret{}, err
 	}
 
-	orderedRegions := s.GetOrderedRegions()
-	for _, region := range orderedRegions {
-		regionClient := s.ssmClients[region]
-		_, err := regionClient.PutParameter(context.TODO(), putParameterInput)
-		// If any region fails, we will retry one more time. If retry fails, this Update operation fails.
-		// This guarantee the invariant that the all secret values are consistent across regions.
+	err = s.updateAllRegions(ctx, id, putParameterInput, nil, func(ctx context.Context, region string) error {
+		return s.putValue(ctx, region, name, oldSecretValue.Data)
+	})
+	if err != nil {
+		return Secret{}, err
+	}
+	return s.Read(ctx, id)
+}
+
+// updateAllRegions writes a new version of a parameter to every region, retrying the regions that fail once.
+// check, if set, inspects each write that succeeded, and rejects it by returning an error; rejected regions aren't
+// retried. If any region fails or is rejected, revert is called for every region, since a write that seemed to
+// fail may still have landed, and a MultiRegionError reports the regions that failed.
+func (s *ParameterStore) updateAllRegions(ctx context.Context, id SecretIdentifier, input *ssm.PutParameterInput, check func(ctx context.Context, region string, resp *ssm.PutParameterOutput) error, revert func(ctx context.Context, region string) error) error {
+	var mu sync.Mutex
+	rejections := map[string]error{}
+	// If any region fails, we will retry one more time. If retry fails, this Update operation fails.
+	// This guarantee the invariant that the all secret values are consistent across regions.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		resp, err := s.ssmClients[region].PutParameter(ctx, input)
 		if err != nil {
-			failedRegions = append(failedRegions, region)
+			return err
 		}
+		if check != nil {
+			if err := check(ctx, region, resp); err != nil {
+				// the write landed, so writing again wouldn't help
+				mu.Lock()
+				rejections[region] = err
+				mu.Unlock()
+			}
+		}
+		return nil
+	})
+	for region, err := range rejections {
+		failures[region] = err
+	}
+	if len(failures) == 0 {
+		return nil
 	}
 
-	abortOperation = false
-	// lets try one more time for the failed regions
-	if len(failedRegions) > 0 {
-		for _, region := range failedRegions {
-			regionClient := s.ssmClients[region]
-			_, err := regionClient.PutParameter(context.TODO(), putParameterInput)
-			if err != nil {
-				abortOperation = true
+	// cleanup so that Update is idempotent. the revert must run even if ctx was cancelled, otherwise regions are
+	// left inconsistent
+	revertFailures := forEachRegion(context.WithoutCancel(ctx), s.GetOrderedRegions(), s.RegionParallelism, revert)
+	return &MultiRegionError{Operation: "update", Identifier: id, Errors: failures, Reverted: len(revertFailures) == 0, RevertErrors: revertFailures}
+}
+
+// putValue writes value to one region as the latest version of a parameter
+func (s *ParameterStore) putValue(ctx context.Context, region, name, value string) error {
+	_, err := s.ssmClients[region].PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Overwrite: aws.Bool(true),
+		Type:      types.ParameterTypeSecureString,
+		Value:     aws.String(value),
+	})
+	return err
+}
+
+// UpdateIfVersion updates a secret only if its latest version is expectedVersion in every region.
+// Parameter Store has no conditional writes, so the versions PutParameter returns are checked as well: if another
+// writer got to a region first, that region gets the other writer's value back, the other regions are reverted as
+// in Update, and a VersionConflictError is returned.
+func (s *ParameterStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	name := getParamNameFromName(id)
+	regionalOutput, regionalErrors := s.readForAllRegions(ctx, name)
+	if err := ctx.Err(); err != nil {
+		return Secret{}, err
+	}
+	for _, region := range s.GetOrderedRegions() {
+		if err := regionalErrors[region]; err != nil {
+			var pnf *types.ParameterNotFound
+			if errors.As(err, &pnf) {
+				return Secret{}, &IdentifierNotFoundError{Identifier: id, Region: region}
 			}
+			return Secret{}, fmt.Errorf("ParamStore error: %w", err)
+		}
+		if actual := convertFromSSMVersion(int(regionalOutput[region].Parameter.Version)); actual != expectedVersion {
+			return Secret{}, &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: actual}
 		}
 	}
 
-	// cleanup so that Update is idempotent
-	if abortOperation {
-		orderedRegions := s.GetOrderedRegions()
-		for _, region := range orderedRegions {
-			regionClient := s.ssmClients[region]
-			putParameterInput := &ssm.PutParameterInput{
-				Name:      aws.String(name),
-				Overwrite: aws.Bool(true), // true since we are reverting the update,
-				Type:      types.ParameterTypeSecureString,
-				Value:     aws.String(oldSecretValue.Data),
-			}
-			_, err := regionClient.PutParameter(context.TODO(), putParameterInput)
-			if err != nil {
-				return Secret{}, fmt.Errorf("error update secret for region(%s). try again. error: %s", region, err)
+	putParameterInput := &ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Overwrite: aws.Bool(true), // true since we are updating existing secret
+		Type:      types.ParameterTypeSecureString,
+		Value:     aws.String(value),
+	}
+	var mu sync.Mutex
+	// conflicts are the versions other writers wrote before ours, by region
+	conflicts := map[string]int{}
+	err := s.updateAllRegions(ctx, id, putParameterInput, func(ctx context.Context, region string, resp *ssm.PutParameterOutput) error {
+		written := convertFromSSMVersion(int(resp.Version))
+		if written == expectedVersion+1 {
+			return nil
+		}
+		mu.Lock()
+		conflicts[region] = written - 1
+		mu.Unlock()
+		return &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: written - 1}
+	}, func(ctx context.Context, region string) error {
+		if version, ok := conflicts[region]; ok {
+			// the version before ours belongs to the other writer, so make it the latest again
+			return s.restoreVersion(ctx, region, id, version)
+		}
+		return s.putValue(ctx, region, name, *regionalOutput[region].Parameter.Value)
+	})
+	var multiRegionErr *MultiRegionError
+	if errors.As(err, &multiRegionErr) && multiRegionErr.Reverted {
+		// every region is back the way it was, so the conflict is what callers need to know about
+		for _, region := range sortedRegions(multiRegionErr.Errors) {
+			if conflict, ok := multiRegionErr.Errors[region].(*VersionConflictError); ok {
+				return Secret{}, conflict
 			}
 		}
-		return Secret{}, fmt.Errorf("error updating secret for (%s). try again", id)
 	}
+	if err != nil {
+		return Secret{}, err
+	}
+	return s.Read(ctx, id)
+}
 
-	return s.Read(id)
+// restoreVersion writes a secret's value at version back to one region as its latest version
+func (s *ParameterStore) restoreVersion(ctx context.Context, region string, id SecretIdentifier, version int) error {
+	regionClient := s.ssmClients[region]
+	resp, err := regionClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(getParamNameFromNameAtVersion(id, version)),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = regionClient.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(getParamNameFromName(id)),
+		Overwrite: aws.Bool(true),
+		Type:      types.ParameterTypeSecureString,
+		Value:     resp.Parameter.Value,
+	})
+	return err
 }
 
 // List gets secrets within a namespace (env/service)>
-func (s *ParameterStore) List(env Environment, service string) ([]SecretIdentifier, error) {
-	id := SecretIdentifier{env, service, ""}
-	namespace := getNamespace(id.EnvironmentString(), service)
-	apiClient := s.ssmClients[s.ParamRegion]
-
-	// Per https://docs.aws.amazon.com/systems-manager/latest/APIReference/API_DescribeParameters.html
-	// DescribeParameters request results are returned on a best-effort basis. Hence, we need to rely on NextToken
-	// to fully fetch teh list of parameters and additionally we have to retry multiple times to fully fetch all the parameters.
-	// We retry 2 times and return the maximum of the results
+func (s *ParameterStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	return s.ListPrefix(ctx, env, service, "")
+}
+
+// ListPrefix gets secrets within a namespace (env/service) whose keys start with prefix, e.g. db/
+func (s *ParameterStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	path := getNamespace(env, service)
+	// only sweep the deepest path the prefix names
+	if i := strings.LastIndex(prefix, "/"); service != "" && i >= 0 {
+		path += "/" + prefix[:i]
+	}
 	results := []SecretIdentifier{}
-	retryCount := 2
-	for i := 1; i <= retryCount; i++ {
-		resultsPerTry := []SecretIdentifier{}
-		hasNextToken := true
-		nextTokenStr := ""
-		for hasNextToken {
-			describeParametersByPathInput := &ssm.DescribeParametersInput{
-				ParameterFilters: []types.ParameterStringFilter{
-					{
-						Key:    aws.String("Path"),
-						Option: aws.String("Recursive"),
-						Values: []string{namespace},
-					},
-				},
-				MaxResults: aws.Int32(int32(s.maxResultsToQuery)),
-			}
-			if nextTokenStr != "" {
-				describeParametersByPathInput.NextToken = aws.String(nextTokenStr)
-			}
+	err := s.getParametersByPath(ctx, path, false, func(id SecretIdentifier, param types.Parameter) {
+		if strings.HasPrefix(id.Key, prefix) {
+			results = append(results, id)
+		}
+	})
+	if err != nil {
+		return []SecretIdentifier{}, err
+	}
+	sort.Sort(ByIDString(results))
+	return results, nil
+}
 
-			resp, err := apiClient.DescribeParameters(context.TODO(), describeParametersByPathInput)
-			if err != nil {
-				return []SecretIdentifier{}, err
-			}
-			for _, result := range resp.Parameters {
-				ident, err := getSecretIDFromParamName(*result.Name)
-				if _, ok := err.(*CurrentDeployError); ok {
-					// secrets that fail with CurrentDeployError are intended to be read by machines, and not returned for human consumption.
-					continue
-				}
-				resultsPerTry = append(resultsPerTry, ident)
-			}
-			if resp.NextToken != nil && *resp.NextToken != "" {
-				nextTokenStr = *resp.NextToken
-			} else {
-				hasNextToken = false
-			}
-			// Try not to overwhelm rate limits
-			time.Sleep(100 * time.Millisecond)
+// ReadService reads the latest version of every secret of a service in one paginated sweep of the primary region
+func (s *ParameterStore) ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	if !env.IsValid() {
+		return nil, fmt.Errorf("env %d is invalid", env)
+	}
+	results := map[SecretIdentifier]Secret{}
+	err := s.getParametersByPath(ctx, getNamespace(env, service), true, func(id SecretIdentifier, param types.Parameter) {
+		results[id] = Secret{*param.Value, SecretMeta{Created: *param.LastModifiedDate, Version: convertFromSSMVersion(int(param.Version))}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// maxGetParametersByPathResults is the largest page GetParametersByPath returns
+const maxGetParametersByPathResults = 10
+
+// getParametersByPath calls fn for every stealth secret under path in the primary region, including nested keys.
+// Parameters that aren't stealth secrets, such as current-deploy parameters, are skipped.
+func (s *ParameterStore) getParametersByPath(ctx context.Context, path string, decrypt bool, fn func(id SecretIdentifier, param types.Parameter)) error {
+	return s.sweepPath(ctx, path, decrypt, func(param types.Parameter) {
+		// secrets that fail with CurrentDeployError are intended to be read by machines, and not returned for human consumption.
+		id, err := getSecretIDFromParamName(*param.Name)
+		if err != nil {
+			return
 		}
-		if len(resultsPerTry) >= len(results) {
-			results = resultsPerTry
+		fn(id, param)
+	})
+}
+
+// sweepPath calls fn for every parameter under path in the primary region, using paginated GetParametersByPath calls
+func (s *ParameterStore) sweepPath(ctx context.Context, path string, decrypt bool, fn func(param types.Parameter)) error {
+	paginator := ssm.NewGetParametersByPathPaginator(s.ssmClients[s.primaryRegion(ctx)], &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(decrypt),
+		MaxResults:     aws.Int32(int32(min(s.maxResultsToQuery, maxGetParametersByPathResults))),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("ParamStore error: %w", err)
 		}
-		// retry again in a second
-		time.Sleep(1 * time.Second)
-	}
-	// collapse any duplicate SecretIdentifiers (same Env,Service,Key)
-	unique := make(map[SecretIdentifier]struct{}, len(results))
-	deduped := make([]SecretIdentifier, 0, len(results))
-	for _, ident := range results {
-		if _, seen := unique[ident]; !seen {
-			unique[ident] = struct{}{}
-			deduped = append(deduped, ident)
+		for _, param := range resp.Parameters {
+			fn(param)
 		}
 	}
-	return deduped, nil
+	return nil
 }
 
 // ListAll gets all secrets within a environment (env)>
-func (s *ParameterStore) ListAll(env Environment) ([]SecretIdentifier, error) {
-	return s.List(env, "")
+func (s *ParameterStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	return s.List(ctx, env, "")
 }
 
-// History gets history for a secret, returning all versions from the store.
-func (s *ParameterStore) History(id SecretIdentifier) ([]SecretMeta, error) {
+// History gets history for a secret, returning all versions from the store. Values are never decrypted.
+func (s *ParameterStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := id.Validate(); err != nil {
+		return []SecretMeta{}, err
+	}
 	paramName := getParamNameFromName(id)
 	getParamHistoryInput := &ssm.GetParameterHistoryInput{
 		Name: aws.String(paramName),
 	}
-	apiClient := s.ssmClients[s.ParamRegion]
+	paginator := ssm.NewGetParameterHistoryPaginator(s.ssmClients[s.primaryRegion(ctx)], getParamHistoryInput)
 	results := []SecretMeta{}
-	resp, err := apiClient.GetParameterHistory(context.TODO(), getParamHistoryInput)
-	if err != nil {
-		var pnf *types.ParameterNotFound
-		if errors.As(err, &pnf) {
-			return results, &IdentifierNotFoundError{Identifier: id, Region: Region}
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return []SecretMeta{}, ctx.Err()
+			}
+			var pnf *types.ParameterNotFound
+			if errors.As(err, &pnf) {
+				return []SecretMeta{}, &IdentifierNotFoundError{Identifier: id, Region: Region}
+			}
+			return []SecretMeta{}, fmt.Errorf("ParamStore error: %w", err)
+		}
+		for _, history := range resp.Parameters {
+			results = append(results, SecretMeta{
+				Created:     *history.LastModifiedDate,
+				Version:     convertFromSSMVersion(int(history.Version)),
+				Labels:      history.Labels,
+				Author:      aws.ToString(history.LastModifiedUser),
+				Description: aws.ToString(history.Description),
+				Tier:        string(history.Tier),
+				Expiration:  getExpirationFromPolicies(history.Policies),
+			})
 		}
-		return results, fmt.Errorf("ParamStore error: %s", err)
-	}
-	for _, history := range resp.Parameters {
-		results = append(results, SecretMeta{
-			Created: *history.LastModifiedDate,
-			Version: convertFromSSMVersion(int(history.Version)),
-		})
 	}
 	return results, nil
 }
 
-// Delete deletes all versions of a secret
-func (s *ParameterStore) Delete(id SecretIdentifier) error {
-	deleteParameterInput := &ssm.DeleteParameterInput{
-		Name: aws.String(getParamNameFromName(id)),
+// ListExpiring gets the secrets within an environment that expire before cutoff, soonest first. Only advanced
+// parameters can have an expiration policy, so only those are described.
+func (s *ParameterStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	if !env.IsValid() {
+		return nil, fmt.Errorf("env %d is invalid", env)
 	}
-	orderedRegions := s.GetOrderedRegions()
-	var failedRegions []string
-	for _, region := range orderedRegions {
-		regionClient := s.ssmClients[region]
-		_, err := regionClient.DeleteParameter(context.TODO(), deleteParameterInput)
-		// If any region fails, add to the return list of errors and continue.
+	paginator := ssm.NewDescribeParametersPaginator(s.ssmClients[s.primaryRegion(ctx)], &ssm.DescribeParametersInput{
+		ParameterFilters: []types.ParameterStringFilter{
+			{Key: aws.String("Path"), Option: aws.String("Recursive"), Values: []string{getNamespace(env, "")}},
+			{Key: aws.String("Tier"), Values: []string{string(types.ParameterTierAdvanced)}},
+		},
+		MaxResults: aws.Int32(maxDescribeParametersResults),
+	})
+	results := []ExpiringSecret{}
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
 		if err != nil {
-			failedRegions = append(failedRegions, region)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("ParamStore error: %w", err)
 		}
-	}
-	// retry one more time
-	if len(failedRegions) > 0 {
-		for _, region := range failedRegions {
-			regionClient := s.ssmClients[region]
-			_, err := regionClient.DeleteParameter(context.TODO(), deleteParameterInput)
-			// If any region fails now, consider this Delete operation failed and return
+		for _, param := range resp.Parameters {
+			expiration := getExpirationFromPolicies(param.Policies)
+			if expiration.IsZero() || !expiration.Before(cutoff) {
+				continue
+			}
+			id, err := getSecretIDFromParamName(*param.Name)
 			if err != nil {
-				return fmt.Errorf("failed to delete secret from region %s. try again", region)
+				continue
 			}
+			results = append(results, ExpiringSecret{Identifier: id, Expiration: expiration})
+		}
+	}
+	sortExpiring(results)
+	return results, nil
+}
+
+// maxDescribeParametersResults is the most parameters a single DescribeParameters call returns
+const maxDescribeParametersResults = 50
+
+// expirationNotificationDays is how long before a secret expires Parameter Store notifies about it, at most.
+// Secrets that expire sooner are notified about halfway to their expiration.
+const expirationNotificationDays = 14
+
+// ssmPolicy is a Parameter Store parameter policy, as written in PutParameterInput.Policies
+type ssmPolicy struct {
+	Type       string            `json:"Type"`
+	Version    string            `json:"Version"`
+	Attributes map[string]string `json:"Attributes"`
+}
+
+// setExpirationPolicies makes a PutParameter expire the parameter at expiration, unless it is zero. Besides the
+// Expiration policy, ExpirationNotification and NoChangeNotification make Parameter Store send EventBridge
+// events ahead of the expiration, and when the secret still hasn't been changed by then.
+func setExpirationPolicies(input *ssm.PutParameterInput, expiration time.Time) error {
+	if expiration.IsZero() {
+		return nil
+	}
+	if !expiration.After(time.Now()) {
+		return fmt.Errorf("expiration %s is not in the future", expiration.UTC().Format(time.RFC3339))
+	}
+	policies := []ssmPolicy{{
+		Type:       "Expiration",
+		Version:    "1.0",
+		Attributes: map[string]string{"Timestamp": expiration.UTC().Format("2006-01-02T15:04:05.000Z")},
+	}}
+	days := int(time.Until(expiration).Hours() / 24)
+	if before := min(expirationNotificationDays, days/2); before > 0 {
+		policies = append(policies, ssmPolicy{
+			Type:       "ExpirationNotification",
+			Version:    "1.0",
+			Attributes: map[string]string{"Before": strconv.Itoa(before), "Unit": "Days"},
+		}, ssmPolicy{
+			Type:       "NoChangeNotification",
+			Version:    "1.0",
+			Attributes: map[string]string{"After": strconv.Itoa(days - before), "Unit": "Days"},
+		})
+	}
+	text, err := json.Marshal(policies)
+	if err != nil {
+		return err
+	}
+	input.Policies = aws.String(string(text))
+	// parameter policies are only available to advanced parameters
+	input.Tier = types.ParameterTierAdvanced
+	return nil
+}
+
+// getExpirationFromPolicies finds the expiration in a parameter's policies, or returns the zero time if it has none
+func getExpirationFromPolicies(policies []types.ParameterInlinePolicy) time.Time {
+	for _, policy := range policies {
+		if aws.ToString(policy.PolicyType) != "Expiration" {
+			continue
+		}
+		var p ssmPolicy
+		if err := json.Unmarshal([]byte(aws.ToString(policy.PolicyText)), &p); err != nil {
+			continue
 		}
+		if expiration, err := time.Parse(time.RFC3339, p.Attributes["Timestamp"]); err == nil {
+			return expiration
+		}
+	}
+	return time.Time{}
+}
+
+// Delete deletes all versions of a secret
+func (s *ParameterStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	return s.deleteParameter(ctx, id, getParamNameFromName(id))
+}
+
+// deleteParameter deletes all versions of a parameter that holds the secret id from every region
+func (s *ParameterStore) deleteParameter(ctx context.Context, id SecretIdentifier, name string) error {
+	deleteParameterInput := &ssm.DeleteParameterInput{
+		Name: aws.String(name),
+	}
+	// If any region fails, we will retry one more time. If retry fails, this Delete operation fails.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		_, err := s.ssmClients[region].DeleteParameter(ctx, deleteParameterInput)
+		return err
+	})
+	if len(failures) > 0 {
+		return &MultiRegionError{Operation: "delete", Identifier: id, Errors: failures}
 	}
 	return nil
 }
 
 // NewParameterStore creates a secret store that points at ParameterStore
 func NewParameterStore(maxResultsToQuery int64, env string, assume bool) *ParameterStore {
+	return NewParameterStoreWithRateLimiter(maxResultsToQuery, env, assume, defaultRateLimiter)
+}
+
+// NewParameterStoreWithRateLimiter creates a secret store that points at ParameterStore, and paces its requests
+// with limiter. NewParameterStore shares a default limiter between all stores.
+func NewParameterStoreWithRateLimiter(maxResultsToQuery int64, env string, assume bool, limiter *RateLimiter) *ParameterStore {
+	regions := environmentRegions(env)
 	return &ParameterStore{
-		ParamRegion:       DefaultRegion,
-		ssmClients:        getAPIClients(env, assume),
+		ParamRegion:       environmentPrimaryRegion(env),
+		RegionParallelism: DefaultRegionParallelism,
+		ssmClients:        getAPIClients(env, assume, limiter),
+		regions:           regions,
 		maxResultsToQuery: maxResultsToQuery,
 		env:               env,
 		assume:            assume,
 	}
 }
 
-// readForAllRegions reads given secret from all AWS regions and return status for the corresponding region.
+// readForAllRegions reads given secret from all AWS regions at once and return status for the corresponding region.
 // If a read for a region fails, the corresponding error is returned
-func (s *ParameterStore) readForAllRegions(paramName string) (map[string]*ssm.GetParameterOutput, map[string]error) {
+func (s *ParameterStore) readForAllRegions(ctx context.Context, paramName string) (map[string]*ssm.GetParameterOutput, map[string]error) {
+	var mu sync.Mutex
 	output := make(map[string]*ssm.GetParameterOutput)
-	errors := make(map[string]error)
 	getParameterInput := &ssm.GetParameterInput{
 		Name:           aws.String(paramName),
 		WithDecryption: aws.Bool(true),
 	}
+	failures := forEachRegion(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		resp, err := s.ssmClients[region].GetParameter(ctx, getParameterInput)
+		mu.Lock()
+		output[region] = resp
+		mu.Unlock()
+		return err
+	})
+	errors := make(map[string]error)
+	for _, region := range s.GetOrderedRegions() {
+		errors[region] = failures[region]
+	}
+	return output, errors
+}
+
+// readConsistently reads a parameter of id from the regions its read consistency calls for. It returns the
+// parameter of the region the read is served from, or the error that decides the read and its region.
+func (s *ParameterStore) readConsistently(ctx context.Context, id SecretIdentifier, paramName string) (string, *ssm.GetParameterOutput, error) {
+	switch readConsistencyFrom(ctx, s.ReadConsistency) {
+	case ReadConsistencyPrimary:
+		region := s.primaryRegion(ctx)
+		resp, err := s.ssmClients[region].GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(paramName),
+			WithDecryption: aws.Bool(true),
+		})
+		return region, resp, err
+	case ReadConsistencyAvailable:
+		input := &ssm.GetParameterInput{
+			Name:           aws.String(paramName),
+			WithDecryption: aws.Bool(true),
+		}
+		read := func(ctx context.Context, region string) (*ssm.GetParameterOutput, error) {
+			return s.ssmClients[region].GetParameter(ctx, input)
+		}
+		healthy := func(err error) bool {
+			return err == nil
+		}
+		result, answered, ok := firstHealthy(ctx, s.primaryFirstRegions(ctx), read, healthy)
+		if ok {
+			s.reportDivergence(ctx, id, result.region, answered)
+			return result.region, result.value, nil
+		}
+		// no region has the parameter, so it is missing if any region says so
+		for _, region := range s.primaryFirstRegions(ctx) {
+			if err := answered[region].err; isParameterMissing(err) {
+				s.reportDivergence(ctx, id, region, answered)
+				return region, nil, err
+			}
+		}
+		failures := map[string]error{}
+		for region, result := range answered {
+			failures[region] = result.err
+		}
+		return s.primaryRegion(ctx), nil, &MultiRegionError{Operation: "read", Identifier: id, Errors: failures}
+	default:
+		regionalOutput, regionalErrors := s.readForAllRegions(ctx, paramName)
+		for _, region := range s.GetOrderedRegions() {
+			if err := regionalErrors[region]; err != nil {
+				return region, nil, err
+			}
+		}
+		region := s.primaryRegion(ctx)
+		return region, regionalOutput[region], nil
+	}
+}
+
+// primaryFirstRegions returns the ordered regions, with the primary region of the calls made with ctx moved to
+// the front
+func (s *ParameterStore) primaryFirstRegions(ctx context.Context) []string {
+	primary := s.primaryRegion(ctx)
+	regions := []string{primary}
+	for _, region := range s.GetOrderedRegions() {
+		if region != primary {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// primaryRegion gets the region the calls made with ctx read from when they read a single region: the region
+// they asked for with WithRegion, if the store has it, or else ParamRegion
+func (s *ParameterStore) primaryRegion(ctx context.Context) string {
+	if region := regionOf(ctx); region != "" {
+		if _, ok := s.ssmClients[region]; ok {
+			return region
+		}
+	}
+	return s.ParamRegion
+}
+
+// isParameterMissing says whether err means that a parameter, or the version or label of it that was read,
+// doesn't exist
+func isParameterMissing(err error) bool {
+	var pnf *types.ParameterNotFound
+	var pvnf *types.ParameterVersionNotFound
+	return errors.As(err, &pnf) || errors.As(err, &pvnf)
+}
+
+// reportDivergence reports how the regions that answered a read differ from region, the region the read was
+// served from: the regions that failed, and the regions with another version or value, or without the parameter
+func (s *ParameterStore) reportDivergence(ctx context.Context, id SecretIdentifier, region string, answered map[string]regionResult[*ssm.GetParameterOutput]) {
+	divergence := RegionDivergence{Identifier: id, Region: region, Errors: map[string]error{}, Versions: map[string]int{}}
+	version, value := parameterVersionAndValue(answered[region].value, answered[region].err)
+	for other, result := range answered {
+		if other == region {
+			continue
+		}
+		if result.err != nil && !isParameterMissing(result.err) {
+			divergence.Errors[other] = result.err
+			continue
+		}
+		if otherVersion, otherValue := parameterVersionAndValue(result.value, result.err); otherVersion != version || otherValue != value {
+			divergence.Versions[other] = otherVersion
+		}
+	}
+	if len(divergence.Errors) > 0 || len(divergence.Versions) > 0 {
+		s.notifyDivergence(ctx, divergence)
+	}
+}
+
+// notifyDivergence passes divergence to OnDivergence, or logs it if that isn't set
+func (s *ParameterStore) notifyDivergence(ctx context.Context, divergence RegionDivergence) {
+	if s.OnDivergence != nil {
+		s.OnDivergence(ctx, divergence)
+	} else {
+		logDivergence(ctx, divergence)
+	}
+}
+
+// parameterVersionAndValue returns the stealth version and value of a parameter that was read, or -1 if it
+// doesn't exist
+func parameterVersionAndValue(resp *ssm.GetParameterOutput, err error) (int, string) {
+	if err != nil || resp == nil || resp.Parameter == nil {
+		return -1, ""
+	}
+	return convertFromSSMVersion(int(resp.Parameter.Version)), aws.ToString(resp.Parameter.Value)
+}
+
+// trashNamespace is where ParameterStore keeps trashed secrets
+const trashNamespace = "/stealth-trash"
+
+// getTrashParamName converts a trashed secret to the parameter it is kept in,
+// e.g. /stealth-trash/development/oauth/foo-bar/1700000000 for a secret deleted at that unix time
+func getTrashParamName(trashed TrashedSecret) string {
+	return fmt.Sprintf("%s%s/%d", trashNamespace, getParamNameFromName(trashed.Identifier), trashed.DeletedAt.Unix())
+}
+
+// getTrashedSecretFromParamName converts from a trash parameter name back to the trashed secret
+func getTrashedSecretFromParamName(name string) (TrashedSecret, error) {
+	rest, ok := strings.CutPrefix(name, trashNamespace)
+	i := strings.LastIndex(rest, "/")
+	if !ok || i < 0 {
+		return TrashedSecret{}, fmt.Errorf("not a trash parameter: %s", name)
+	}
+	deletedAt, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return TrashedSecret{}, fmt.Errorf("not a trash parameter: %s", name)
+	}
+	id, err := getSecretIDFromParamName(rest[:i])
+	if err != nil {
+		return TrashedSecret{}, err
+	}
+	return TrashedSecret{Identifier: id, DeletedAt: time.Unix(deletedAt, 0).UTC()}, nil
+}
+
+// Trash moves a secret and its history into the trash. Every version is copied, in order and with its expiration,
+// tier and labels, to a parameter in the trash namespace in every region, and then the secret is deleted.
+func (s *ParameterStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	if err := id.Validate(); err != nil {
+		return TrashedSecret{}, err
+	}
+	name := getParamNameFromName(id)
+	history, err := s.getHistory(ctx, name)
+	if err != nil {
+		var pnf *types.ParameterNotFound
+		if errors.As(err, &pnf) {
+			return TrashedSecret{}, &IdentifierNotFoundError{Identifier: id, Region: s.primaryRegion(ctx)}
+		}
+		return TrashedSecret{}, err
+	}
+	trashed := TrashedSecret{Identifier: id, DeletedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := s.putHistory(ctx, id, getTrashParamName(trashed), history); err != nil {
+		return TrashedSecret{}, err
+	}
+	if err := s.deleteParameter(ctx, id, name); err != nil {
+		return TrashedSecret{}, fmt.Errorf("secret was copied to the trash as %s, but deleting it failed: %w", trashed, err)
+	}
+	return trashed, nil
+}
+
+// ListTrash gets the trashed secrets within an environment, oldest first
+func (s *ParameterStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	if !env.IsValid() {
+		return nil, fmt.Errorf("env %d is invalid", env)
+	}
+	results := []TrashedSecret{}
+	err := s.sweepPath(ctx, trashNamespace+getNamespace(env, ""), false, func(param types.Parameter) {
+		if trashed, err := getTrashedSecretFromParamName(*param.Name); err == nil {
+			results = append(results, trashed)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].DeletedAt.Before(results[j].DeletedAt) })
+	return results, nil
+}
+
+// Restore moves a trashed secret and its history back out of the trash
+func (s *ParameterStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	if err := trashed.Identifier.Validate(); err != nil {
+		return err
+	}
+	trashName := getTrashParamName(trashed)
+	history, err := s.getHistory(ctx, trashName)
+	if err != nil {
+		var pnf *types.ParameterNotFound
+		if errors.As(err, &pnf) {
+			return &TrashNotFoundError{Trashed: trashed}
+		}
+		return err
+	}
+	_, regionalErrors := s.readForAllRegions(ctx, getParamNameFromName(trashed.Identifier))
+	for _, err := range regionalErrors {
+		// the secret has been created again in some regions
+		if err == nil {
+			return &IdentifierAlreadyExistsError{Identifier: trashed.Identifier}
+		}
+	}
+	if err := s.putHistory(ctx, trashed.Identifier, getParamNameFromName(trashed.Identifier), history); err != nil {
+		return err
+	}
+	if err := s.deleteParameter(ctx, trashed.Identifier, trashName); err != nil {
+		return fmt.Errorf("secret was restored, but removing %s from the trash failed: %w", trashed, err)
+	}
+	return nil
+}
+
+// Purge permanently deletes a trashed secret
+func (s *ParameterStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	if err := trashed.Identifier.Validate(); err != nil {
+		return err
+	}
+	return s.deleteParameter(ctx, trashed.Identifier, getTrashParamName(trashed))
+}
+
+// getHistory reads every version of a parameter in the primary region, oldest first
+func (s *ParameterStore) getHistory(ctx context.Context, name string) ([]types.ParameterHistory, error) {
+	paginator := ssm.NewGetParameterHistoryPaginator(s.ssmClients[s.primaryRegion(ctx)], &ssm.GetParameterHistoryInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	history := []types.ParameterHistory{}
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		history = append(history, resp.Parameters...)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+	return history, nil
+}
+
+// putHistory writes history as successive versions of a new parameter in every region, keeping each version's
+// policies, tier and labels. If any write fails, the parameter is deleted again from the regions it was created in.
+func (s *ParameterStore) putHistory(ctx context.Context, id SecretIdentifier, name string, history []types.ParameterHistory) error {
+	var failure error
+	var createdRegions []string
 	orderedRegions := s.GetOrderedRegions()
 	for _, region := range orderedRegions {
 		regionClient := s.ssmClients[region]
-		resp, err := regionClient.GetParameter(context.TODO(), getParameterInput)
-		output[region] = resp
-		errors[region] = err
+		for i, version := range history {
+			putParameterInput := &ssm.PutParameterInput{
+				Name:      aws.String(name),
+				Overwrite: aws.Bool(i > 0), // only the first version creates the parameter
+				Type:      types.ParameterTypeSecureString,
+				Value:     version.Value,
+				Policies:  getPoliciesText(version.Policies),
+			}
+			if version.Tier == types.ParameterTierAdvanced {
+				putParameterInput.Tier = types.ParameterTierAdvanced
+			}
+			if i == 0 {
+				putParameterInput.Tags = getTagsFromName(id)
+			}
+			resp, err := regionClient.PutParameter(ctx, putParameterInput)
+			if err != nil && i > 0 {
+				// lets try one more time
+				resp, err = regionClient.PutParameter(ctx, putParameterInput)
+			}
+			if err == nil && i == 0 {
+				createdRegions = append(createdRegions, region)
+			}
+			if err == nil && len(version.Labels) > 0 {
+				_, err = regionClient.LabelParameterVersion(ctx, &ssm.LabelParameterVersionInput{
+					Name:             aws.String(name),
+					Labels:           version.Labels,
+					ParameterVersion: aws.Int64(resp.Version),
+				})
+			}
+			if err != nil {
+				var pae *types.ParameterAlreadyExists
+				if errors.As(err, &pae) {
+					failure = &IdentifierAlreadyExistsError{Identifier: id}
+				} else {
+					failure = fmt.Errorf("error writing %s in region %s: %w", name, region, err)
+				}
+				break
+			}
+		}
+		if failure != nil {
+			break
+		}
+	}
+
+	if failure != nil {
+		// the cleanup must run even if ctx was cancelled, otherwise regions are left inconsistent
+		cleanupCtx := context.WithoutCancel(ctx)
+		for _, region := range createdRegions {
+			regionClient := s.ssmClients[region]
+			if _, err := regionClient.DeleteParameter(cleanupCtx, &ssm.DeleteParameterInput{Name: aws.String(name)}); err != nil {
+				return fmt.Errorf("Error during cleanup of %s in region %s. try again. error: %w", name, region, err)
+			}
+		}
+	}
+	return failure
+}
+
+// getPoliciesText converts the policies a parameter version has back to the JSON PutParameter takes, or nil if it
+// has none
+func getPoliciesText(policies []types.ParameterInlinePolicy) *string {
+	if len(policies) == 0 {
+		return nil
+	}
+	texts := make([]string, len(policies))
+	for i, policy := range policies {
+		texts[i] = aws.ToString(policy.PolicyText)
+	}
+	return aws.String("[" + strings.Join(texts, ",") + "]")
+}
+
+// sleepContext pauses for the given duration, returning early with the context's error if it is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	return output, errors
 }
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// PolicyAction is a kind of operation a Policy allows or denies
+type PolicyAction string
+
+const (
+	// PolicyActionRead covers reading secrets' values and history
+	PolicyActionRead PolicyAction = "read"
+	// PolicyActionWrite covers creating, updating, labeling and restoring secrets
+	PolicyActionWrite PolicyAction = "write"
+	// PolicyActionDelete covers deleting secrets, moving them to the trash and purging the trash
+	PolicyActionDelete PolicyAction = "delete"
+	// PolicyActionList covers listing secrets, without reading their values
+	PolicyActionList PolicyAction = "list"
+)
+
+// PolicyEffect is whether a PolicyRule allows or denies the operations it matches
+type PolicyEffect string
+
+const (
+	// PolicyAllow allows an operation
+	PolicyAllow PolicyEffect = "allow"
+	// PolicyDeny denies an operation
+	PolicyDeny PolicyEffect = "deny"
+)
+
+// PolicyRule allows or denies the operations it matches. Every condition that is set must match; an unset
+// condition matches anything. Patterns are globs where * matches any run of characters, including slashes,
+// and ? matches one character.
+type PolicyRule struct {
+	Effect PolicyEffect `json:"effect"`
+	// Actions are the actions the rule matches
+	Actions []PolicyAction `json:"actions,omitempty"`
+	// Environments, Services and Keys are patterns for the secrets the rule matches. Listing a namespace has
+	// an empty key, so only rules without Keys, or with a * pattern, match it.
+	Environments []string `json:"environments,omitempty"`
+	Services     []string `json:"services,omitempty"`
+	Keys         []string `json:"keys,omitempty"`
+	// Principals are patterns for the ARN of the callers the rule matches
+	Principals []string `json:"principals,omitempty"`
+	// Roles are patterns for the role the callers the rule matches have assumed
+	Roles []string `json:"roles,omitempty"`
+	// Assumed matches callers that have (true) or haven't (false) assumed the environment's role, e.g. with --assume
+	Assumed *bool `json:"assumed,omitempty"`
+	// Reason explains a denial, and is attached to the AuthorizationError
+	Reason string `json:"reason,omitempty"`
+}
+
+// Policy allows or denies operations on secrets. Rules are evaluated in order and the first that matches an
+// operation decides it; operations no rule matches get the Default effect, which defaults to allow.
+//
+// For example, this policy requires --assume to delete production secrets, and makes the billing service read-only:
+//
+//	{"rules": [
+//	  {"effect": "deny", "actions": ["delete"], "environments": ["production"], "assumed": false,
+//	   "reason": "deleting production secrets requires --assume"},
+//	  {"effect": "deny", "actions": ["write", "delete"], "services": ["billing"], "reason": "billing is read-only"}
+//	]}
+type Policy struct {
+	Default PolicyEffect `json:"default,omitempty"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyCaller is who makes the calls a Policy is evaluated for
+type PolicyCaller struct {
+	Identity CallerIdentity
+	// Assumed is whether the caller has assumed the environment's role
+	Assumed bool
+}
+
+// PolicyRequest is an operation a Policy is evaluated for
+type PolicyRequest struct {
+	Action     PolicyAction
+	Identifier SecretIdentifier
+	Caller     PolicyCaller
+}
+
+// LoadPolicy reads a Policy from a JSON file
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse policy %s: %s", path, err)
+	}
+	return p, nil
+}
+
+// ParsePolicy parses and validates a Policy in JSON
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// a misspelled condition would otherwise silently match everything
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = PolicyAllow
+	}
+	if p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return nil, fmt.Errorf("invalid default effect %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+			return nil, fmt.Errorf("rule %d: invalid effect %q", i+1, rule.Effect)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case PolicyActionRead, PolicyActionWrite, PolicyActionDelete, PolicyActionList:
+			default:
+				return nil, fmt.Errorf("rule %d: invalid action %q", i+1, action)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// UsesIdentity checks if any rule matches on the caller's identity, which then needs to be looked up
+func (p *Policy) UsesIdentity() bool {
+	for _, rule := range p.Rules {
+		if len(rule.Principals) > 0 || len(rule.Roles) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize evaluates the policy for an operation, returning an AuthorizationError with the reason if it is denied
+func (p *Policy) Authorize(req PolicyRequest) error {
+	for i, rule := range p.Rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Effect == PolicyAllow {
+			return nil
+		}
+		reason := rule.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("%s denied by policy rule %d", req.Action, i+1)
+		}
+		return &AuthorizationError{Identifier: req.Identifier, Reason: reason}
+	}
+	if p.Default == PolicyDeny {
+		return &AuthorizationError{Identifier: req.Identifier, Reason: fmt.Sprintf("%s not allowed by any policy rule", req.Action)}
+	}
+	return nil
+}
+
+// matches checks if every condition of the rule matches an operation
+func (r PolicyRule) matches(req PolicyRequest) bool {
+	if len(r.Actions) > 0 && !containsAction(r.Actions, req.Action) {
+		return false
+	}
+	if r.Assumed != nil && *r.Assumed != req.Caller.Assumed {
+		return false
+	}
+	return matchesAny(r.Environments, req.Identifier.EnvironmentString()) &&
+		matchesAny(r.Services, req.Identifier.Service) &&
+		matchesAny(r.Keys, req.Identifier.Key) &&
+		matchesAny(r.Principals, req.Caller.Identity.ARN) &&
+		matchesAny(r.Roles, req.Caller.Identity.Role)
+}
+
+// containsAction checks if actions includes action
+func containsAction(actions []PolicyAction, action PolicyAction) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny checks if s matches any of the patterns, or if there are no patterns
+func matchesAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if globMatch(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch checks if s matches a glob, where * matches any run of characters and ? matches one
+func globMatch(pattern, s string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String()).MatchString(s)
+}
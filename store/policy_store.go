@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// PolicyStore wraps a store to allow or deny each operation according to a Policy. Denied operations fail with
+// an AuthorizationError whose Reason explains the denial, without reaching the wrapped store. Secrets the policy
+// doesn't allow listing are left out of listings.
+//
+// PolicyStore implements BatchReader, PrefixLister, ServiceReader, ConditionalUpdater and ExpirationLister,
+// falling back like the package's helpers when the wrapped store doesn't. It also implements TrashStore, Labeler
+// and ExpiringWriter, whose calls fail with an UnsupportedError when the wrapped store doesn't implement them;
+// check with Implements. Calls made through Unwrap aren't checked.
+type PolicyStore struct {
+	store  ContextSecretStore
+	policy *Policy
+	caller PolicyCaller
+}
+
+// NewPolicyStore wraps a store to enforce a policy for the calls caller makes
+func NewPolicyStore(s ContextSecretStore, policy *Policy, caller PolicyCaller) *PolicyStore {
+	return &PolicyStore{store: s, policy: policy, caller: caller}
+}
+
+// Unwrap returns the wrapped store
+func (s *PolicyStore) Unwrap() ContextSecretStore {
+	return s.store
+}
+
+// Authorize checks if the policy allows an action on a secret. For an action on a whole namespace, leave the
+// identifier's Key (and Service, for a whole environment) empty.
+func (s *PolicyStore) Authorize(action PolicyAction, id SecretIdentifier) error {
+	return s.policy.Authorize(PolicyRequest{Action: action, Identifier: id, Caller: s.caller})
+}
+
+// filterListable keeps the identifiers the policy allows listing
+func (s *PolicyStore) filterListable(ids []SecretIdentifier) []SecretIdentifier {
+	results := []SecretIdentifier{}
+	for _, id := range ids {
+		if s.Authorize(PolicyActionList, id) == nil {
+			results = append(results, id)
+		}
+	}
+	return results
+}
+
+// Create creates a Secret in the wrapped store, if the policy allows writing it
+func (s *PolicyStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return err
+	}
+	return s.store.Create(ctx, id, value)
+}
+
+// Read reads the latest version of a Secret from the wrapped store, if the policy allows reading it
+func (s *PolicyStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := s.Authorize(PolicyActionRead, id); err != nil {
+		return Secret{}, err
+	}
+	return s.store.Read(ctx, id)
+}
+
+// ReadVersion reads a specific version of a Secret from the wrapped store, if the policy allows reading it
+func (s *PolicyStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := s.Authorize(PolicyActionRead, id); err != nil {
+		return Secret{}, err
+	}
+	return s.store.ReadVersion(ctx, id, version)
+}
+
+// ReadMany reads the latest version of each secret from the wrapped store, if the policy allows reading all of them
+func (s *PolicyStore) ReadMany(ctx context.Context, ids []SecretIdentifier) (map[SecretIdentifier]Secret, error) {
+	for _, id := range ids {
+		if err := s.Authorize(PolicyActionRead, id); err != nil {
+			return nil, err
+		}
+	}
+	return ReadMany(ctx, s.store, ids)
+}
+
+// Update updates a Secret in the wrapped store, if the policy allows writing it
+func (s *PolicyStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return Secret{}, err
+	}
+	return s.store.Update(ctx, id, value)
+}
+
+// UpdateIfVersion updates a Secret in the wrapped store if it is at expectedVersion, if the policy allows writing it
+func (s *PolicyStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return Secret{}, err
+	}
+	return UpdateIfVersion(ctx, s.store, id, expectedVersion, value)
+}
+
+// List gets the secrets within a namespace that the policy allows listing from the wrapped store
+func (s *PolicyStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	if err := s.Authorize(PolicyActionList, SecretIdentifier{Environment: env, Service: service}); err != nil {
+		return nil, err
+	}
+	ids, err := s.store.List(ctx, env, service)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterListable(ids), nil
+}
+
+// ListPrefix gets the secrets within a namespace whose keys start with prefix, and that the policy allows
+// listing, from the wrapped store
+func (s *PolicyStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	if err := s.Authorize(PolicyActionList, SecretIdentifier{Environment: env, Service: service}); err != nil {
+		return nil, err
+	}
+	ids, err := ListPrefix(ctx, s.store, env, service, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterListable(ids), nil
+}
+
+// ReadService reads every secret within a namespace from the wrapped store, if the policy allows reading all of them
+func (s *PolicyStore) ReadService(ctx context.Context, env Environment, service string) (map[SecretIdentifier]Secret, error) {
+	if err := s.Authorize(PolicyActionRead, SecretIdentifier{Environment: env, Service: service}); err != nil {
+		return nil, err
+	}
+	secrets, err := ReadService(ctx, s.store, env, service)
+	if err != nil {
+		return nil, err
+	}
+	for id := range secrets {
+		if err := s.Authorize(PolicyActionRead, id); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+// ListAll gets the secrets within an environment that the policy allows listing from the wrapped store
+func (s *PolicyStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	if err := s.Authorize(PolicyActionList, SecretIdentifier{Environment: env}); err != nil {
+		return nil, err
+	}
+	ids, err := s.store.ListAll(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterListable(ids), nil
+}
+
+// History gets the history of a Secret from the wrapped store, if the policy allows reading it
+func (s *PolicyStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := s.Authorize(PolicyActionRead, id); err != nil {
+		return nil, err
+	}
+	return s.store.History(ctx, id)
+}
+
+// Delete deletes all versions of a Secret from the wrapped store, if the policy allows deleting it
+func (s *PolicyStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := s.Authorize(PolicyActionDelete, id); err != nil {
+		return err
+	}
+	return s.store.Delete(ctx, id)
+}
+
+// CreateWithExpiration creates a Secret that expires in the wrapped store, if the policy allows writing it
+func (s *PolicyStore) CreateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) error {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return err
+	}
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	if err != nil {
+		return err
+	}
+	return writer.CreateWithExpiration(ctx, id, value, expiration)
+}
+
+// UpdateWithExpiration updates a Secret in the wrapped store and makes it expire, if the policy allows writing it
+func (s *PolicyStore) UpdateWithExpiration(ctx context.Context, id SecretIdentifier, value string, expiration time.Time) (Secret, error) {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return Secret{}, err
+	}
+	writer, err := optionalInterface[ExpiringWriter](s.store, "ExpiringWriter")
+	if err != nil {
+		return Secret{}, err
+	}
+	return writer.UpdateWithExpiration(ctx, id, value, expiration)
+}
+
+// ListExpiring gets the secrets within an environment that expire before cutoff, and that the policy allows
+// listing, from the wrapped store
+func (s *PolicyStore) ListExpiring(ctx context.Context, env Environment, cutoff time.Time) ([]ExpiringSecret, error) {
+	if err := s.Authorize(PolicyActionList, SecretIdentifier{Environment: env}); err != nil {
+		return nil, err
+	}
+	expiring, err := ListExpiring(ctx, s.store, env, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	results := []ExpiringSecret{}
+	for _, e := range expiring {
+		if s.Authorize(PolicyActionList, e.Identifier) == nil {
+			results = append(results, e)
+		}
+	}
+	return results, nil
+}
+
+// Label attaches a label to a version of a Secret in the wrapped store, if the policy allows writing it
+func (s *PolicyStore) Label(ctx context.Context, id SecretIdentifier, version int, label string) error {
+	if err := s.Authorize(PolicyActionWrite, id); err != nil {
+		return err
+	}
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	if err != nil {
+		return err
+	}
+	return labeler.Label(ctx, id, version, label)
+}
+
+// ReadLabel reads the version of a Secret a label is attached to from the wrapped store, if the policy allows
+// reading it
+func (s *PolicyStore) ReadLabel(ctx context.Context, id SecretIdentifier, label string) (Secret, error) {
+	if err := s.Authorize(PolicyActionRead, id); err != nil {
+		return Secret{}, err
+	}
+	labeler, err := optionalInterface[Labeler](s.store, "Labeler")
+	if err != nil {
+		return Secret{}, err
+	}
+	return labeler.ReadLabel(ctx, id, label)
+}
+
+// Trash moves a Secret into the trash of the wrapped store, if the policy allows deleting it
+func (s *PolicyStore) Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error) {
+	if err := s.Authorize(PolicyActionDelete, id); err != nil {
+		return TrashedSecret{}, err
+	}
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return TrashedSecret{}, err
+	}
+	return trash.Trash(ctx, id)
+}
+
+// ListTrash gets the trashed secrets within an environment that the policy allows listing from the wrapped store
+func (s *PolicyStore) ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error) {
+	if err := s.Authorize(PolicyActionList, SecretIdentifier{Environment: env}); err != nil {
+		return nil, err
+	}
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return nil, err
+	}
+	trashed, err := trash.ListTrash(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	results := []TrashedSecret{}
+	for _, t := range trashed {
+		if s.Authorize(PolicyActionList, t.Identifier) == nil {
+			results = append(results, t)
+		}
+	}
+	return results, nil
+}
+
+// Restore moves a trashed secret out of the trash of the wrapped store, if the policy allows writing it
+func (s *PolicyStore) Restore(ctx context.Context, trashed TrashedSecret) error {
+	if err := s.Authorize(PolicyActionWrite, trashed.Identifier); err != nil {
+		return err
+	}
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return err
+	}
+	return trash.Restore(ctx, trashed)
+}
+
+// Purge permanently deletes a trashed secret from the wrapped store, if the policy allows deleting it
+func (s *PolicyStore) Purge(ctx context.Context, trashed TrashedSecret) error {
+	if err := s.Authorize(PolicyActionDelete, trashed.Identifier); err != nil {
+		return err
+	}
+	trash, err := optionalInterface[TrashStore](s.store, "TrashStore")
+	if err != nil {
+		return err
+	}
+	return trash.Purge(ctx, trashed)
+}
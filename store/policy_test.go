@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{"rules": [
+  {"effect": "allow", "actions": ["delete"], "environments": ["production"], "principals": ["arn:aws:iam::*:user/admin"]},
+  {"effect": "deny", "actions": ["delete"], "environments": ["production"], "assumed": false,
+   "reason": "deleting production secrets requires --assume"},
+  {"effect": "deny", "actions": ["write", "delete"], "services": ["billing"], "reason": "billing is read-only"},
+  {"effect": "deny", "actions": ["read", "list"], "keys": ["private/*"]}
+]}`
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NoError(t, err)
+	assert.True(t, p.UsesIdentity())
+	prod := SecretIdentifier{Environment: ProductionEnvironment, Service: "api", Key: "db/password"}
+	dev := SecretIdentifier{Environment: DevelopmentEnvironment, Service: "api", Key: "db/password"}
+	billing := SecretIdentifier{Environment: DevelopmentEnvironment, Service: "billing", Key: "token"}
+	private := SecretIdentifier{Environment: DevelopmentEnvironment, Service: "api", Key: "private/nested/key"}
+	user := PolicyCaller{Identity: CallerIdentity{ARN: "arn:aws:iam::123456789012:user/jane"}}
+	assumed := PolicyCaller{Identity: CallerIdentity{ARN: "arn:aws:sts::123456789012:assumed-role/SecretsManagement/jane"}, Assumed: true}
+	admin := PolicyCaller{Identity: CallerIdentity{ARN: "arn:aws:iam::123456789012:user/admin"}}
+
+	t.Log("the first matching rule decides, and denials carry the rule's reason")
+	err = p.Authorize(PolicyRequest{Action: PolicyActionDelete, Identifier: prod, Caller: user})
+	assert.Equal(t, err, &AuthorizationError{Identifier: prod, Reason: "deleting production secrets requires --assume"})
+	assert.NoError(t, p.Authorize(PolicyRequest{Action: PolicyActionDelete, Identifier: prod, Caller: assumed}))
+	assert.NoError(t, p.Authorize(PolicyRequest{Action: PolicyActionDelete, Identifier: prod, Caller: admin}))
+	assert.NoError(t, p.Authorize(PolicyRequest{Action: PolicyActionDelete, Identifier: dev, Caller: user}))
+	assert.NoError(t, p.Authorize(PolicyRequest{Action: PolicyActionRead, Identifier: billing, Caller: user}))
+	err = p.Authorize(PolicyRequest{Action: PolicyActionWrite, Identifier: billing, Caller: assumed})
+	assert.Equal(t, err.(*AuthorizationError).Reason, "billing is read-only")
+
+	t.Log("* matches across slashes, and rules without a reason get one")
+	err = p.Authorize(PolicyRequest{Action: PolicyActionRead, Identifier: private, Caller: user})
+	assert.Equal(t, err.(*AuthorizationError).Reason, "read denied by policy rule 4")
+
+	t.Log("operations no rule matches get the default effect")
+	p, err = ParsePolicy([]byte(`{"default": "deny", "rules": [{"effect": "allow", "actions": ["read"]}]}`))
+	assert.NoError(t, err)
+	assert.False(t, p.UsesIdentity())
+	assert.NoError(t, p.Authorize(PolicyRequest{Action: PolicyActionRead, Identifier: dev}))
+	assert.IsType(t, &AuthorizationError{}, p.Authorize(PolicyRequest{Action: PolicyActionWrite, Identifier: dev}))
+
+	t.Log("invalid policies are rejected")
+	for _, invalid := range []string{
+		`{"default": "maybe", "rules": []}`,
+		`{"rules": [{"effect": "permit"}]}`,
+		`{"rules": [{"effect": "deny", "actions": ["destroy"]}]}`,
+		`{"rules": [{"effect": "deny", "service": ["billing"]}]}`,
+	} {
+		_, err := ParsePolicy([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPolicyStore(t *testing.T) {
+	ctx := context.Background()
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NoError(t, err)
+	inner := NewMemoryStore()
+	s := NewPolicyStore(inner, p, PolicyCaller{})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "api", Key: "foo"}
+	private := SecretIdentifier{Environment: CITestEnvironment, Service: "api", Key: "private/foo"}
+	billing := SecretIdentifier{Environment: CITestEnvironment, Service: "billing", Key: "foo"}
+	assert.NoError(t, inner.Create(ctx, id, "bar"))
+	assert.NoError(t, inner.Create(ctx, private, "bar"))
+	assert.NoError(t, inner.Create(ctx, billing, "bar"))
+
+	t.Log("denied operations fail without reaching the wrapped store")
+	_, err = s.Update(ctx, billing, "baz")
+	assert.IsType(t, &AuthorizationError{}, err)
+	assert.NoError(t, s.Delete(ctx, id))
+	secret, err := inner.Read(ctx, billing)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 0)
+
+	t.Log("secrets the policy doesn't allow listing are left out of listings, and can't be read in bulk")
+	ids, err := s.List(ctx, CITestEnvironment, "api")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	ids, err = s.ListAll(ctx, CITestEnvironment)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{billing})
+	_, err = ReadService(ctx, s, CITestEnvironment, "api")
+	assert.IsType(t, &AuthorizationError{}, err)
+	_, err = ReadMany(ctx, s, []SecretIdentifier{billing, private})
+	assert.IsType(t, &AuthorizationError{}, err)
+}
+
+func TestPolicyStoreOptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NoError(t, err)
+	inner := NewMemoryStore()
+	s := NewPolicyStore(inner, p, PolicyCaller{})
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "api", Key: "foo"}
+	private := SecretIdentifier{Environment: CITestEnvironment, Service: "api", Key: "private/foo"}
+	billing := SecretIdentifier{Environment: CITestEnvironment, Service: "billing", Key: "foo"}
+	expiration := time.Now().Add(time.Hour)
+	assert.NoError(t, inner.CreateWithExpiration(ctx, id, "bar", expiration))
+	assert.NoError(t, inner.CreateWithExpiration(ctx, private, "bar", expiration))
+	assert.NoError(t, inner.Create(ctx, billing, "bar"))
+	assert.True(t, Implements[TrashStore](s))
+
+	t.Log("labels and expiring writes are checked for each secret")
+	assert.IsType(t, &AuthorizationError{}, s.Label(ctx, billing, 0, "stable"))
+	assert.NoError(t, s.Label(ctx, id, 0, "stable"))
+	assert.NoError(t, inner.Label(ctx, private, 0, "stable"))
+	_, err = s.ReadLabel(ctx, private, "stable")
+	assert.IsType(t, &AuthorizationError{}, err)
+	_, err = s.UpdateWithExpiration(ctx, billing, "baz", expiration)
+	assert.IsType(t, &AuthorizationError{}, err)
+
+	t.Log("secrets the policy doesn't allow listing are left out of the expiring secrets and the trash")
+	expiring, err := s.ListExpiring(ctx, CITestEnvironment, expiration.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, expiring, 1)
+	assert.Equal(t, expiring[0].Identifier, id)
+	_, err = s.Trash(ctx, billing)
+	assert.IsType(t, &AuthorizationError{}, err)
+	_, err = inner.Trash(ctx, private)
+	assert.NoError(t, err)
+	billingTrashed, err := inner.Trash(ctx, billing)
+	assert.NoError(t, err)
+	trashed, err := s.Trash(ctx, id)
+	assert.NoError(t, err)
+	listed, err := s.ListTrash(ctx, CITestEnvironment)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, listed, []TrashedSecret{trashed, billingTrashed})
+
+	t.Log("restoring and purging are checked for each trashed secret")
+	assert.IsType(t, &AuthorizationError{}, s.Restore(ctx, billingTrashed))
+	assert.IsType(t, &AuthorizationError{}, s.Purge(ctx, billingTrashed))
+	assert.NoError(t, s.Restore(ctx, trashed))
+
+	t.Log("calls the wrapped store doesn't support fail")
+	s = NewPolicyStore(NewMockStore(), p, PolicyCaller{})
+	assert.False(t, Implements[TrashStore](s))
+	_, err = s.ListTrash(ctx, CITestEnvironment)
+	assert.IsType(t, &UnsupportedError{}, err)
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	// DefaultRequestsPerSecond is the sustained rate of requests RateLimiter allows in each region, which is
+	// Parameter Store's default throughput quota
+	DefaultRequestsPerSecond = 40
+	// DefaultMaxRetries is how many times a throttled request is retried, unless configured otherwise
+	DefaultMaxRetries = 5
+	// DefaultBaseBackoff is the backoff before the first retry, which doubles for each retry after it
+	DefaultBaseBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff caps the backoff between retries
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// RateLimitConfig configures a RateLimiter
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of requests allowed in each region. Defaults to
+	// DefaultRequestsPerSecond; a negative value turns off rate limiting.
+	RequestsPerSecond float64
+	// Burst is how many requests can be made at once in a region after it has been idle. Defaults to one
+	// second's worth of requests.
+	Burst int
+	// MaxRetries is how many times a request that was throttled, or failed with another transient error, is
+	// retried. Defaults to DefaultMaxRetries; a negative value turns off retries.
+	MaxRetries int
+	// BaseBackoff and MaxBackoff bound the exponential backoff between retries, which is jittered so that
+	// concurrent requests don't retry in lockstep. Default to DefaultBaseBackoff and DefaultMaxBackoff.
+	BaseBackoff, MaxBackoff time.Duration
+}
+
+// RateLimiter paces requests with a separate token bucket for each region, and retries throttled requests
+// with exponential backoff. A RateLimiter can be shared by any number of stores, which then share its budgets.
+type RateLimiter struct {
+	config RateLimitConfig
+	// now is the clock, which tests replace
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket is a region's budget of requests
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// defaultRateLimiter is shared by the stores that aren't given a RateLimiter, so that they share each region's budget
+var defaultRateLimiter = NewRateLimiter(RateLimitConfig{})
+
+// NewRateLimiter creates a RateLimiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.RequestsPerSecond == 0 {
+		config.RequestsPerSecond = DefaultRequestsPerSecond
+	}
+	if config.Burst <= 0 {
+		config.Burst = max(1, int(config.RequestsPerSecond))
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.BaseBackoff <= 0 {
+		config.BaseBackoff = DefaultBaseBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	return &RateLimiter{config: config, now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+// Wait blocks until a request may be made in region. It returns early with the context's error if ctx is cancelled.
+func (l *RateLimiter) Wait(ctx context.Context, region string) error {
+	if l.config.RequestsPerSecond < 0 {
+		return ctx.Err()
+	}
+	if delay := l.reserve(region); delay > 0 {
+		return sleepContext(ctx, delay)
+	}
+	return ctx.Err()
+}
+
+// reserve takes a token from region's bucket, and returns how long to wait until the token is available
+func (l *RateLimiter) reserve(region string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	bucket, ok := l.buckets[region]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.config.Burst), last: now}
+		l.buckets[region] = bucket
+	}
+	bucket.tokens = min(float64(l.config.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.RequestsPerSecond)
+	bucket.last = now
+	// the token is taken even if it isn't there yet, which queues requests behind each other
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / l.config.RequestsPerSecond * float64(time.Second))
+}
+
+// Backoff returns how long to wait before retry number attempt (starting at 1): a random duration up to
+// BaseBackoff doubled for each earlier retry, capped at MaxBackoff
+func (l *RateLimiter) Backoff(attempt int) time.Duration {
+	backoff := l.config.MaxBackoff
+	if attempt < 32 {
+		backoff = min(backoff, l.config.BaseBackoff<<(attempt-1))
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// ssmOptions makes an SSM client in region wait for the rate limiter before every attempt of a request, and
+// retry throttled requests with the limiter's backoff instead of the SDK's
+func (l *RateLimiter) ssmOptions(region string) func(*ssm.Options) {
+	return func(o *ssm.Options) {
+		o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+			so.MaxAttempts = l.config.MaxRetries + 1
+			so.MaxBackoff = l.config.MaxBackoff
+			so.Backoff = retry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) {
+				return l.Backoff(attempt), nil
+			})
+			// the limiter paces requests, so the SDK's own retry quota would only make bulk operations fail
+			so.RateLimiter = ratelimit.None
+		})
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			// after Retry, so that every attempt waits for the limiter
+			return stack.Finalize.Insert(rateLimitMiddleware{limiter: l, region: region}, "Retry", middleware.After)
+		})
+	}
+}
+
+// rateLimitMiddleware waits for a RateLimiter before a request is sent
+type rateLimitMiddleware struct {
+	limiter *RateLimiter
+	region  string
+}
+
+// ID identifies the middleware in the SDK's middleware stack
+func (m rateLimitMiddleware) ID() string {
+	return "StealthRateLimit"
+}
+
+// HandleFinalize waits for the rate limiter, then sends the request
+func (m rateLimitMiddleware) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	if err := m.limiter.Wait(ctx, m.region); err != nil {
+		return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+	}
+	return next.HandleFinalize(ctx, in)
+}
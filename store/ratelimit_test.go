@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{RequestsPerSecond: 10, Burst: 2})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	t.Log("requests up to the burst go straight through, and the rest are queued at the rate")
+	assert.Equal(t, l.reserve("us-west-1"), time.Duration(0))
+	assert.Equal(t, l.reserve("us-west-1"), time.Duration(0))
+	assert.Equal(t, l.reserve("us-west-1"), 100*time.Millisecond)
+	assert.Equal(t, l.reserve("us-west-1"), 200*time.Millisecond)
+
+	t.Log("each region has its own budget")
+	assert.Equal(t, l.reserve("us-east-1"), time.Duration(0))
+
+	t.Log("the budget refills over time, up to the burst")
+	now = now.Add(time.Minute)
+	assert.Equal(t, l.reserve("us-west-1"), time.Duration(0))
+	assert.Equal(t, l.reserve("us-west-1"), time.Duration(0))
+	assert.Equal(t, l.reserve("us-west-1"), 100*time.Millisecond)
+
+	t.Log("waiting stops when the context is cancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, l.Wait(ctx, "us-west-1"), context.Canceled)
+	assert.NoError(t, NewRateLimiter(RateLimitConfig{RequestsPerSecond: -1}).Wait(context.Background(), "us-west-1"))
+}
+
+func TestRateLimiterBackoff(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, l.Backoff(1), 100*time.Millisecond)
+		assert.LessOrEqual(t, l.Backoff(3), 400*time.Millisecond)
+		assert.LessOrEqual(t, l.Backoff(100), time.Second)
+	}
+}
+
+// throttlingSSM is a stand-in for the SSM API that throttles the first requests it gets
+type throttlingSSM struct {
+	mu       sync.Mutex
+	throttle int
+	requests int
+}
+
+func (f *throttlingSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if f.requests <= f.throttle {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+		return
+	}
+	fmt.Fprint(w, `{"Parameter":{"Name":"/ci-test/foo/bar","Value":"baz","Version":1}}`)
+}
+
+func TestRateLimiterRetriesThrottling(t *testing.T) {
+	fake := &throttlingSSM{throttle: 3}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	newClient := func(l *RateLimiter) *ssm.Client {
+		return ssm.New(ssm.Options{
+			Region:       "us-west-1",
+			Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+			BaseEndpoint: aws.String(server.URL),
+		}, l.ssmOptions("us-west-1"))
+	}
+	input := &ssm.GetParameterInput{Name: aws.String("/ci-test/foo/bar")}
+
+	t.Log("throttled requests are retried with backoff until they succeed")
+	l := NewRateLimiter(RateLimitConfig{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	resp, err := newClient(l).GetParameter(context.Background(), input)
+	assert.NoError(t, err)
+	assert.Equal(t, *resp.Parameter.Value, "baz")
+	assert.Equal(t, fake.requests, 4)
+
+	t.Log("requests fail once the retries run out")
+	fake.requests = 0
+	l = NewRateLimiter(RateLimitConfig{MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	_, err = newClient(l).GetParameter(context.Background(), input)
+	assert.ErrorContains(t, err, "ThrottlingException")
+	assert.Equal(t, fake.requests, 3)
+}
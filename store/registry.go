@@ -0,0 +1,73 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a secret store from a store URL, such as ssm://?env=production or memory://
+type Factory func(u *url.URL) (ContextSecretStore, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a secret store backend available to Open under the given URL scheme.
+// It panics if factory is nil or if a backend is already registered for the scheme.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if factory == nil {
+		panic("store: Register factory is nil for scheme " + scheme)
+	}
+	if _, dup := factories[scheme]; dup {
+		panic("store: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Schemes returns a sorted list of the URL schemes of the registered backends
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates a secret store from a URL. The scheme selects the backend (e.g. ssm://, memory://),
+// and the rest of the URL is interpreted by that backend's Factory.
+func Open(rawURL string) (ContextSecretStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL %q: %s", rawURL, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("invalid store URL %q: missing scheme, expected one of %s", rawURL, strings.Join(Schemes(), ", "))
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[strings.ToLower(u.Scheme)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, &UnknownStoreSchemeError{Scheme: u.Scheme}
+	}
+	return factory(u)
+}
+
+// UnknownStoreSchemeError occurs when Open is called with a URL scheme that has no registered backend
+type UnknownStoreSchemeError struct {
+	Scheme string
+}
+
+func (e *UnknownStoreSchemeError) Error() string {
+	return fmt.Sprintf("no secret store registered for scheme %q, expected one of %s", e.Scheme, strings.Join(Schemes(), ", "))
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("memory:// opens a new, empty store every time")
+	s1, err := Open("memory://")
+	assert.NoError(t, err)
+	assert.NoError(t, s1.Create(ctx, id, "bar"))
+	s2, err := Open("memory://")
+	assert.NoError(t, err)
+	_, err = s2.Read(ctx, id)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+
+	t.Log("memory://name shares one store per name")
+	named1, err := Open("memory://" + id.Service)
+	assert.NoError(t, err)
+	assert.NoError(t, named1.Create(ctx, id, "bar"))
+	named2, err := Open("memory://" + id.Service + "?env=production")
+	assert.NoError(t, err)
+	secret, err := named2.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("errors on unknown schemes and URLs without a scheme")
+	_, err = Open("bogus://")
+	assert.Equal(t, err, &UnknownStoreSchemeError{Scheme: "bogus"})
+	_, err = Open("just-a-path")
+	assert.Error(t, err)
+}
+
+func TestRegister(t *testing.T) {
+	scheme := "test-" + strings.ToLower(randSeq(8))
+	var opened *url.URL
+	Register(scheme, func(u *url.URL) (ContextSecretStore, error) {
+		opened = u
+		return NewMockStore(), nil
+	})
+	assert.Contains(t, Schemes(), scheme)
+
+	t.Log("Open passes the parsed URL to the factory")
+	s, err := Open(scheme + "://host/path?a=b")
+	assert.NoError(t, err)
+	assert.Equal(t, s, NewMockStore())
+	assert.Equal(t, opened.Host, "host")
+	assert.Equal(t, opened.Path, "/path")
+	assert.Equal(t, opened.Query().Get("a"), "b")
+
+	t.Log("registering a scheme twice panics")
+	assert.Panics(t, func() {
+		Register(scheme, func(u *url.URL) (ContextSecretStore, error) { return NewMockStore(), nil })
+	})
+}
@@ -0,0 +1,529 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretsManagerCurrentStage is the staging label Secrets Manager returns by default
+	secretsManagerCurrentStage = "AWSCURRENT"
+	// secretsManagerVersionIDPrefix prefixes the version IDs that record a version's 0-indexed stealth version
+	secretsManagerVersionIDPrefix = "stealth-v"
+)
+
+func init() {
+	Register("secretsmanager", openSecretsManagerStore)
+}
+
+// openSecretsManagerStore creates a SecretsManagerStore from a URL of the form
+// secretsmanager://?env=production&assume=true&region=us-west-1&endpoint=http://localhost:4566.
+// All query parameters are optional; endpoint points every region at a local stand-in.
+func openSecretsManagerStore(u *url.URL) (ContextSecretStore, error) {
+	query := u.Query()
+	assume := false
+	if v := query.Get("assume"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assume for secretsmanager store: %s", v)
+		}
+		assume = b
+	}
+	s := NewSecretsManagerStore(query.Get("env"), assume, query.Get("endpoint"))
+	if region := query.Get("region"); region != "" {
+		if _, ok := s.clients[region]; !ok {
+			return nil, fmt.Errorf("invalid region for secretsmanager store: %s", region)
+		}
+		s.SecretRegion = region
+	}
+	return s, nil
+}
+
+// getSecretsManagerName converts from development.oauth.foo-bar to development/oauth/foo-bar
+func getSecretsManagerName(id SecretIdentifier) string {
+	return fmt.Sprintf("%s/%s/%s", id.Environment.pathPrefix(), id.Service, id.Key)
+}
+
+// getSecretIDFromSecretsManagerName converts from development/oauth/foo-bar to SecretIdentifier development.oauth.foo-bar
+func getSecretIDFromSecretsManagerName(name string) (SecretIdentifier, error) {
+	env, rest, ok := environmentFromPath(name)
+	if !ok {
+		return SecretIdentifier{}, &InvalidEnvironmentError{Identifier: name}
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 {
+		return SecretIdentifier{}, fmt.Errorf("unable to create SecretIdentifier from secret name: %s", name)
+	}
+	return SecretIdentifier{Environment: env, Service: parts[0], Key: parts[1]}, nil
+}
+
+// newSecretsManagerVersionID returns a new version ID recording a 0-indexed version, e.g.
+// stealth-v0000000003-<random hex>. It is passed as the ClientRequestToken of a write, which makes it the ID of
+// the version written. The random part keeps the IDs of versions that were reverted and written again unique.
+func newSecretsManagerVersionID(version int) string {
+	suffix := make([]byte, 16)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s%010d-%x", secretsManagerVersionIDPrefix, version, suffix)
+}
+
+// getVersionFromSecretsManagerVersionID finds the stealth version recorded in a version ID
+func getVersionFromSecretsManagerVersionID(versionID string) (int, bool) {
+	rest, ok := strings.CutPrefix(versionID, secretsManagerVersionIDPrefix)
+	if !ok {
+		return 0, false
+	}
+	digits, _, _ := strings.Cut(rest, "-")
+	version, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// getSecretsManagerTags takes the SecretIdentifier id and returns the secret's Tags
+func getSecretsManagerTags(id SecretIdentifier) []types.Tag {
+	return []types.Tag{
+		{Key: aws.String("environment"), Value: aws.String(id.EnvironmentString())},
+		{Key: aws.String("application"), Value: aws.String(id.Service)},
+		{Key: aws.String("key"), Value: aws.String(id.Key)},
+	}
+}
+
+// convertSecretsManagerError maps Secrets Manager errors onto the store's errors
+func convertSecretsManagerError(id SecretIdentifier, region string, err error) error {
+	var rnf *types.ResourceNotFoundException
+	var ree *types.ResourceExistsException
+	var apiErr smithy.APIError
+	if errors.As(err, &rnf) {
+		return &IdentifierNotFoundError{Identifier: id, Region: region}
+	} else if errors.As(err, &ree) {
+		return &IdentifierAlreadyExistsError{Identifier: id}
+	} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDeniedException" {
+		return &AuthorizationError{Identifier: id}
+	}
+	return fmt.Errorf("SecretsManager error: %w", err)
+}
+
+// SecretsManagerStore is a secret store that uses AWS Secrets Manager.
+// Secrets are named env/service/key, and every stealth version is a Secrets Manager version whose version ID
+// records the stealth version. Only the latest version carries a staging label (AWSCURRENT), since Secrets
+// Manager limits how many staging labels a secret has. Like ParameterStore, every write goes to all regions or
+// none of them.
+type SecretsManagerStore struct {
+	SecretRegion string
+	// RegionParallelism bounds how many regions are called at once when writing every region.
+	// Defaults to DefaultRegionParallelism; 1 calls one region at a time.
+	RegionParallelism int
+	clients           map[string]*secretsmanager.Client
+	regions           []string
+	env               string
+	assume            bool
+}
+
+// NewSecretsManagerStore creates a secret store that points at Secrets Manager.
+// If endpoint is set, every region's client sends requests to it instead of AWS, e.g. for a local stand-in.
+func NewSecretsManagerStore(env string, assume bool, endpoint string) *SecretsManagerStore {
+	regions := environmentRegions(env)
+	clients := map[string]*secretsmanager.Client{}
+	for _, region := range regions {
+		clients[region] = secretsmanager.NewFromConfig(getV2Config(region, env, assume), func(o *secretsmanager.Options) {
+			if endpoint != "" {
+				o.BaseEndpoint = aws.String(endpoint)
+			}
+		})
+	}
+	return &SecretsManagerStore{
+		SecretRegion:      environmentPrimaryRegion(env),
+		RegionParallelism: DefaultRegionParallelism,
+		clients:           clients,
+		regions:           regions,
+		env:               env,
+		assume:            assume,
+	}
+}
+
+// GetOrderedRegions provides guarantees that actions on Secrets Manager will happen
+// within a specific order every time.
+func (s *SecretsManagerStore) GetOrderedRegions() []string {
+	return append([]string{}, s.regions...)
+}
+
+// Create creates a Secret in the secret store. Version is guaranteed to be zero if no error is returned.
+func (s *SecretsManagerStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	name := getSecretsManagerName(id)
+	existing := forEachRegion(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		_, err := s.clients[region].DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+		var rnf *types.ResourceNotFoundException
+		if errors.As(err, &rnf) {
+			return nil
+		} else if err == nil {
+			return &IdentifierAlreadyExistsError{Identifier: id}
+		}
+		return err
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, region := range s.GetOrderedRegions() {
+		// the secret exists in some regions, throw error
+		var iae *IdentifierAlreadyExistsError
+		if errors.As(existing[region], &iae) {
+			return iae
+		}
+	}
+	for _, region := range s.GetOrderedRegions() {
+		// whether the secret exists in this region is unknown, so creating it could clobber it
+		if err := existing[region]; err != nil {
+			return convertSecretsManagerError(id, region, err)
+		}
+	}
+
+	versionID := newSecretsManagerVersionID(0)
+	// If any region fails, we will retry one more time. If retry fails, this Create operation fails.
+	// This guarantee the invariant that the all secret values are consistent across regions.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		client := s.clients[region]
+		_, err := client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+			Name: aws.String(name),
+			Tags: getSecretsManagerTags(id),
+		})
+		var ree *types.ResourceExistsException
+		// a previous attempt may have created the secret without writing its value
+		if err != nil && !errors.As(err, &ree) {
+			return err
+		}
+		// writing the same version ID again is a no-op, so retries don't add versions
+		_, err = client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:           aws.String(name),
+			SecretString:       aws.String(value),
+			ClientRequestToken: aws.String(versionID),
+			VersionStages:      []string{secretsManagerCurrentStage},
+		})
+		return err
+	})
+
+	// cleanup so that the Create operation is idempotent
+	if len(failures) > 0 {
+		// the cleanup must run even if ctx was cancelled, otherwise regions are left inconsistent
+		cleanupCtx := context.WithoutCancel(ctx)
+		revertFailures := forEachRegion(cleanupCtx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+			_, err := s.clients[region].DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{
+				SecretId:                   aws.String(name),
+				ForceDeleteWithoutRecovery: aws.Bool(true),
+			})
+			// the regions the secret was never created in have nothing to revert
+			var rnf *types.ResourceNotFoundException
+			if errors.As(err, &rnf) {
+				return nil
+			}
+			return err
+		})
+		return &MultiRegionError{Operation: "create", Identifier: id, Errors: failures, Reverted: len(revertFailures) == 0, RevertErrors: revertFailures}
+	}
+
+	return nil
+}
+
+// Read a Secret from the store. Returns the latest version of the secret.
+func (s *SecretsManagerStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	return s.readAtStage(ctx, id, secretsManagerCurrentStage)
+}
+
+// ReadVersion reads a specific version of a secret from the store.
+// Version is 0-indexed
+func (s *SecretsManagerStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var resp *secretsmanager.GetSecretValueOutput
+	for _, region := range s.GetOrderedRegions() {
+		versions, _, err := s.listVersions(ctx, region, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Secret{}, ctx.Err()
+			}
+			return Secret{}, convertSecretsManagerError(id, region, err)
+		}
+		entry, ok := versions[version]
+		if !ok {
+			return Secret{}, &VersionNotFoundError{Identifier: id, Version: version}
+		}
+		regionResp, err := s.clients[region].GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId:  aws.String(getSecretsManagerName(id)),
+			VersionId: entry.VersionId,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return Secret{}, ctx.Err()
+			}
+			return Secret{}, convertSecretsManagerError(id, region, err)
+		}
+		if region == s.SecretRegion {
+			resp = regionResp
+		}
+	}
+	return secretsManagerOutputToSecret(resp), nil
+}
+
+// listVersions lists the stealth versions of a secret in region, by version, along with the ID of its current
+// version. A version that was written more than once, because a write was reverted and tried again, is the
+// latest one written; versions after the current one were reverted, and are left out.
+func (s *SecretsManagerStore) listVersions(ctx context.Context, region string, id SecretIdentifier) (map[int]types.SecretVersionsListEntry, string, error) {
+	entries := []types.SecretVersionsListEntry{}
+	current := -1
+	currentID := ""
+	paginator := secretsmanager.NewListSecretVersionIdsPaginator(s.clients[region], &secretsmanager.ListSecretVersionIdsInput{
+		SecretId:          aws.String(getSecretsManagerName(id)),
+		IncludeDeprecated: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, entry := range resp.Versions {
+			version, ok := getVersionFromSecretsManagerVersionID(aws.ToString(entry.VersionId))
+			if !ok {
+				// versions without a stealth version ID were not written by stealth
+				continue
+			}
+			if slices.Contains(entry.VersionStages, secretsManagerCurrentStage) {
+				current = version
+				currentID = aws.ToString(entry.VersionId)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	versions := map[int]types.SecretVersionsListEntry{}
+	for _, entry := range entries {
+		version, _ := getVersionFromSecretsManagerVersionID(aws.ToString(entry.VersionId))
+		if version > current {
+			continue
+		}
+		if other, ok := versions[version]; ok && aws.ToTime(entry.CreatedDate).Before(aws.ToTime(other.CreatedDate)) {
+			continue
+		}
+		versions[version] = entry
+	}
+	return versions, currentID, nil
+}
+
+// readAtStage reads the version of a secret with the given staging label from all regions,
+// failing if any region fails
+func (s *SecretsManagerStore) readAtStage(ctx context.Context, id SecretIdentifier, stage string) (Secret, error) {
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(getSecretsManagerName(id)),
+		VersionStage: aws.String(stage),
+	}
+	var resp *secretsmanager.GetSecretValueOutput
+	for _, region := range s.GetOrderedRegions() {
+		regionResp, err := s.clients[region].GetSecretValue(ctx, input)
+		if err != nil {
+			if ctx.Err() != nil {
+				return Secret{}, ctx.Err()
+			}
+			return Secret{}, convertSecretsManagerError(id, region, err)
+		}
+		if region == s.SecretRegion {
+			resp = regionResp
+		}
+	}
+	return secretsManagerOutputToSecret(resp), nil
+}
+
+// secretsManagerOutputToSecret converts a GetSecretValue response into a Secret
+func secretsManagerOutputToSecret(resp *secretsmanager.GetSecretValueOutput) Secret {
+	secret := Secret{Data: aws.ToString(resp.SecretString)}
+	secret.Meta.Version, _ = getVersionFromSecretsManagerVersionID(aws.ToString(resp.VersionId))
+	if resp.CreatedDate != nil {
+		secret.Meta.Created = *resp.CreatedDate
+	}
+	return secret
+}
+
+// Update updates a Secret from the store and increments version number.
+func (s *SecretsManagerStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	name := getSecretsManagerName(id)
+	oldSecret, err := s.Read(ctx, id)
+	if err != nil {
+		return Secret{}, err
+	}
+	newVersionID := newSecretsManagerVersionID(oldSecret.Meta.Version + 1)
+	// writing the same version ID again is a no-op, so the retry doesn't add versions
+	putSecretValueInput := &secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String(name),
+		SecretString:       aws.String(value),
+		ClientRequestToken: aws.String(newVersionID),
+		VersionStages:      []string{secretsManagerCurrentStage},
+	}
+
+	// If any region fails, we will retry one more time. If retry fails, this Update operation fails.
+	// This guarantee the invariant that the all secret values are consistent across regions.
+	failures := retryRegions(ctx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+		_, err := s.clients[region].PutSecretValue(ctx, putSecretValueInput)
+		return err
+	})
+
+	// cleanup so that Update is idempotent: move AWSCURRENT back wherever the new version became current
+	if len(failures) > 0 {
+		// the revert must run even if ctx was cancelled, otherwise regions are left inconsistent
+		cleanupCtx := context.WithoutCancel(ctx)
+		revertFailures := forEachRegion(cleanupCtx, s.GetOrderedRegions(), s.RegionParallelism, func(ctx context.Context, region string) error {
+			return s.revertVersion(ctx, region, id, newVersionID, oldSecret.Meta.Version)
+		})
+		return Secret{}, &MultiRegionError{Operation: "update", Identifier: id, Errors: failures, Reverted: len(revertFailures) == 0, RevertErrors: revertFailures}
+	}
+
+	return s.Read(ctx, id)
+}
+
+// revertVersion undoes a PutSecretValue in a region, by moving AWSCURRENT back to the previous version if the
+// new version became current. The new version stays behind without a staging label, and listVersions leaves it out.
+func (s *SecretsManagerStore) revertVersion(ctx context.Context, region string, id SecretIdentifier, newVersionID string, oldVersion int) error {
+	versions, currentID, err := s.listVersions(ctx, region, id)
+	if err != nil {
+		return err
+	}
+	if currentID != newVersionID {
+		// the new version wasn't written to this region
+		return nil
+	}
+	old, ok := versions[oldVersion]
+	if !ok {
+		return &VersionNotFoundError{Identifier: id, Version: oldVersion}
+	}
+	_, err = s.clients[region].UpdateSecretVersionStage(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            aws.String(getSecretsManagerName(id)),
+		VersionStage:        aws.String(secretsManagerCurrentStage),
+		MoveToVersionId:     old.VersionId,
+		RemoveFromVersionId: aws.String(newVersionID),
+	})
+	return err
+}
+
+// List gets secrets within a namespace (env/service)>
+func (s *SecretsManagerStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	return s.ListPrefix(ctx, env, service, "")
+}
+
+// ListPrefix gets secrets within a namespace (env/service) whose keys start with keyPrefix, e.g. db/
+func (s *SecretsManagerStore) ListPrefix(ctx context.Context, env Environment, service, keyPrefix string) ([]SecretIdentifier, error) {
+	if !env.IsValid() {
+		return []SecretIdentifier{}, fmt.Errorf("env %d is invalid", env)
+	}
+	prefix := env.pathPrefix() + "/"
+	if service != "" {
+		prefix += service + "/" + keyPrefix
+	}
+
+	results := []SecretIdentifier{}
+	paginator := secretsmanager.NewListSecretsPaginator(s.clients[s.SecretRegion], &secretsmanager.ListSecretsInput{
+		Filters: []types.Filter{{Key: types.FilterNameStringTypeName, Values: []string{prefix}}},
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return []SecretIdentifier{}, err
+		}
+		for _, entry := range resp.SecretList {
+			name := aws.ToString(entry.Name)
+			// the name filter matches words anywhere in the name, so check the prefix again
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			id, err := getSecretIDFromSecretsManagerName(name)
+			if err != nil || !strings.HasPrefix(id.Key, keyPrefix) {
+				continue
+			}
+			results = append(results, id)
+		}
+	}
+	sort.Sort(ByIDString(results))
+	return results, nil
+}
+
+// ListAll gets all secrets within a environment (env)>
+func (s *SecretsManagerStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	return s.List(ctx, env, "")
+}
+
+// History gets history for a secret, returning all versions from the store.
+func (s *SecretsManagerStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := id.Validate(); err != nil {
+		return []SecretMeta{}, err
+	}
+	results := []SecretMeta{}
+	versions, _, err := s.listVersions(ctx, s.SecretRegion, id)
+	if err != nil {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		return results, convertSecretsManagerError(id, s.SecretRegion, err)
+	}
+	for version, entry := range versions {
+		results = append(results, SecretMeta{Version: version, Created: aws.ToTime(entry.CreatedDate)})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Version < results[j].Version })
+	return results, nil
+}
+
+// Delete deletes all versions of a secret
+func (s *SecretsManagerStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	deleteSecretInput := &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(getSecretsManagerName(id)),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	}
+	var failedRegions []string
+	notFound := 0
+	for _, region := range s.GetOrderedRegions() {
+		_, err := s.clients[region].DeleteSecret(ctx, deleteSecretInput)
+		// a region without the secret has nothing to delete
+		var rnf *types.ResourceNotFoundException
+		if errors.As(err, &rnf) {
+			notFound++
+			continue
+		}
+		// If any region fails, add to the return list of errors and continue.
+		if err != nil {
+			failedRegions = append(failedRegions, region)
+		}
+	}
+	if notFound == len(s.GetOrderedRegions()) {
+		return &IdentifierNotFoundError{Identifier: id, Region: s.SecretRegion}
+	}
+	// retry one more time
+	for _, region := range failedRegions {
+		_, err := s.clients[region].DeleteSecret(ctx, deleteSecretInput)
+		// the first attempt may have deleted it after all
+		var rnf *types.ResourceNotFoundException
+		// If any region fails now, consider this Delete operation failed and return
+		if err != nil && !errors.As(err, &rnf) {
+			return fmt.Errorf("failed to delete secret from region %s. try again", region)
+		}
+	}
+	return nil
+}
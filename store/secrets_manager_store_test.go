@@ -0,0 +1,364 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSecretsManagerVersion is a version of a secret in fakeSecretsManager
+type fakeSecretsManagerVersion struct {
+	id      string
+	value   string
+	stages  map[string]bool
+	created time.Time
+}
+
+// fakeSecretsManager is a local stand-in for the Secrets Manager JSON API, with separate state per region
+type fakeSecretsManager struct {
+	mu       sync.Mutex
+	secrets  map[string]map[string][]*fakeSecretsManagerVersion // region -> name -> versions
+	failures map[string]bool                                    // "region/Operation" -> fail
+	counter  int
+}
+
+// fakeSecretsManagerMaxStages is how many staging labels the versions of a secret may have between them
+const fakeSecretsManagerMaxStages = 20
+
+var fakeSecretsManagerRegion = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/`)
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{secrets: map[string]map[string][]*fakeSecretsManagerVersion{}, failures: map[string]bool{}}
+}
+
+func (f *fakeSecretsManager) fail(region, operation string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[region+"/"+operation] = true
+}
+
+func (f *fakeSecretsManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.")
+	match := fakeSecretsManagerRegion.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		f.writeError(w, "AccessDeniedException")
+		return
+	}
+	region := match[1]
+	if f.failures[region+"/"+operation] {
+		f.writeError(w, "InvalidRequestException")
+		return
+	}
+	if f.secrets[region] == nil {
+		f.secrets[region] = map[string][]*fakeSecretsManagerVersion{}
+	}
+	secrets := f.secrets[region]
+
+	var req struct {
+		Name, SecretId, SecretString, VersionStage, VersionId, MoveToVersionId, RemoveFromVersionId, ClientRequestToken string
+		VersionStages                                                                                                   []string
+		Filters                                                                                                         []struct{ Values []string }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.writeError(w, "InvalidRequestException")
+		return
+	}
+	versions, exists := secrets[req.SecretId]
+
+	switch operation {
+	case "CreateSecret":
+		if _, ok := secrets[req.Name]; ok {
+			f.writeError(w, "ResourceExistsException")
+			return
+		}
+		secrets[req.Name] = []*fakeSecretsManagerVersion{}
+		f.write(w, map[string]interface{}{"Name": req.Name})
+	case "DescribeSecret":
+		if !exists {
+			f.writeError(w, "ResourceNotFoundException")
+			return
+		}
+		f.write(w, map[string]interface{}{"Name": req.SecretId})
+	case "PutSecretValue":
+		if !exists {
+			f.writeError(w, "ResourceNotFoundException")
+			return
+		}
+		for _, version := range versions {
+			if version.id == req.ClientRequestToken {
+				// writing a version again is a no-op
+				f.write(w, map[string]interface{}{"Name": req.SecretId, "VersionId": version.id})
+				return
+			}
+		}
+		stages := map[string]bool{}
+		for _, version := range versions {
+			for stage := range version.stages {
+				stages[stage] = true
+			}
+		}
+		for _, stage := range req.VersionStages {
+			stages[stage] = true
+		}
+		if len(stages) > fakeSecretsManagerMaxStages {
+			f.writeError(w, "LimitExceededException")
+			return
+		}
+		f.counter++
+		version := &fakeSecretsManagerVersion{id: req.ClientRequestToken, value: req.SecretString, stages: map[string]bool{}, created: time.Now()}
+		if version.id == "" {
+			version.id = fmt.Sprintf("version-%d", f.counter)
+		}
+		for _, stage := range req.VersionStages {
+			for _, other := range versions {
+				delete(other.stages, stage)
+			}
+			version.stages[stage] = true
+		}
+		secrets[req.SecretId] = append(versions, version)
+		f.write(w, map[string]interface{}{"Name": req.SecretId, "VersionId": version.id})
+	case "GetSecretValue":
+		for _, version := range versions {
+			if version.stages[req.VersionStage] || version.id == req.VersionId {
+				f.write(w, map[string]interface{}{
+					"Name":          req.SecretId,
+					"SecretString":  version.value,
+					"VersionId":     version.id,
+					"VersionStages": fakeSecretsManagerStages(version),
+					"CreatedDate":   float64(version.created.UnixNano()) / 1e9,
+				})
+				return
+			}
+		}
+		f.writeError(w, "ResourceNotFoundException")
+	case "UpdateSecretVersionStage":
+		for _, version := range versions {
+			if version.id == req.RemoveFromVersionId {
+				delete(version.stages, req.VersionStage)
+			}
+			if version.id == req.MoveToVersionId {
+				version.stages[req.VersionStage] = true
+			}
+		}
+		f.write(w, map[string]interface{}{"Name": req.SecretId})
+	case "ListSecretVersionIds":
+		if !exists {
+			f.writeError(w, "ResourceNotFoundException")
+			return
+		}
+		entries := []map[string]interface{}{}
+		for _, version := range versions {
+			entries = append(entries, map[string]interface{}{
+				"VersionId":     version.id,
+				"VersionStages": fakeSecretsManagerStages(version),
+				"CreatedDate":   float64(version.created.UnixNano()) / 1e9,
+			})
+		}
+		f.write(w, map[string]interface{}{"Name": req.SecretId, "Versions": entries})
+	case "ListSecrets":
+		entries := []map[string]interface{}{}
+		for name := range secrets {
+			if len(req.Filters) == 0 || strings.Contains(name, req.Filters[0].Values[0]) {
+				entries = append(entries, map[string]interface{}{"Name": name})
+			}
+		}
+		f.write(w, map[string]interface{}{"SecretList": entries})
+	case "DeleteSecret":
+		if !exists {
+			f.writeError(w, "ResourceNotFoundException")
+			return
+		}
+		delete(secrets, req.SecretId)
+		f.write(w, map[string]interface{}{"Name": req.SecretId})
+	default:
+		f.writeError(w, "InvalidRequestException")
+	}
+}
+
+func fakeSecretsManagerStages(version *fakeSecretsManagerVersion) []string {
+	stages := []string{}
+	for stage := range version.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+func (f *fakeSecretsManager) write(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeSecretsManager) writeError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "Message": code})
+}
+
+// newTestSecretsManagerStore returns a SecretsManagerStore pointed at a fresh fakeSecretsManager
+func newTestSecretsManagerStore(t *testing.T) (*SecretsManagerStore, *fakeSecretsManager) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	fake := newFakeSecretsManager()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return NewSecretsManagerStore("ci-test", false, server.URL), fake
+}
+
+func TestSecretsManagerStore(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestSecretsManagerStore(t)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("no secrets exist, to begin")
+	_, err := s.Read(ctx, id)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id, Region: "us-west-1"})
+
+	t.Log("write a secret, and read it back")
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Equal(t, secret.Meta.Version, 0)
+	assert.Equal(t, s.Create(ctx, id, "bar"), &IdentifierAlreadyExistsError{Identifier: id})
+
+	t.Log("updates create new versions")
+	secret, err = s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	assert.Equal(t, secret.Meta.Version, 1)
+	secret, err = s.ReadVersion(ctx, id, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	_, err = s.ReadVersion(ctx, id, 2)
+	assert.Equal(t, err, &VersionNotFoundError{Identifier: id, Version: 2})
+	history, err := s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[0].Version, 0)
+	assert.Equal(t, history[1].Version, 1)
+
+	t.Log("list only returns secrets in the namespace")
+	other := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, other, "bar"))
+	ids, err := s.List(ctx, id.Environment, id.Service)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{id})
+	ids, err = s.ListAll(ctx, id.Environment)
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids), 2)
+
+	t.Log("delete removes the secret from every region")
+	assert.NoError(t, s.Delete(ctx, id))
+	_, err = s.Read(ctx, id)
+	assert.Error(t, err)
+	_, err = s.History(ctx, id)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id, Region: "us-west-1"})
+	assert.Equal(t, s.Delete(ctx, id), &IdentifierNotFoundError{Identifier: id, Region: "us-west-1"})
+}
+
+func TestSecretsManagerStoreManyVersions(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestSecretsManagerStore(t)
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, id, "value-0"))
+
+	t.Log("versions don't use up staging labels, so a secret can have more than 20")
+	for i := 1; i <= 25; i++ {
+		secret, err := s.Update(ctx, id, fmt.Sprintf("value-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Meta.Version, i)
+	}
+	secret, err := s.ReadVersion(ctx, id, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "value-3")
+	assert.Equal(t, secret.Meta.Version, 3)
+	history, err := s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, len(history), 26)
+	assert.Equal(t, history[25].Version, 25)
+}
+
+func TestSecretsManagerStoreRevertsFailedWrites(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newTestSecretsManagerStore(t)
+	id := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("an update that keeps failing in one region is reverted everywhere")
+	fake.fail("us-east-1", "PutSecretValue")
+	_, err := s.Update(ctx, id, "baz")
+	var multiRegionErr *MultiRegionError
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-east-1"})
+	assert.True(t, multiRegionErr.Reverted)
+	assert.Contains(t, err.Error(), "region us-east-1: ")
+	_, err = s.ReadVersion(ctx, id, 1)
+	assert.Equal(t, err, &VersionNotFoundError{Identifier: id, Version: 1})
+	for _, region := range s.GetOrderedRegions() {
+		s.SecretRegion = region
+		secret, err := s.Read(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "bar")
+		assert.Equal(t, secret.Meta.Version, 0)
+		history, err := s.History(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, len(history), 1)
+	}
+
+	t.Log("the reverted version is replaced by the next update")
+	fake.mu.Lock()
+	delete(fake.failures, "us-east-1/PutSecretValue")
+	fake.mu.Unlock()
+	secret, err := s.Update(ctx, id, "qux")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 1)
+	secret, err = s.ReadVersion(ctx, id, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "qux")
+	history, err := s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, len(history), 2)
+	fake.fail("us-east-1", "PutSecretValue")
+
+	t.Log("a create that keeps failing in one region is reverted everywhere")
+	other := GetRandomTestSecretIdentifier()
+	err = s.Create(ctx, other, "bar")
+	assert.True(t, errors.As(err, &multiRegionErr))
+	assert.Equal(t, sortedRegions(multiRegionErr.Errors), []string{"us-east-1"})
+	assert.True(t, multiRegionErr.Reverted)
+	for _, region := range s.GetOrderedRegions() {
+		s.SecretRegion = region
+		_, err := s.History(ctx, other)
+		assert.Equal(t, err, &IdentifierNotFoundError{Identifier: other, Region: region})
+	}
+
+	t.Log("a create can't tell whether the secret exists in a region that fails, so it fails without writing")
+	fake.fail("us-west-2", "DescribeSecret")
+	err = s.Create(ctx, other, "bar")
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &multiRegionErr))
+	assert.Contains(t, err.Error(), "InvalidRequestException")
+	fake.mu.Lock()
+	for _, secrets := range fake.secrets {
+		assert.NotContains(t, secrets, getSecretsManagerName(other))
+	}
+	fake.mu.Unlock()
+}
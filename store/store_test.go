@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -19,6 +21,9 @@ import (
 func TestMain(m *testing.M) {
 	deleteSecretsFromStores()
 	code := m.Run()
+	if testFileStoreDir != "" {
+		os.RemoveAll(testFileStoreDir)
+	}
 	os.Exit(code)
 }
 
@@ -48,26 +53,134 @@ func TestIdentifer(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%s", id), "ci-test.service.foo")
 }
 
-func TestStringToSecretIdentifier(t *testing.T) {
+func TestParseSecretIdentifier(t *testing.T) {
 	t.Log("works for all valid environments")
 	for _, env := range []Environment{CITestEnvironment, DevelopmentEnvironment, ProductionEnvironment} {
 		id := SecretIdentifier{Environment: env, Service: "service", Key: "foo"}
-		idFromString, err := stringToSecretIdentifier(id.String())
+		idFromString, err := ParseSecretIdentifier(id.String())
+		assert.NoError(t, err)
+		assert.Equal(t, idFromString, id)
+	}
+
+	t.Log("accepts SSM parameter paths and ARNs")
+	id := SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo-bar"}
+	for _, s := range []string{
+		"/ci-test/service/foo-bar",
+		"arn:aws:ssm:us-west-1:123456789012:parameter/ci-test/service/foo-bar",
+	} {
+		idFromString, err := ParseSecretIdentifier(s)
 		assert.NoError(t, err)
 		assert.Equal(t, idFromString, id)
 	}
 
-	// TODO: consider creating SecretIdentifier's in a NewSecretIdentifier constructor and put validation there
 	t.Log("errors on invalid environment")
-	id := SecretIdentifier{Environment: -1, Service: "service", Key: "foo"}
-	_, err := stringToSecretIdentifier(id.String())
+	id = SecretIdentifier{Environment: -1, Service: "service", Key: "foo"}
+	_, err := ParseSecretIdentifier(id.String())
 	assert.Error(t, err)
+	_, err = ParseSecretIdentifier("/nope/service/foo")
+	assert.Equal(t, err, &InvalidEnvironmentError{Identifier: "/nope/service/foo"})
 
 	id = SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo.bar"}
 	idString := id.String()
 	t.Log(fmt.Sprintf("errors on '.' in key name: %s", idString))
-	_, err = stringToSecretIdentifier(idString)
+	_, err = ParseSecretIdentifier(idString)
 	assert.Error(t, err)
+
+	t.Log("errors on malformed identifiers")
+	for _, s := range []string{
+		"ci-test.service",
+		"ci-test.Service.foo",
+		"ci-test.service.foo_bar",
+		"/ci-test/service",
+		"/ci-test/service/foo//bar",
+		"ci-test.service.foo%zz",
+		"arn:aws:s3:::bucket/ci-test/service/foo",
+	} {
+		_, err := ParseSecretIdentifier(s)
+		assert.IsType(t, &InvalidIdentifierError{}, err, s)
+	}
+}
+
+func TestNestedKeys(t *testing.T) {
+	t.Log("nested keys round trip through every form")
+	id := SecretIdentifier{Environment: ProductionEnvironment, Service: "api", Key: "db/password"}
+	assert.Equal(t, id.String(), "production.api.db/password")
+	for _, s := range []string{
+		id.String(),
+		"/production/api/db/password",
+		"arn:aws:ssm:us-west-1:123456789012:parameter/production/api/db/password",
+	} {
+		idFromString, err := ParseSecretIdentifier(s)
+		assert.NoError(t, err)
+		assert.Equal(t, idFromString, id)
+	}
+	idFromName, err := getSecretIDFromParamName("/production/api/db/password")
+	assert.NoError(t, err)
+	assert.Equal(t, idFromName, id)
+
+	t.Log("parameter names without a key are errors, not panics")
+	for _, name := range []string{"/production", "/production/api", "/production/api/"} {
+		_, err := getSecretIDFromParamName(name)
+		assert.Error(t, err, name)
+	}
+
+	t.Log("the dotted form escapes dots and percent signs")
+	id = SecretIdentifier{Environment: ProductionEnvironment, Service: "a.b", Key: "c%2Ed"}
+	assert.Equal(t, id.String(), "production.a%2Eb.c%252Ed")
+
+	t.Log("nested keys can be listed by prefix")
+	ctx := context.Background()
+	service := "test" + randSeq(4)
+	password := SecretIdentifier{Environment: CITestEnvironment, Service: service, Key: "db/password"}
+	user := SecretIdentifier{Environment: CITestEnvironment, Service: service, Key: "db/user"}
+	other := SecretIdentifier{Environment: CITestEnvironment, Service: service, Key: "dbx"}
+	for name, s := range ContextStores() {
+		t.Logf("---- %s ----\n", name)
+		for _, id := range []SecretIdentifier{password, user, other} {
+			assert.NoError(t, s.Create(ctx, id, "bar"))
+			defer s.Delete(ctx, id)
+		}
+		secret, err := s.Read(ctx, password)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "bar")
+		ids, err := ListPrefix(ctx, s, CITestEnvironment, service, "db/")
+		assert.NoError(t, err)
+		sort.Sort(ByIDString(ids))
+		assert.Equal(t, ids, []SecretIdentifier{password, user})
+		ids, err = ListPrefix(ctx, s, CITestEnvironment, service, "")
+		assert.NoError(t, err)
+		assert.Equal(t, len(ids), 3)
+	}
+}
+
+func TestNewSecretIdentifier(t *testing.T) {
+	id, err := NewSecretIdentifier(CITestEnvironment, "service", "foo-2")
+	assert.NoError(t, err)
+	assert.Equal(t, id, SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "foo-2"})
+
+	for _, id := range []SecretIdentifier{
+		{Environment: -1, Service: "service", Key: "foo"},
+		{Environment: CITestEnvironment, Service: "", Key: "foo"},
+		{Environment: CITestEnvironment, Service: "service", Key: "FOO"},
+		{Environment: CITestEnvironment, Service: "service", Key: "foo/"},
+		{Environment: CITestEnvironment, Service: "service/foo", Key: "bar"},
+	} {
+		_, err := NewSecretIdentifier(id.Environment, id.Service, id.Key)
+		assert.IsType(t, &InvalidIdentifierError{}, err, id.String())
+	}
+
+	t.Log("stores reject invalid identifiers before calling their backend")
+	ctx := context.Background()
+	id = SecretIdentifier{Environment: CITestEnvironment, Service: "service", Key: "Not_Valid"}
+	for name, s := range ContextStores() {
+		t.Logf("---- %s ----\n", name)
+		assert.IsType(t, &InvalidIdentifierError{}, s.Create(ctx, id, "bar"))
+		_, err := s.Read(ctx, id)
+		assert.IsType(t, &InvalidIdentifierError{}, err)
+		_, err = s.History(ctx, id)
+		assert.IsType(t, &InvalidIdentifierError{}, err)
+		assert.IsType(t, &InvalidIdentifierError{}, s.Delete(ctx, id))
+	}
 }
 
 func TestCreateRead(t *testing.T) {
@@ -75,7 +188,7 @@ func TestCreateRead(t *testing.T) {
 	for name, store := range Stores() {
 		defer store.Delete(id)
 		region := Region
-		if name == "Memory" {
+		if name != "Paramstore" {
 			region = ""
 		}
 		t.Logf("---- %s ----\n", name)
@@ -167,6 +280,11 @@ func TestCreateList(t *testing.T) {
 		expectedIds = []SecretIdentifier{s1id1, s1id2, s2id1}
 		sort.Sort(ByIDString(expectedIds))
 		assert.Equal(t, ids, expectedIds)
+
+		t.Log("listing without a service lists all secret ids too")
+		ids, err = store.List(CITestEnvironment, "")
+		assert.NoError(t, err)
+		assert.Equal(t, ids, expectedIds)
 	}
 }
 
@@ -198,12 +316,74 @@ func TestCreateListMultipleTimes(t *testing.T) {
 	return
 }
 
+func TestReadMany(t *testing.T) {
+	ctx := context.Background()
+	// more than one GetParameters batch
+	ids := []SecretIdentifier{}
+	for i := 0; i < 12; i++ {
+		ids = append(ids, GetRandomTestSecretIdentifier())
+	}
+	missing := GetRandomTestSecretIdentifier()
+	for name, s := range ContextStores() {
+		t.Logf("---- %s ----\n", name)
+		for i, id := range ids {
+			assert.NoError(t, s.Create(ctx, id, fmt.Sprintf("bar%d", i)))
+			defer s.Delete(ctx, id)
+		}
+		_, err := s.Update(ctx, ids[0], "baz")
+		assert.NoError(t, err)
+
+		t.Log("every existing secret is read at its latest version, and missing ones are left out")
+		secrets, err := ReadMany(ctx, s, append([]SecretIdentifier{missing}, ids...))
+		assert.NoError(t, err)
+		assert.Equal(t, len(secrets), len(ids))
+		assert.Equal(t, secrets[ids[0]].Data, "baz")
+		assert.Equal(t, secrets[ids[0]].Meta.Version, 1)
+		for i, id := range ids[1:] {
+			assert.Equal(t, secrets[id].Data, fmt.Sprintf("bar%d", i+1))
+		}
+		_, ok := secrets[missing]
+		assert.False(t, ok)
+
+		t.Log("invalid identifiers are rejected")
+		_, err = ReadMany(ctx, s, []SecretIdentifier{{Environment: CITestEnvironment, Service: "service", Key: "Not_Valid"}})
+		assert.IsType(t, &InvalidIdentifierError{}, err)
+	}
+}
+
+func TestReadService(t *testing.T) {
+	ctx := context.Background()
+	service := "test" + randSeq(4)
+	ids := []SecretIdentifier{
+		{Environment: CITestEnvironment, Service: service, Key: "foo"},
+		{Environment: CITestEnvironment, Service: service, Key: "db/password"},
+	}
+	other := SecretIdentifier{Environment: CITestEnvironment, Service: service + "x", Key: "foo"}
+	for name, s := range ContextStores() {
+		t.Logf("---- %s ----\n", name)
+		for _, id := range append(ids, other) {
+			assert.NoError(t, s.Create(ctx, id, "bar-"+id.Key))
+			defer s.Delete(ctx, id)
+		}
+		secrets, err := ReadService(ctx, s, CITestEnvironment, service)
+		assert.NoError(t, err)
+		assert.Equal(t, len(secrets), len(ids))
+		for _, id := range ids {
+			assert.Equal(t, secrets[id].Data, "bar-"+id.Key)
+		}
+	}
+
+	t.Log("current-deploy parameters are not secrets")
+	_, err := getSecretIDFromParamName("/ci-test/" + service + "/current-deploy")
+	assert.IsType(t, &CurrentDeployError{}, err)
+}
+
 func TestUpdateHistory(t *testing.T) {
 	id := GetRandomTestSecretIdentifier()
 	for name, store := range Stores() {
 		defer store.Delete(id)
 		region := Region
-		if name == "Memory" {
+		if name != "Paramstore" {
 			region = ""
 		}
 		t.Logf("---- %s ----\n", name)
@@ -272,12 +452,160 @@ func TestUpdateHistory(t *testing.T) {
 	}
 }
 
+func TestUpdateIfVersion(t *testing.T) {
+	ctx := context.Background()
+	id := GetRandomTestSecretIdentifier()
+	for name, s := range ContextStores() {
+		defer s.Delete(ctx, id)
+		t.Logf("---- %s ----\n", name)
+		_, err := UpdateIfVersion(ctx, s, id, 0, "bar")
+		assert.IsType(t, &IdentifierNotFoundError{}, err)
+		assert.NoError(t, s.Create(ctx, id, "bar"))
+
+		t.Log("updates at the expected version succeed")
+		_, err = UpdateIfVersion(ctx, s, id, 0, "baz")
+		assert.NoError(t, err)
+		secret, err := s.Read(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "baz")
+		assert.Equal(t, secret.Meta.Version, 1)
+
+		t.Log("updates at a stale version conflict and don't write")
+		_, err = UpdateIfVersion(ctx, s, id, 0, "qux")
+		assert.Equal(t, err, &VersionConflictError{Identifier: id, Expected: 0, Actual: 1})
+		secret, err = s.Read(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "baz")
+		assert.Equal(t, secret.Meta.Version, 1)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	ctx := context.Background()
+	id := GetRandomTestSecretIdentifier()
+	for name, s := range ContextStores() {
+		labeler, ok := s.(Labeler)
+		if !ok {
+			continue
+		}
+		defer s.Delete(ctx, id)
+		t.Logf("---- %s ----\n", name)
+		assert.NoError(t, s.Create(ctx, id, "bar"))
+		_, err := s.Update(ctx, id, "baz")
+		assert.NoError(t, err)
+		_, err = s.Update(ctx, id, "qux")
+		assert.NoError(t, err)
+
+		t.Log("reading a label gets the version it is attached to")
+		assert.NoError(t, labeler.Label(ctx, id, 1, "stable"))
+		secret, err := labeler.ReadLabel(ctx, id, "stable")
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "baz")
+		assert.Equal(t, secret.Meta.Version, 1)
+		assert.Equal(t, labelsOf(t, s, id), map[int][]string{1: {"stable"}})
+
+		t.Log("labelling another version moves the label")
+		assert.NoError(t, labeler.Label(ctx, id, 2, "stable"))
+		assert.NoError(t, labeler.Label(ctx, id, 0, "canary"))
+		secret, err = labeler.ReadLabel(ctx, id, "stable")
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "qux")
+		assert.Equal(t, labelsOf(t, s, id), map[int][]string{0: {"canary"}, 2: {"stable"}})
+
+		t.Log("bad labels and versions are rejected")
+		_, err = labeler.ReadLabel(ctx, id, "missing")
+		assert.Equal(t, err, &LabelNotFoundError{Identifier: id, Label: "missing"})
+		assert.IsType(t, &InvalidLabelError{}, labeler.Label(ctx, id, 0, "1st"))
+		assert.IsType(t, &InvalidLabelError{}, labeler.Label(ctx, id, 0, "aws-stable"))
+		assert.Equal(t, labeler.Label(ctx, id, 9, "stable"), &VersionNotFoundError{Identifier: id, Version: 9})
+	}
+}
+
+// labelsOf gets the labels of each version of a secret that has any
+func labelsOf(t *testing.T, s ContextSecretStore, id SecretIdentifier) map[int][]string {
+	history, err := s.History(context.Background(), id)
+	assert.NoError(t, err)
+	labels := map[int][]string{}
+	for _, meta := range history {
+		if len(meta.Labels) > 0 {
+			labels[meta.Version] = meta.Labels
+		}
+	}
+	return labels
+}
+
+func TestExpiration(t *testing.T) {
+	ctx := context.Background()
+	id := GetRandomTestSecretIdentifier()
+	expiration := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	for name, s := range ContextStores() {
+		writer, ok := s.(ExpiringWriter)
+		if !ok {
+			continue
+		}
+		defer s.Delete(ctx, id)
+		t.Logf("---- %s ----\n", name)
+		assert.NoError(t, writer.CreateWithExpiration(ctx, id, "bar", expiration))
+		history, err := s.History(ctx, id)
+		assert.NoError(t, err)
+		assert.True(t, history[0].Expiration.Equal(expiration))
+
+		t.Log("secrets expiring before the cutoff are listed")
+		expiring, err := ListExpiring(ctx, s, id.Environment, expiration.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Contains(t, expiringIDs(expiring), id)
+		expiring, err = ListExpiring(ctx, s, id.Environment, expiration.Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.NotContains(t, expiringIDs(expiring), id)
+
+		t.Log("updating moves the expiration")
+		_, err = writer.UpdateWithExpiration(ctx, id, "baz", expiration.Add(24*time.Hour))
+		assert.NoError(t, err)
+		expiring, err = ListExpiring(ctx, s, id.Environment, expiration.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.NotContains(t, expiringIDs(expiring), id)
+	}
+
+	t.Log("memory store refuses to read expired secrets")
+	s := NewMemoryStore()
+	expired := time.Now().Add(-time.Minute)
+	assert.NoError(t, s.CreateWithExpiration(ctx, id, "bar", expired))
+	_, err := s.Read(ctx, id)
+	assert.Equal(t, err, &SecretExpiredError{Identifier: id, Expiration: expired})
+	_, err = s.ReadVersion(ctx, id, 0)
+	assert.IsType(t, &SecretExpiredError{}, err)
+	secrets, err := ReadMany(ctx, s, []SecretIdentifier{id})
+	assert.NoError(t, err)
+	assert.Empty(t, secrets)
+
+	t.Log("memory store treats expired secrets as missing when writing, like Parameter Store deleting them")
+	_, err = s.Update(ctx, id, "baz")
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+	_, err = s.UpdateIfVersion(ctx, id, 0, "baz")
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+	assert.Equal(t, s.Label(ctx, id, 0, "stable"), &IdentifierNotFoundError{Identifier: id})
+	assert.NoError(t, s.Create(ctx, id, "baz"))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	assert.Equal(t, secret.Meta.Version, 0)
+}
+
+// expiringIDs gets the identifiers of expiring secrets
+func expiringIDs(secrets []ExpiringSecret) []SecretIdentifier {
+	ids := []SecretIdentifier{}
+	for _, secret := range secrets {
+		ids = append(ids, secret.Identifier)
+	}
+	return ids
+}
+
 func TestDelete(t *testing.T) {
 	id := GetRandomTestSecretIdentifier()
 	for name, store := range Stores() {
 		defer store.Delete(id)
 		region := Region
-		if name == "Memory" {
+		if name != "Paramstore" {
 			region = ""
 		}
 		t.Logf("---- %s ----\n", name)
@@ -300,3 +628,104 @@ func TestDelete(t *testing.T) {
 		assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id, Region: region})
 	}
 }
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	id := GetRandomTestSecretIdentifier()
+	for name, s := range ContextStores() {
+		trash, ok := s.(TrashStore)
+		if !ok {
+			continue
+		}
+		defer s.Delete(ctx, id)
+		t.Logf("---- %s ----\n", name)
+		assert.NoError(t, s.Create(ctx, id, "bar"))
+		_, err := s.Update(ctx, id, "baz")
+		assert.NoError(t, err)
+
+		t.Log("trashed secrets can't be read, but are listed in the trash")
+		trashed, err := trash.Trash(ctx, id)
+		assert.NoError(t, err)
+		defer trash.Purge(ctx, trashed)
+		assert.Equal(t, trashed.Identifier, id)
+		_, err = s.Read(ctx, id)
+		assert.IsType(t, &IdentifierNotFoundError{}, err)
+		list, err := trash.ListTrash(ctx, id.Environment)
+		assert.NoError(t, err)
+		assert.Contains(t, list, trashed)
+
+		t.Log("restoring brings back the secret and its history")
+		assert.NoError(t, trash.Restore(ctx, trashed))
+		secret, err := s.Read(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, "baz")
+		assert.Equal(t, secret.Meta.Version, 1)
+		first, err := s.ReadVersion(ctx, id, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, first.Data, "bar")
+		assert.Equal(t, trash.Restore(ctx, trashed), &TrashNotFoundError{Trashed: trashed})
+
+		t.Log("restoring over a re-created secret fails")
+		trashed, err = trash.Trash(ctx, id)
+		assert.NoError(t, err)
+		assert.NoError(t, s.Create(ctx, id, "qux"))
+		assert.Equal(t, trash.Restore(ctx, trashed), &IdentifierAlreadyExistsError{Identifier: id})
+
+		t.Log("purging only deletes secrets trashed longer than the retention ago")
+		purged, err := PurgeTrash(ctx, trash, id.Environment, time.Hour)
+		assert.NoError(t, err)
+		assert.NotContains(t, purged, trashed)
+		purged, err = PurgeTrash(ctx, trash, id.Environment, -time.Hour)
+		assert.NoError(t, err)
+		assert.Contains(t, purged, trashed)
+		list, err = trash.ListTrash(ctx, id.Environment)
+		assert.NoError(t, err)
+		assert.NotContains(t, list, trashed)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	id := GetRandomTestSecretIdentifier()
+	for name, store := range ContextStores() {
+		t.Logf("---- %s ----\n", name)
+		defer store.Delete(context.Background(), id)
+
+		t.Log("calls with a cancelled context fail with the context's error")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := store.Create(ctx, id, "bar")
+		assert.Error(t, err)
+		_, err = store.Read(ctx, id)
+		assert.True(t, errors.Is(err, context.Canceled))
+
+		t.Log("nothing was written by the cancelled Create")
+		_, err = store.Read(context.Background(), id)
+		assert.Error(t, err)
+	}
+}
+
+func TestAdapters(t *testing.T) {
+	id := GetRandomTestSecretIdentifier()
+	legacy := NewLegacyStore(NewMemoryStore())
+
+	t.Log("a ContextSecretStore can be used as a SecretStore")
+	assert.NoError(t, legacy.Create(id, "bar"))
+	secret, err := legacy.Read(id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("a SecretStore can be used as a ContextSecretStore")
+	wrapped := NewContextStore(legacy)
+	secret, err = wrapped.Read(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+
+	t.Log("the context is checked before calling into a SecretStore")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = wrapped.Update(ctx, id, "baz")
+	assert.Equal(t, err, context.Canceled)
+	secret, err = legacy.Read(id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+}
@@ -3,6 +3,8 @@ package store
 import (
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -10,10 +12,20 @@ func isCI() bool {
 	return os.Getenv("CI") == "true"
 }
 
-// Stores returns all implemented SecretStores memory and param
+// Stores returns all implemented SecretStores memory and param, adapted to the SecretStore interface
 func Stores() map[string]SecretStore {
 	var stores = make(map[string]SecretStore)
+	for name, s := range ContextStores() {
+		stores[name] = NewLegacyStore(s)
+	}
+	return stores
+}
+
+// ContextStores returns all implemented ContextSecretStores memory and param
+func ContextStores() map[string]ContextSecretStore {
+	var stores = make(map[string]ContextSecretStore)
 	stores["Memory"] = NewMemoryStore()
+	stores["File"] = newTestFileStore()
 	// don't test in CI environment, since it would require a role assumption we
 	// don't want to support
 	if !isCI() {
@@ -23,12 +35,41 @@ func Stores() map[string]SecretStore {
 	return stores
 }
 
+var (
+	testFileStoreDirOnce sync.Once
+	testFileStoreDir     string
+)
+
+// newTestFileStore returns a FileStore in a fresh file, encrypted with a key file so tests skip key derivation
+func newTestFileStore() *FileStore {
+	testFileStoreDirOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "stealth-test")
+		if err != nil {
+			panic("unable to create directory for test file stores: " + err.Error())
+		}
+		testFileStoreDir = dir
+	})
+	dir, err := os.MkdirTemp(testFileStoreDir, "store")
+	if err != nil {
+		panic("unable to create test file store: " + err.Error())
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := GenerateFileStoreKey(keyFile); err != nil {
+		panic("unable to create test file store key: " + err.Error())
+	}
+	s, err := NewFileStoreWithKeyFile(filepath.Join(dir, "secrets"), keyFile)
+	if err != nil {
+		panic("unable to create test file store: " + err.Error())
+	}
+	return s
+}
+
 // GetRandomTestSecretIdentifier returns a random key in the ci-test environment
 func GetRandomTestSecretIdentifier() SecretIdentifier {
 	return SecretIdentifier{Environment: CITestEnvironment, Service: "test" + randSeq(2), Key: randSeq(10)}
 }
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+var letters = []rune("abcdefghijklmnopqrstuvwxyz")
 
 func randSeq(n int) string {
 	rand.Seed(time.Now().UTC().UnixNano())
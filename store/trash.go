@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultTrashRetention is how long trashed secrets are kept before PurgeTrash deletes them, unless told otherwise
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashedSecret is a secret that has been moved to the trash, along with its history
+type TrashedSecret struct {
+	Identifier SecretIdentifier
+	DeletedAt  time.Time
+}
+
+func (t TrashedSecret) String() string {
+	return fmt.Sprintf("%s (deleted %s)", t.Identifier, t.DeletedAt.UTC().Format(time.RFC3339))
+}
+
+// TrashStore is implemented by stores that can soft delete secrets. Trashed secrets keep their history, and can
+// be restored until they are purged. Delete still removes a secret permanently.
+type TrashStore interface {
+	// Trash moves a secret and its history into the trash
+	Trash(ctx context.Context, id SecretIdentifier) (TrashedSecret, error)
+
+	// ListTrash gets the trashed secrets within an environment, oldest first
+	ListTrash(ctx context.Context, env Environment) ([]TrashedSecret, error)
+
+	// Restore moves a trashed secret and its history back out of the trash. It fails with an
+	// IdentifierAlreadyExistsError if the secret has been created again since it was trashed.
+	Restore(ctx context.Context, trashed TrashedSecret) error
+
+	// Purge permanently deletes a trashed secret
+	Purge(ctx context.Context, trashed TrashedSecret) error
+}
+
+// TrashNotFoundError occurs when a trashed secret cannot be found (during Restore, Purge)
+type TrashNotFoundError struct {
+	Trashed TrashedSecret
+}
+
+func (e *TrashNotFoundError) Error() string {
+	return fmt.Sprintf("Trashed secret not found: %s", e.Trashed)
+}
+
+// PurgeTrash permanently deletes the secrets within an environment that were trashed longer than retention ago,
+// and returns them
+func PurgeTrash(ctx context.Context, s TrashStore, env Environment, retention time.Duration) ([]TrashedSecret, error) {
+	trashed, err := s.ListTrash(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-retention)
+	purged := []TrashedSecret{}
+	for _, t := range trashed {
+		if t.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := s.Purge(ctx, t); err != nil {
+			return purged, err
+		}
+		purged = append(purged, t)
+	}
+	return purged, nil
+}
@@ -1,42 +1,71 @@
 package util
 
 import (
+	"context"
 	"log"
-	"time"
 
 	"github.com/Clever/stealth/store"
 )
 
+// readBatchSize is how many secrets FindDupes reads at once, matching Parameter Store's GetParameters limit
+const readBatchSize = 10
+
 // FindDupes finds all secrets that match a secret with a specified identifier, and optionally
-// replace that value with a new value
-func FindDupes(s store.SecretStore, id store.SecretIdentifier, envs []store.Environment) ([]store.SecretIdentifier, error) {
-	secret, err := s.Read(id)
+// replace that value with a new value. It stops early with the context's error if ctx is cancelled.
+func FindDupes(ctx context.Context, s store.ContextSecretStore, id store.SecretIdentifier, envs []store.Environment) ([]store.SecretIdentifier, error) {
+	secret, err := s.Read(ctx, id)
 	if err != nil {
 		return []store.SecretIdentifier{}, err
 	}
 	var dupes []store.SecretIdentifier
 	for _, e := range envs {
 		log.Printf("reading from %s\n", e.String())
-		ids, err := s.ListAll(e)
+		ids, err := s.ListAll(ctx, e)
 		log.Printf("total secrets: %d\n", len(ids))
 		if err != nil {
 			return []store.SecretIdentifier{}, err
 		}
-		for num, id := range ids {
-			if num%100 == 0 {
-				log.Printf("reading %04d/%04d\n", num, len(ids))
+		valid := []store.SecretIdentifier{}
+		for _, id := range ids {
+			// secrets written before identifiers were validated can't be read, so leave them out of the batches
+			if err := id.Validate(); err != nil {
+				log.Printf("skipping secret: %v\n", err)
+				continue
+			}
+			valid = append(valid, id)
+		}
+		for start := 0; start < len(valid); start += readBatchSize {
+			if start%100 == 0 {
+				log.Printf("reading %04d/%04d\n", start, len(valid))
 			}
-			// With Parameter Store, the maximal normal limit is 40 requests per second.
-			// 1000 ms / 67 ms ~= 15 secrets per second.
-			time.Sleep(67 * time.Millisecond)
-			newSecret, err := s.Read(id)
+			// Stores pace their own requests, e.g. ParameterStore with its RateLimiter
+			batch := valid[start:min(start+readBatchSize, len(valid))]
+			secrets, err := store.ReadMany(ctx, s, batch)
 			if err != nil {
-				// We assume that any missing secret isn't an issue
-				// with the duplicate checking. We'll log instead of erroring.
-				log.Printf("error reading secret: %v\n", err)
+				if ctx.Err() != nil {
+					return []store.SecretIdentifier{}, ctx.Err()
+				}
+				// read the secrets one at a time instead, so that one secret can't hide the others
+				log.Printf("error reading secrets: %v\n", err)
+				secrets = map[store.SecretIdentifier]store.Secret{}
 			}
-			if newSecret.Data == secret.Data {
-				dupes = append(dupes, id)
+			for _, id := range batch {
+				newSecret, ok := secrets[id]
+				if !ok {
+					// ReadMany leaves out secrets that are missing, e.g. from one region, so read it on its own
+					if newSecret, err = s.Read(ctx, id); err != nil {
+						if ctx.Err() != nil {
+							return []store.SecretIdentifier{}, ctx.Err()
+						}
+						// We assume that any missing secret isn't an issue
+						// with the duplicate checking. We'll log instead of erroring.
+						log.Printf("error reading secret: %v\n", err)
+						continue
+					}
+				}
+				if newSecret.Data == secret.Data {
+					dupes = append(dupes, id)
+				}
 			}
 		}
 	}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"context"
+	"fmt"
 	"sort"
 	"testing"
 
@@ -13,29 +15,74 @@ func TestFindDupes(t *testing.T) {
 	id2 := store.GetRandomTestSecretIdentifier()
 	id3 := store.GetRandomTestSecretIdentifier()
 	envs := []store.Environment{store.CITestEnvironment}
-	for name, s := range store.Stores() {
-		defer s.Delete(id1)
-		defer s.Delete(id2)
-		defer s.Delete(id3)
+	ctx := context.Background()
+	for name, s := range store.ContextStores() {
+		defer s.Delete(ctx, id1)
+		defer s.Delete(ctx, id2)
+		defer s.Delete(ctx, id3)
 		t.Logf("---- %s ----\n", name)
 		t.Log("creating some duplicate secrets")
 		data1 := "bar1"
-		err := s.Create(id1, data1)
-		err = s.Create(id2, data1)
+		err := s.Create(ctx, id1, data1)
+		err = s.Create(ctx, id2, data1)
 		data2 := "bar2"
-		err = s.Create(id3, data2)
+		err = s.Create(ctx, id3, data2)
 		t.Log("should be able to find dupes for either duplicate value")
-		dupes, err := FindDupes(s, id1, envs)
+		dupes, err := FindDupes(ctx, s, id1, envs)
 		assert.NoError(t, err)
 		expectedIds := []store.SecretIdentifier{id1, id2}
 		sort.Sort(store.ByIDString(expectedIds))
 		assert.Equal(t, dupes, expectedIds)
-		dupes, err = FindDupes(s, id2, envs)
+		dupes, err = FindDupes(ctx, s, id2, envs)
 		assert.NoError(t, err)
 		assert.Equal(t, dupes, expectedIds)
 		t.Log("a secret with no duplicate should only return itself")
-		dupes, err = FindDupes(s, id3, envs)
+		dupes, err = FindDupes(ctx, s, id3, envs)
 		assert.NoError(t, err)
 		assert.Equal(t, dupes, []store.SecretIdentifier{id3})
 	}
 }
+
+// legacyStore lists a secret whose identifier predates validation, like an old Parameter Store key, and its
+// ReadMany leaves out a secret, like a region that doesn't have it
+type legacyStore struct {
+	store.ContextSecretStore
+	legacy  store.SecretIdentifier
+	leftOut store.SecretIdentifier
+}
+
+func (s *legacyStore) ListAll(ctx context.Context, env store.Environment) ([]store.SecretIdentifier, error) {
+	ids, err := s.ContextSecretStore.ListAll(ctx, env)
+	return append([]store.SecretIdentifier{s.legacy}, ids...), err
+}
+
+func (s *legacyStore) ReadMany(ctx context.Context, ids []store.SecretIdentifier) (map[store.SecretIdentifier]store.Secret, error) {
+	secrets, err := store.ReadMany(ctx, s.ContextSecretStore, ids)
+	delete(secrets, s.leftOut)
+	return secrets, err
+}
+
+func TestFindDupesMixedBatch(t *testing.T) {
+	ctx := context.Background()
+	inner := store.NewMemoryStore()
+	ids := []store.SecretIdentifier{}
+	for i := 0; i < 9; i++ {
+		id := store.SecretIdentifier{Environment: store.CITestEnvironment, Service: "service", Key: fmt.Sprintf("key-%d", i)}
+		value := "other"
+		if i%2 == 0 {
+			value = "leaked"
+		}
+		assert.NoError(t, inner.Create(ctx, id, value))
+		ids = append(ids, id)
+	}
+	s := &legacyStore{
+		ContextSecretStore: inner,
+		legacy:             store.SecretIdentifier{Environment: store.CITestEnvironment, Service: "service", Key: "Legacy_Key"},
+		leftOut:            ids[2],
+	}
+
+	t.Log("an invalid identifier in a batch, or a secret the batch leaves out, doesn't hide the other secrets")
+	dupes, err := FindDupes(ctx, s, ids[0], []store.Environment{store.CITestEnvironment})
+	assert.NoError(t, err)
+	assert.Equal(t, dupes, []store.SecretIdentifier{ids[0], ids[2], ids[4], ids[6], ids[8]})
+}
@@ -0,0 +1,537 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vaultValueField is the field of a KV v2 secret that holds the stealth value
+	vaultValueField = "value"
+	// vaultDefaultMount is where the KV v2 engine is mounted unless configured otherwise
+	vaultDefaultMount = "secret"
+)
+
+func init() {
+	Register("vault", openVaultStore)
+}
+
+// openVaultStore creates a VaultStore from a URL of the form vault://vault.example.com:8200/secret.
+// The path is the KV v2 mount, and defaults to "secret"; insecure=true talks plain HTTP. Without a host,
+// the address is read from $VAULT_ADDR. Authentication uses $VAULT_TOKEN, unless role-id is set, in which
+// case stealth logs in with AppRole using the secret ID in $VAULT_SECRET_ID.
+func openVaultStore(u *url.URL) (ContextSecretStore, error) {
+	query := u.Query()
+	config := VaultConfig{
+		Address:   os.Getenv("VAULT_ADDR"),
+		Mount:     strings.Trim(u.Path, "/"),
+		Namespace: query.Get("namespace"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+	}
+	if u.Host != "" {
+		scheme := "https"
+		if insecure, _ := strconv.ParseBool(query.Get("insecure")); insecure {
+			scheme = "http"
+		}
+		config.Address = scheme + "://" + u.Host
+	}
+	if roleID := query.Get("role-id"); roleID != "" {
+		config.Token = ""
+		config.RoleID = roleID
+		config.SecretID = os.Getenv("VAULT_SECRET_ID")
+		config.AppRoleMount = query.Get("approle-mount")
+	}
+	return NewVaultStore(config)
+}
+
+// VaultConfig configures a VaultStore
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	// Mount is the path the KV v2 secrets engine is mounted at. Defaults to "secret".
+	Mount string
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+	// Token authenticates with a Vault token. Either Token, or RoleID and SecretID, must be set.
+	Token string
+	// RoleID and SecretID authenticate with AppRole
+	RoleID, SecretID string
+	// AppRoleMount is the path the AppRole auth method is mounted at. Defaults to "approle".
+	AppRoleMount string
+	// HTTPClient is used for all requests. Defaults to a client with a 30 second timeout.
+	HTTPClient *http.Client
+}
+
+// VaultStore is a secret store backed by the HashiCorp Vault KV version 2 secrets engine.
+// Secrets live at <mount>/data/<env>/<service>/<key>, with the value in the "value" field.
+type VaultStore struct {
+	config VaultConfig
+	client *http.Client
+
+	tokenMu sync.Mutex
+	token   string
+}
+
+// NewVaultStore creates a secret store that points at Vault
+func NewVaultStore(config VaultConfig) (*VaultStore, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("vault store requires an address")
+	}
+	if config.Token == "" && (config.RoleID == "" || config.SecretID == "") {
+		return nil, fmt.Errorf("vault store requires a token, or an AppRole role ID and secret ID")
+	}
+	if config.Mount == "" {
+		config.Mount = vaultDefaultMount
+	}
+	if config.AppRoleMount == "" {
+		config.AppRoleMount = "approle"
+	}
+	config.Address = strings.TrimRight(config.Address, "/")
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &VaultStore{config: config, client: client, token: config.Token}, nil
+}
+
+// vaultResponse is the envelope of every Vault API response
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *vaultAuth      `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken string `json:"client_token"`
+}
+
+// vaultVersionMetadata is the metadata of a single KV v2 version
+type vaultVersionMetadata struct {
+	CreatedTime  time.Time `json:"created_time"`
+	DeletionTime string    `json:"deletion_time"`
+	Destroyed    bool      `json:"destroyed"`
+	Version      int       `json:"version"`
+}
+
+// vaultSecretData is the data returned when reading a KV v2 secret
+type vaultSecretData struct {
+	Data     map[string]interface{} `json:"data"`
+	Metadata vaultVersionMetadata   `json:"metadata"`
+}
+
+// vaultSecretMetadata is the metadata of a KV v2 secret, including all of its versions
+type vaultSecretMetadata struct {
+	CurrentVersion int                             `json:"current_version"`
+	Versions       map[string]vaultVersionMetadata `json:"versions"`
+}
+
+// vaultError is a failed Vault API call
+type vaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("Vault error (%d): %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// getVaultPath converts from development.oauth.foo-bar to development/oauth/foo-bar
+func getVaultPath(id SecretIdentifier) string {
+	return fmt.Sprintf("%s/%s/%s", id.Environment.pathPrefix(), id.Service, id.Key)
+}
+
+// convertVaultError maps Vault errors onto the store's errors
+func convertVaultError(id SecretIdentifier, err error) error {
+	if verr, ok := err.(*vaultError); ok {
+		switch verr.StatusCode {
+		case http.StatusNotFound:
+			return &IdentifierNotFoundError{Identifier: id, Region: ""}
+		case http.StatusForbidden:
+			return &AuthorizationError{Identifier: id}
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return &ThrottlingError{Identifier: id, Err: err}
+		}
+	}
+	return err
+}
+
+// Create creates a Secret in the secret store. Version is guaranteed to be zero if no error is returned.
+func (s *VaultStore) Create(ctx context.Context, id SecretIdentifier, value string) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"data": map[string]string{vaultValueField: value},
+		// a check-and-set of 0 only writes if the secret does not exist yet
+		"options": map[string]int{"cas": 0},
+	}
+	err := s.do(ctx, http.MethodPost, s.dataPath(id), nil, body, nil)
+	if verr, ok := err.(*vaultError); ok && verr.StatusCode == http.StatusBadRequest && isVaultCASError(verr) {
+		return &IdentifierAlreadyExistsError{Identifier: id}
+	}
+	return convertVaultError(id, err)
+}
+
+// isVaultCASError reports whether a write failed its check-and-set
+func isVaultCASError(err *vaultError) bool {
+	for _, msg := range err.Errors {
+		if strings.Contains(msg, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a Secret from the store. Returns the latest version of the secret.
+func (s *VaultStore) Read(ctx context.Context, id SecretIdentifier) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	var data vaultSecretData
+	if err := s.do(ctx, http.MethodGet, s.dataPath(id), nil, nil, &data); err != nil {
+		return Secret{}, convertVaultError(id, err)
+	}
+	return vaultDataToSecret(data), nil
+}
+
+// ReadVersion reads a specific version of a secret from the store.
+// Version is 0-indexed
+func (s *VaultStore) ReadVersion(ctx context.Context, id SecretIdentifier, version int) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	// Vault reads the latest version when asked for version 0, so negative versions must be caught here
+	if version < 0 {
+		if _, err := s.History(ctx, id); err != nil {
+			return Secret{}, err
+		}
+		return Secret{}, &VersionNotFoundError{Identifier: id, Version: version}
+	}
+	query := url.Values{"version": []string{strconv.Itoa(convertToVaultVersion(version))}}
+	var data vaultSecretData
+	err := s.do(ctx, http.MethodGet, s.dataPath(id), query, nil, &data)
+	if verr, ok := err.(*vaultError); ok && verr.StatusCode == http.StatusNotFound {
+		// Vault does not distinguish a missing version from a missing secret
+		if _, err := s.History(ctx, id); err != nil {
+			return Secret{}, err
+		}
+		return Secret{}, &VersionNotFoundError{Identifier: id, Version: version}
+	} else if err != nil {
+		return Secret{}, convertVaultError(id, err)
+	}
+	return vaultDataToSecret(data), nil
+}
+
+// vaultDataToSecret converts a KV v2 read into a Secret
+func vaultDataToSecret(data vaultSecretData) Secret {
+	value, _ := data.Data[vaultValueField].(string)
+	return Secret{Data: value, Meta: SecretMeta{
+		Created: data.Metadata.CreatedTime,
+		Version: convertFromVaultVersion(data.Metadata.Version),
+	}}
+}
+
+// Update updates a Secret from the store and increments version number.
+func (s *VaultStore) Update(ctx context.Context, id SecretIdentifier, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	if _, err := s.History(ctx, id); err != nil {
+		return Secret{}, err
+	}
+	body := map[string]interface{}{
+		"data": map[string]string{vaultValueField: value},
+	}
+	var written vaultVersionMetadata
+	if err := s.do(ctx, http.MethodPost, s.dataPath(id), nil, body, &written); err != nil {
+		return Secret{}, convertVaultError(id, err)
+	}
+	return Secret{Data: value, Meta: SecretMeta{Created: written.CreatedTime, Version: convertFromVaultVersion(written.Version)}}, nil
+}
+
+// versionConflict returns the VersionConflictError of an UpdateIfVersion that didn't find the secret at
+// expectedVersion, or an IdentifierNotFoundError if the secret has no versions left
+func (s *VaultStore) versionConflict(ctx context.Context, id SecretIdentifier, expectedVersion int) error {
+	history, err := s.History(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return &IdentifierNotFoundError{Identifier: id}
+	}
+	return &VersionConflictError{Identifier: id, Expected: expectedVersion, Actual: history[len(history)-1].Version}
+}
+
+// UpdateIfVersion updates a secret only if its latest version is expectedVersion, using Vault's check-and-set
+func (s *VaultStore) UpdateIfVersion(ctx context.Context, id SecretIdentifier, expectedVersion int, value string) (Secret, error) {
+	if err := id.Validate(); err != nil {
+		return Secret{}, err
+	}
+	// a check-and-set of 0 would create the secret, so negative versions must be caught here
+	if expectedVersion < 0 {
+		return Secret{}, s.versionConflict(ctx, id, expectedVersion)
+	}
+	body := map[string]interface{}{
+		"data":    map[string]string{vaultValueField: value},
+		"options": map[string]int{"cas": convertToVaultVersion(expectedVersion)},
+	}
+	var written vaultVersionMetadata
+	err := s.do(ctx, http.MethodPost, s.dataPath(id), nil, body, &written)
+	if verr, ok := err.(*vaultError); ok && verr.StatusCode == http.StatusBadRequest && isVaultCASError(verr) {
+		return Secret{}, s.versionConflict(ctx, id, expectedVersion)
+	} else if err != nil {
+		return Secret{}, convertVaultError(id, err)
+	}
+	return Secret{Data: value, Meta: SecretMeta{Created: written.CreatedTime, Version: convertFromVaultVersion(written.Version)}}, nil
+}
+
+// List gets secrets within a namespace (env/service)>
+func (s *VaultStore) List(ctx context.Context, env Environment, service string) ([]SecretIdentifier, error) {
+	return s.ListPrefix(ctx, env, service, "")
+}
+
+// ListPrefix gets secrets within a namespace (env/service) whose keys start with prefix, e.g. db/
+func (s *VaultStore) ListPrefix(ctx context.Context, env Environment, service, prefix string) ([]SecretIdentifier, error) {
+	if !env.IsValid() {
+		return []SecretIdentifier{}, fmt.Errorf("env %d is invalid", env)
+	}
+	if service == "" {
+		ids, err := s.ListAll(ctx, env)
+		if err != nil {
+			return []SecretIdentifier{}, err
+		}
+		return filterKeyPrefix(ids, prefix), nil
+	}
+	// Vault lists one folder at a time, so start from the deepest folder the prefix names
+	folder := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		folder = prefix[:i+1]
+	}
+	keys, err := s.listRecursive(ctx, env.pathPrefix()+"/"+service+"/", folder)
+	if err != nil {
+		return []SecretIdentifier{}, err
+	}
+	results := []SecretIdentifier{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			results = append(results, SecretIdentifier{Environment: env, Service: service, Key: key})
+		}
+	}
+	sort.Sort(ByIDString(results))
+	return results, nil
+}
+
+// listRecursive lists every secret under base+folder, as keys relative to base. Nested keys are in subfolders.
+func (s *VaultStore) listRecursive(ctx context.Context, base, folder string) ([]string, error) {
+	entries, err := s.list(ctx, strings.TrimSuffix(base+folder, "/"))
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			keys = append(keys, folder+entry)
+			continue
+		}
+		nested, err := s.listRecursive(ctx, base, folder+entry)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, nested...)
+	}
+	return keys, nil
+}
+
+// ListAll gets all secrets within a environment (env)>
+func (s *VaultStore) ListAll(ctx context.Context, env Environment) ([]SecretIdentifier, error) {
+	if !env.IsValid() {
+		return []SecretIdentifier{}, fmt.Errorf("env %d is invalid", env)
+	}
+	services, err := s.list(ctx, env.pathPrefix())
+	if err != nil {
+		return []SecretIdentifier{}, err
+	}
+	results := []SecretIdentifier{}
+	for _, service := range services {
+		if !strings.HasSuffix(service, "/") {
+			continue
+		}
+		ids, err := s.List(ctx, env, strings.TrimSuffix(service, "/"))
+		if err != nil {
+			return []SecretIdentifier{}, err
+		}
+		results = append(results, ids...)
+	}
+	sort.Sort(ByIDString(results))
+	return results, nil
+}
+
+// list lists the keys under a metadata path. Folders end in a slash.
+func (s *VaultStore) list(ctx context.Context, path string) ([]string, error) {
+	var data struct {
+		Keys []string `json:"keys"`
+	}
+	err := s.do(ctx, "LIST", s.metadataPath(path), nil, nil, &data)
+	if verr, ok := err.(*vaultError); ok && verr.StatusCode == http.StatusNotFound {
+		// Vault has no empty folders, so a missing path is an empty list
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return data.Keys, nil
+}
+
+// History gets history for a secret, returning all versions from the store.
+func (s *VaultStore) History(ctx context.Context, id SecretIdentifier) ([]SecretMeta, error) {
+	if err := id.Validate(); err != nil {
+		return []SecretMeta{}, err
+	}
+	var metadata vaultSecretMetadata
+	if err := s.do(ctx, http.MethodGet, s.metadataPath(getVaultPath(id)), nil, nil, &metadata); err != nil {
+		return []SecretMeta{}, convertVaultError(id, err)
+	}
+	results := []SecretMeta{}
+	for _, version := range metadata.Versions {
+		results = append(results, SecretMeta{
+			Created: version.CreatedTime,
+			Version: convertFromVaultVersion(version.Version),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Version < results[j].Version })
+	return results, nil
+}
+
+// Delete deletes all versions of a secret
+func (s *VaultStore) Delete(ctx context.Context, id SecretIdentifier) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+	if _, err := s.History(ctx, id); err != nil {
+		return err
+	}
+	return convertVaultError(id, s.do(ctx, http.MethodDelete, s.metadataPath(getVaultPath(id)), nil, nil, nil))
+}
+
+func (s *VaultStore) dataPath(id SecretIdentifier) string {
+	return fmt.Sprintf("%s/data/%s", s.config.Mount, getVaultPath(id))
+}
+
+func (s *VaultStore) metadataPath(path string) string {
+	return fmt.Sprintf("%s/metadata/%s", s.config.Mount, path)
+}
+
+// convertFromVaultVersion converts Vault 1-indexed version to be 0-indexed
+func convertFromVaultVersion(version int) int {
+	return version - 1
+}
+
+// convertToVaultVersion converts 0-indexed version specifier to be 1-indexed for Vault
+func convertToVaultVersion(version int) int {
+	return version + 1
+}
+
+// do makes an authenticated Vault API call, decoding the response's data into out if it is set.
+// If AppRole is configured, it logs in as needed, and once more if the token is rejected.
+func (s *VaultStore) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	token, err := s.getToken(ctx, false)
+	if err != nil {
+		return err
+	}
+	resp, err := s.request(ctx, method, path, query, body, token)
+	if verr, ok := err.(*vaultError); ok && verr.StatusCode == http.StatusForbidden && s.config.RoleID != "" {
+		// the token may have expired, so log in again
+		if token, err = s.getToken(ctx, true); err != nil {
+			return err
+		}
+		resp, err = s.request(ctx, method, path, query, body, token)
+	}
+	if err != nil {
+		return err
+	}
+	if out != nil && len(resp.Data) > 0 {
+		return json.Unmarshal(resp.Data, out)
+	}
+	return nil
+}
+
+// getToken returns the token to authenticate with, logging in with AppRole if there is none or refresh is set
+func (s *VaultStore) getToken(ctx context.Context, refresh bool) (string, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+	if s.token != "" && !refresh {
+		return s.token, nil
+	}
+	body := map[string]string{"role_id": s.config.RoleID, "secret_id": s.config.SecretID}
+	resp, err := s.request(ctx, http.MethodPost, fmt.Sprintf("auth/%s/login", s.config.AppRoleMount), nil, body, "")
+	if err != nil {
+		if _, ok := err.(*vaultError); ok {
+			return "", &AuthenticationError{}
+		}
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", &AuthenticationError{}
+	}
+	s.token = resp.Auth.ClientToken
+	return s.token, nil
+}
+
+// request makes a single Vault API call
+func (s *VaultStore) request(ctx context.Context, method, path string, query url.Values, body interface{}, token string) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s", s.config.Address, path)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parsed vaultResponse
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("unable to parse Vault response: %s", err)
+		}
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &vaultError{StatusCode: resp.StatusCode, Errors: parsed.Errors}
+	}
+	return &parsed, nil
+}
@@ -0,0 +1,354 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVaultVersion is a version of a secret in fakeVault
+type fakeVaultVersion struct {
+	data    map[string]interface{}
+	created time.Time
+}
+
+// fakeVault is an httptest stand-in for the parts of the Vault HTTP API used by VaultStore:
+// a KV v2 engine mounted at secret/, and AppRole auth
+type fakeVault struct {
+	mu       sync.Mutex
+	secrets  map[string][]fakeVaultVersion
+	tokens   map[string]bool
+	roleID   string
+	secretID string
+	logins   int
+	// status, if set, is returned for every request, e.g. 429 to throttle
+	status int
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{
+		secrets:  map[string][]fakeVaultVersion{},
+		tokens:   map[string]bool{"root": true},
+		roleID:   "stealth",
+		secretID: "s3cret",
+	}
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.status != 0 {
+		f.writeError(w, f.status, http.StatusText(f.status))
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == "auth/approle/login" {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != f.roleID || body["secret_id"] != f.secretID {
+			f.writeError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		f.logins++
+		token := "approle-" + strconv.Itoa(f.logins)
+		f.tokens[token] = true
+		f.write(w, map[string]interface{}{"auth": map[string]string{"client_token": token}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		f.writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(path, "secret/data/"):
+		f.serveData(w, r, strings.TrimPrefix(path, "secret/data/"))
+	case strings.HasPrefix(path, "secret/metadata/"):
+		f.serveMetadata(w, r, strings.TrimPrefix(path, "secret/metadata/"))
+	default:
+		f.writeError(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+func (f *fakeVault) serveData(w http.ResponseWriter, r *http.Request, path string) {
+	versions := f.secrets[path]
+	switch r.Method {
+	case http.MethodPost:
+		var body struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]int         `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if cas, ok := body.Options["cas"]; ok && cas != len(versions) {
+			f.writeError(w, http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		version := fakeVaultVersion{data: body.Data, created: time.Now().UTC()}
+		f.secrets[path] = append(versions, version)
+		f.write(w, map[string]interface{}{"data": f.versionMetadata(version, len(versions)+1)})
+	case http.MethodGet:
+		number := len(versions)
+		if v := r.URL.Query().Get("version"); v != "" && v != "0" {
+			number, _ = strconv.Atoi(v)
+		}
+		if number < 1 || number > len(versions) {
+			f.writeError(w, http.StatusNotFound)
+			return
+		}
+		version := versions[number-1]
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{
+			"data":     version.data,
+			"metadata": f.versionMetadata(version, number),
+		}})
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeVault) serveMetadata(w http.ResponseWriter, r *http.Request, path string) {
+	switch r.Method {
+	case "LIST":
+		prefix := strings.TrimSuffix(path, "/") + "/"
+		keys := map[string]bool{}
+		for name := range f.secrets {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(rest, "/"); i >= 0 {
+				rest = rest[:i+1]
+			}
+			keys[rest] = true
+		}
+		if len(keys) == 0 {
+			f.writeError(w, http.StatusNotFound)
+			return
+		}
+		list := []string{}
+		for key := range keys {
+			list = append(list, key)
+		}
+		sort.Strings(list)
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{"keys": list}})
+	case http.MethodGet:
+		versions, ok := f.secrets[path]
+		if !ok {
+			f.writeError(w, http.StatusNotFound)
+			return
+		}
+		metadata := map[string]interface{}{}
+		for i, version := range versions {
+			metadata[strconv.Itoa(i+1)] = f.versionMetadata(version, i+1)
+		}
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(versions),
+			"versions":        metadata,
+		}})
+	case http.MethodDelete:
+		delete(f.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeVault) versionMetadata(version fakeVaultVersion, number int) map[string]interface{} {
+	return map[string]interface{}{
+		"created_time":  version.created.Format(time.RFC3339Nano),
+		"deletion_time": "",
+		"destroyed":     false,
+		"version":       number,
+	}
+}
+
+func (f *fakeVault) write(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeVault) writeError(w http.ResponseWriter, status int, errs ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": append([]string{}, errs...)})
+}
+
+func newTestVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	fake := newFakeVault()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func TestVaultStore(t *testing.T) {
+	ctx := context.Background()
+	fake, server := newTestVault(t)
+	s, err := NewVaultStore(VaultConfig{Address: server.URL, Token: "root"})
+	assert.NoError(t, err)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("no secrets exist, to begin")
+	_, err = s.Read(ctx, id)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+	_, err = s.Update(ctx, id, "bar")
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+
+	t.Log("write a secret, and read it back")
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Equal(t, secret.Meta.Version, 0)
+	assert.Equal(t, s.Create(ctx, id, "bar"), &IdentifierAlreadyExistsError{Identifier: id})
+
+	t.Log("updates create new versions")
+	secret, err = s.Update(ctx, id, "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 1)
+	secret, err = s.ReadVersion(ctx, id, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	secret, err = s.ReadVersion(ctx, id, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "baz")
+	_, err = s.ReadVersion(ctx, id, 2)
+	assert.Equal(t, err, &VersionNotFoundError{Identifier: id, Version: 2})
+	_, err = s.ReadVersion(ctx, id, -1)
+	assert.Equal(t, err, &VersionNotFoundError{Identifier: id, Version: -1})
+	history, err := s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[0].Version, 0)
+	assert.Equal(t, history[1].Version, 1)
+
+	t.Log("conditional updates use check-and-set")
+	_, err = s.UpdateIfVersion(ctx, id, 0, "qux")
+	assert.Equal(t, err, &VersionConflictError{Identifier: id, Expected: 0, Actual: 1})
+	_, err = s.UpdateIfVersion(ctx, id, -1, "qux")
+	assert.Equal(t, err, &VersionConflictError{Identifier: id, Expected: -1, Actual: 1})
+	secret, err = s.UpdateIfVersion(ctx, id, 1, "qux")
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Meta.Version, 2)
+	history, err = s.History(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, len(history), 3)
+
+	t.Log("list secrets by service and by environment")
+	sibling := GetRandomTestSecretIdentifier()
+	sibling.Service = id.Service
+	other := GetRandomTestSecretIdentifier()
+	assert.NoError(t, s.Create(ctx, sibling, "bar"))
+	assert.NoError(t, s.Create(ctx, other, "bar"))
+	ids, err := s.List(ctx, id.Environment, id.Service)
+	assert.NoError(t, err)
+	expected := []SecretIdentifier{id, sibling}
+	sort.Sort(ByIDString(expected))
+	assert.Equal(t, ids, expected)
+	ids, err = s.ListAll(ctx, id.Environment)
+	assert.NoError(t, err)
+	expected = append(expected, other)
+	sort.Sort(ByIDString(expected))
+	assert.Equal(t, ids, expected)
+	ids, err = s.List(ctx, DevelopmentEnvironment, id.Service)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{})
+
+	t.Log("nested keys are listed from subfolders")
+	nested := SecretIdentifier{Environment: id.Environment, Service: id.Service, Key: "db/password"}
+	assert.NoError(t, s.Create(ctx, nested, "bar"))
+	ids, err = s.ListPrefix(ctx, id.Environment, id.Service, "db/")
+	assert.NoError(t, err)
+	assert.Equal(t, ids, []SecretIdentifier{nested})
+	ids, err = s.List(ctx, id.Environment, id.Service)
+	assert.NoError(t, err)
+	assert.Contains(t, ids, nested)
+	assert.NoError(t, s.Delete(ctx, nested))
+
+	t.Log("delete removes every version")
+	assert.NoError(t, s.Delete(ctx, id))
+	_, err = s.History(ctx, id)
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+	assert.Equal(t, s.Delete(ctx, id), &IdentifierNotFoundError{Identifier: id})
+
+	t.Log("conditional updates of a secret with no versions left fail as not found")
+	fake.mu.Lock()
+	fake.secrets[getVaultPath(id)] = []fakeVaultVersion{}
+	fake.mu.Unlock()
+	_, err = s.UpdateIfVersion(ctx, id, 0, "baz")
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+	_, err = s.UpdateIfVersion(ctx, id, -1, "baz")
+	assert.Equal(t, err, &IdentifierNotFoundError{Identifier: id})
+
+	t.Log("throttled and unavailable requests fail as throttled")
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		fake.mu.Lock()
+		fake.status = status
+		fake.mu.Unlock()
+		_, err = s.Read(ctx, id)
+		assert.IsType(t, &ThrottlingError{}, err)
+		assert.Equal(t, ErrorType(err), ErrorTypeThrottling)
+	}
+}
+
+func TestVaultStoreAuth(t *testing.T) {
+	ctx := context.Background()
+	fake, server := newTestVault(t)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Log("a bad token is unauthorized")
+	s, err := NewVaultStore(VaultConfig{Address: server.URL, Token: "bogus"})
+	assert.NoError(t, err)
+	_, err = s.Read(ctx, id)
+	assert.Equal(t, err, &AuthorizationError{Identifier: id})
+
+	t.Log("AppRole logs in on first use")
+	s, err = NewVaultStore(VaultConfig{Address: server.URL, RoleID: "stealth", SecretID: "s3cret"})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+	assert.Equal(t, fake.logins, 1)
+
+	t.Log("AppRole logs in again when its token is rejected")
+	fake.mu.Lock()
+	fake.tokens = map[string]bool{}
+	fake.mu.Unlock()
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+	assert.Equal(t, fake.logins, 2)
+
+	t.Log("bad AppRole credentials fail to authenticate")
+	s, err = NewVaultStore(VaultConfig{Address: server.URL, RoleID: "stealth", SecretID: "wrong"})
+	assert.NoError(t, err)
+	_, err = s.Read(ctx, id)
+	assert.Equal(t, err, &AuthenticationError{})
+}
+
+func TestOpenVaultStore(t *testing.T) {
+	ctx := context.Background()
+	_, server := newTestVault(t)
+	id := GetRandomTestSecretIdentifier()
+
+	t.Setenv("VAULT_TOKEN", "root")
+	s, err := Open("vault://" + strings.TrimPrefix(server.URL, "http://") + "/secret?insecure=true")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Create(ctx, id, "bar"))
+
+	t.Log("the address can come from the environment, and AppRole from the URL")
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_SECRET_ID", "s3cret")
+	s, err = Open("vault://?role-id=stealth")
+	assert.NoError(t, err)
+	secret, err := s.Read(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, "bar")
+}